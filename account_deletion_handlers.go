@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ehumba/chirpy-web-server/internal/auth"
+	"github.com/ehumba/chirpy-web-server/internal/database"
+)
+
+const (
+	accountDeletionGracePeriod = 30 * 24 * time.Hour
+	accountPurgeInterval       = time.Hour
+)
+
+func (a *apiConfig) handlerDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	caller := principalFromContext(r.Context())
+	if !requireSession(w, caller) {
+		return
+	}
+	userID := caller.UserID
+
+	type reqParams struct {
+		Password string `json:"password"`
+	}
+
+	params := reqParams{}
+	err := decodeJSON(r, &params)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+
+	userDB, err := a.dbQueries.LookUpByID(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, 404, "user not found")
+		return
+	}
+
+	// the password check is as open to guessing as the login itself
+	accountKey := accountThrottleKey(userDB.Email)
+	lockedUntil, err := a.loginLockedUntil(r.Context(), accountKey)
+	if err != nil {
+		respondWithError(w, 500, "failed to check login attempts")
+		return
+	}
+	if !lockedUntil.IsZero() {
+		respondWithLockout(w, lockedUntil)
+		return
+	}
+
+	err = auth.CheckPasswordHash(params.Password, userDB.HashedPassword)
+	if errors.Is(err, auth.ErrUnknownHash) {
+		respondWithError(w, 409, "set a password before deleting the account")
+		return
+	}
+	if err != nil {
+		err = a.recordLoginFailure(r.Context(), accountKey, accountLoginThrottle)
+		if err != nil {
+			respondWithError(w, 500, "failed to record login attempt")
+			return
+		}
+		respondWithError(w, 401, "incorrect password")
+		return
+	}
+
+	deletion, err := a.dbQueries.ScheduleAccountDeletion(r.Context(), database.ScheduleAccountDeletionParams{
+		UserID:     userID,
+		PurgeAfter: time.Now().Add(accountDeletionGracePeriod),
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to schedule account deletion")
+		return
+	}
+
+	// log out everywhere; logging in again restores the account
+	err = a.dbQueries.RevokeRefreshTokensForUser(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, 500, "failed to revoke refresh tokens")
+		return
+	}
+
+	err = a.dbQueries.RevokePersonalAccessTokensForUser(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, 500, "failed to revoke personal access tokens")
+		return
+	}
+
+	if a.cookieSessions {
+		a.clearSessionCookies(w)
+	}
+
+	resStruct := struct {
+		DeleteAfter time.Time `json:"delete_after"`
+	}{
+		DeleteAfter: deletion.PurgeAfter,
+	}
+
+	respondWithJSON(w, 202, resStruct)
+}
+
+// purgeDeletedAccounts permanently deletes the accounts whose grace period
+// has ended. Chirps, tokens and everything else that belongs to the user is
+// removed by the ON DELETE CASCADE constraints.
+func (a *apiConfig) purgeDeletedAccounts(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		rows, err := a.dbQueries.PurgeDeletedAccounts(ctx)
+		if err != nil {
+			log.Printf("failed to purge deleted accounts: %v", err)
+		} else if rows > 0 {
+			log.Printf("purged %d deleted accounts", rows)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/ehumba/chirpy-web-server/internal/auth"
+	"github.com/ehumba/chirpy-web-server/internal/database"
+)
+
+// grantAdminRoles gives the admin role to the accounts with the given
+// emails, a comma separated list. Emails without an account are skipped,
+// so the role is granted on the next start after the account was created.
+func (a *apiConfig) grantAdminRoles(ctx context.Context, emails string) error {
+	for _, email := range strings.Split(emails, ",") {
+		email = strings.TrimSpace(email)
+		if email == "" {
+			continue
+		}
+
+		userDB, err := a.dbQueries.LookUpByEmail(ctx, email)
+		if errors.Is(err, sql.ErrNoRows) {
+			log.Printf("no account for admin %s yet", email)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to look up admin %s: %v", email, err)
+		}
+
+		err = a.dbQueries.AddUserRole(ctx, database.AddUserRoleParams{
+			UserID: userDB.ID,
+			Role:   auth.RoleAdmin,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to grant admin role to %s: %v", email, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/mail"
+	"reflect"
+	"regexp"
+
+	"github.com/lib/pq"
+)
+
+// apiError is an error with the response it should produce. Handlers and
+// helpers return it where the status depends on the kind of failure, and
+// respondWithAPIError turns it into the usual {"error": ...} body, plus the
+// field-level errors if there are any.
+type apiError struct {
+	Code    int
+	Message string
+	Fields  []fieldError
+	Err     error
+}
+
+func (e *apiError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *apiError) Unwrap() error {
+	return e.Err
+}
+
+func respondWithAPIError(w http.ResponseWriter, err error) error {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		log.Printf("unexpected error: %v", err)
+		return respondWithError(w, 500, "internal server error")
+	}
+	if apiErr.Code >= 500 && apiErr.Err != nil {
+		log.Printf("%s: %v", apiErr.Message, apiErr.Err)
+	}
+	if len(apiErr.Fields) == 0 {
+		return respondWithError(w, apiErr.Code, apiErr.Message)
+	}
+	return respondWithJSON(w, apiErr.Code, struct {
+		Error  string       `json:"error"`
+		Fields []fieldError `json:"fields"`
+	}{
+		Error:  apiErr.Message,
+		Fields: apiErr.Fields,
+	})
+}
+
+// decodeJSON decodes the request body into v. Malformed bodies are reported
+// as 400, values of the wrong type additionally name the offending field.
+func decodeJSON(r *http.Request, v any) error {
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(v)
+	if err == nil {
+		return nil
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, io.EOF):
+		return &apiError{Code: 400, Message: "request body must not be empty", Err: err}
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return &apiError{
+			Code:    400,
+			Message: "validation failed",
+			Fields: []fieldError{{
+				Field:   typeErr.Field,
+				Code:    "invalid_type",
+				Message: typeErr.Field + " must be " + jsonTypeName(typeErr.Type),
+			}},
+			Err: err,
+		}
+	}
+	return &apiError{Code: 400, Message: "could not decode parameters", Err: err}
+}
+
+func jsonTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	}
+	return "an object"
+}
+
+// Postgres error codes, see https://www.postgresql.org/docs/current/errcodes-appendix.html
+const (
+	pgUniqueViolation     = "23505"
+	pgForeignKeyViolation = "23503"
+	pgNotNullViolation    = "23502"
+	pgCheckViolation      = "23514"
+	pgStringTooLong       = "22001"
+	pgInvalidText         = "22P02"
+)
+
+var pgDetailKey = regexp.MustCompile(`^Key \(([^)]+)\)=`)
+
+// dbError translates a database error into an apiError: constraint
+// violations caused by the request become 409 or 422, missing rows 404 and
+// everything else a 500 with msg.
+func dbError(err error, msg string) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return &apiError{Code: 404, Message: "not found", Err: err}
+	}
+
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return &apiError{Code: 500, Message: msg, Err: err}
+	}
+
+	field := pqErr.Column
+	if m := pgDetailKey.FindStringSubmatch(pqErr.Detail); m != nil {
+		field = m[1]
+	}
+
+	switch pqErr.Code {
+	case pgUniqueViolation:
+		return conflictError(field)
+	case pgForeignKeyViolation, pgNotNullViolation, pgCheckViolation, pgStringTooLong, pgInvalidText:
+		fe := fieldError{Field: field, Code: "invalid", Message: pqErr.Message}
+		return &apiError{Code: 422, Message: "validation failed", Fields: []fieldError{fe}, Err: err}
+	}
+	return &apiError{Code: 500, Message: msg, Err: err}
+}
+
+func conflictError(field string) error {
+	return &apiError{
+		Code:    409,
+		Message: field + " is already taken",
+		Fields: []fieldError{{
+			Field:   field,
+			Code:    "taken",
+			Message: field + " is already taken",
+		}},
+	}
+}
+
+func validateEmail(email string) []fieldError {
+	if email == "" {
+		return []fieldError{{Field: "email", Code: "required", Message: "email is required"}}
+	}
+	// reject display names and comments, only a bare address is allowed
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" || addr.Address != email {
+		return []fieldError{{Field: "email", Code: "invalid", Message: "email is not a valid email address"}}
+	}
+	return nil
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
-	"encoding/json"
+	"database/sql"
+	"errors"
+	"fmt"
 	"net/http"
 	"sort"
 	"time"
@@ -19,23 +21,36 @@ func (a *apiConfig) handlerCreateUser(w http.ResponseWriter, r *http.Request) {
 		Password string `json:"password"`
 	}
 
-	decoder := json.NewDecoder(r.Body)
 	params := reqParams{}
-	err := decoder.Decode(&params)
+	err := decodeJSON(r, &params)
 	if err != nil {
-		respondWithError(w, 500, "could not decode email")
+		respondWithAPIError(w, err)
 		return
 	}
 
-	hashedPassword, err := auth.HashPassword(params.Password)
+	validationErrs, err := a.validatePassword(params.Password)
 	if err != nil {
-		respondWithError(w, 500, "invalid password")
+		respondWithError(w, 500, "failed to validate password")
+		return
+	}
+	validationErrs = append(validationErrs, validateEmail(params.Email)...)
+	if len(validationErrs) > 0 {
+		respondWithValidationErrors(w, validationErrs)
+		return
+	}
+
+	hashedPassword, err := a.passwordHasher.Hash(params.Password)
+	if err != nil {
+		respondWithError(w, 500, "failed to hash password")
 		return
 	}
 
-	newUserDb, err := a.dbQueries.CreateUser(r.Context(), database.CreateUserParams{params.Email, hashedPassword})
+	newUserDb, err := a.dbQueries.CreateUser(r.Context(), database.CreateUserParams{
+		Email:          params.Email,
+		HashedPassword: hashedPassword,
+	})
 	if err != nil {
-		respondWithError(w, 500, "failed to create new user")
+		respondWithAPIError(w, dbError(err, "failed to create new user"))
 		return
 	}
 
@@ -56,24 +71,36 @@ func (a *apiConfig) handlerChirps(w http.ResponseWriter, r *http.Request) {
 		Body string `json:"body"`
 	}
 
-	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
-	err := decoder.Decode(&params)
+	err := decodeJSON(r, &params)
 	if err != nil {
-		respondWithError(w, 400, "could not decode parameters")
+		respondWithAPIError(w, err)
 		return
 	}
 
 	// authenticate
-	bearerToken, err := auth.GetBearerToken(r.Header)
+	caller := principalFromContext(r.Context())
+	if !requireScope(w, caller, auth.ScopeChirpsWrite) {
+		return
+	}
+	id := caller.UserID
+
+	limits, err := a.entitlementsFor(r.Context(), id)
 	if err != nil {
-		respondWithError(w, 401, "invalid authentication header")
+		respondWithError(w, 500, "failed to look up entitlements")
 		return
 	}
 
-	id, err := auth.ValidateJWT(bearerToken, a.secret)
+	recentChirps, err := a.dbQueries.CountChirpsSince(r.Context(), database.CountChirpsSinceParams{
+		UserID:    id,
+		CreatedAt: time.Now().Add(-time.Hour),
+	})
 	if err != nil {
-		respondWithError(w, 401, "no authorization")
+		respondWithError(w, 500, "failed to count chirps")
+		return
+	}
+	if recentChirps >= int64(limits.ChirpsPerHour) {
+		respondWithError(w, 429, fmt.Sprintf("you can post %d chirps per hour", limits.ChirpsPerHour))
 		return
 	}
 
@@ -81,13 +108,21 @@ func (a *apiConfig) handlerChirps(w http.ResponseWriter, r *http.Request) {
 	cleansedBody := removeProfane(params.Body)
 
 	charCount := utf8.RuneCountInString(cleansedBody)
-	if charCount > 140 {
+	if charCount > limits.MaxChirpLength {
 		respondWithError(w, 400, "Chirp is too long")
 		return
 	}
 
 	// if valid, respond.
-	newChirpDb, err := a.dbQueries.CreateChirp(r.Context(), database.CreateChirpParams{Body: cleansedBody, UserID: id})
+	tx, err := a.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondWithError(w, 500, "failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+	qtx := a.dbQueries.WithTx(tx)
+
+	newChirpDb, err := qtx.CreateChirp(r.Context(), database.CreateChirpParams{Body: cleansedBody, UserID: id})
 	if err != nil {
 		respondWithError(w, 500, "failed to create new chirp")
 		return
@@ -100,6 +135,19 @@ func (a *apiConfig) handlerChirps(w http.ResponseWriter, r *http.Request) {
 		UserID:    newChirpDb.UserID,
 	}
 
+	err = publishEvent(r.Context(), qtx, eventChirpCreated, id, newChirp)
+	if err != nil {
+		respondWithError(w, 500, "failed to create new chirp")
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		respondWithError(w, 500, "failed to save new chirp")
+		return
+	}
+	a.events.Wake()
+
 	respondWithJSON(w, 201, &newChirp)
 }
 
@@ -155,8 +203,13 @@ func (a *apiConfig) handlerGetChirps(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *apiConfig) handlerGetChirp(w http.ResponseWriter, r *http.Request) {
-	idString := r.PathValue("chirpID")
-	chirpDB, err := a.dbQueries.GetChirp(r.Context(), uuid.MustParse(idString))
+	chirpID, err := uuid.Parse(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid chirp ID format")
+		return
+	}
+
+	chirpDB, err := a.dbQueries.GetChirp(r.Context(), chirpID)
 	if err != nil {
 		respondWithError(w, 404, "chirp not found")
 		return
@@ -178,22 +231,135 @@ func (a *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 		Email    string `json:"email"`
 	}
 
-	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
-	err := decoder.Decode(&params)
+	err := decodeJSON(r, &params)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+
+	accountKey := accountThrottleKey(params.Email)
+	ipKey := ipThrottleKey(r)
+
+	lockedUntil, err := a.loginLockedUntil(r.Context(), accountKey, ipKey)
 	if err != nil {
-		respondWithError(w, 500, "could not decode parameters")
+		respondWithError(w, 500, "failed to check login attempts")
+		return
+	}
+	if !lockedUntil.IsZero() {
+		respondWithLockout(w, lockedUntil)
 		return
 	}
 
 	userDB, err := a.dbQueries.LookUpByEmail(r.Context(), params.Email)
-	hashErr := auth.CheckPasswordHash(params.Password, userDB.HashedPassword)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, 500, "failed to look up user")
+		return
+	}
+
+	// always pay for one bcrypt comparison so unknown emails are not faster
+	var hashErr error
+	if err == nil {
+		hashErr = auth.CheckPasswordHash(params.Password, userDB.HashedPassword)
+	} else {
+		a.passwordHasher.CheckDummy(params.Password)
+	}
+
 	if err != nil || hashErr != nil {
+		err = a.recordLoginFailure(r.Context(), accountKey, accountLoginThrottle)
+		if err != nil {
+			respondWithError(w, 500, "failed to record login attempt")
+			return
+		}
+		err = a.recordLoginFailure(r.Context(), ipKey, ipLoginThrottle)
+		if err != nil {
+			respondWithError(w, 500, "failed to record login attempt")
+			return
+		}
 		respondWithError(w, 401, "Incorrect email or password")
 		return
 	}
 
-	authToken, err := auth.MakeJWT(userDB.ID, a.secret, time.Hour)
+	// upgrade hashes made with an older algorithm or older parameters while
+	// the plain password is at hand
+	if a.passwordHasher.NeedsRehash(userDB.HashedPassword) {
+		hashedPassword, err := a.passwordHasher.Hash(params.Password)
+		if err != nil {
+			respondWithError(w, 500, "failed to hash password")
+			return
+		}
+		err = a.dbQueries.UpdatePasswordHash(r.Context(), database.UpdatePasswordHashParams{
+			ID:             userDB.ID,
+			HashedPassword: hashedPassword,
+		})
+		if err != nil {
+			respondWithError(w, 500, "failed to update password hash")
+			return
+		}
+		userDB.HashedPassword = hashedPassword
+	}
+
+	a.respondWithLogin(w, r, userDB)
+}
+
+// respondWithLogin finishes a first-factor login: users with two-factor
+// authentication get a challenge, everyone else gets their tokens.
+func (a *apiConfig) respondWithLogin(w http.ResponseWriter, r *http.Request, userDB database.User) {
+	totp, err := a.dbQueries.GetTOTP(r.Context(), userDB.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, 500, "failed to look up two-factor settings")
+		return
+	}
+
+	if err == nil && totp.EnabledAt.Valid {
+		challengeToken, err := auth.MakeRefreshToken()
+		if err != nil {
+			respondWithError(w, 500, "failed to create login challenge")
+			return
+		}
+
+		_, err = a.dbQueries.CreateLoginChallenge(r.Context(), database.CreateLoginChallengeParams{
+			Token:     challengeToken,
+			UserID:    userDB.ID,
+			ExpiresAt: time.Now().Add(5 * time.Minute),
+		})
+		if err != nil {
+			respondWithError(w, 500, "failed to save login challenge")
+			return
+		}
+
+		resStruct := struct {
+			TwoFactorRequired bool   `json:"two_factor_required"`
+			ChallengeToken    string `json:"challenge_token"`
+		}{
+			TwoFactorRequired: true,
+			ChallengeToken:    challengeToken,
+		}
+
+		respondWithJSON(w, 200, resStruct)
+		return
+	}
+
+	a.respondWithTokens(w, r, userDB)
+}
+
+func (a *apiConfig) respondWithTokens(w http.ResponseWriter, r *http.Request, userDB database.User) {
+	// only a complete login resets the throttle, so a known password doesn't
+	// give unlimited tries at the second factor
+	err := a.dbQueries.ClearLoginFailures(r.Context(), accountThrottleKey(userDB.Email))
+	if err != nil {
+		respondWithError(w, 500, "failed to reset login attempts")
+		return
+	}
+
+	// logging in during the grace period restores a deleted account
+	_, err = a.dbQueries.CancelAccountDeletion(r.Context(), userDB.ID)
+	if err != nil {
+		respondWithError(w, 500, "failed to restore account")
+		return
+	}
+
+	authToken, err := a.makeAccessToken(r.Context(), userDB.ID)
 	if err != nil {
 		respondWithError(w, 500, "failed to create authentication token")
 		return
@@ -208,7 +374,7 @@ func (a *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 	refreshTokenParams := database.GenerateRefreshTokenParams{
 		Token:     refreshToken,
 		UserID:    userDB.ID,
-		ExpiresAt: time.Now().Add(60 * 24 * time.Hour),
+		ExpiresAt: time.Now().Add(a.tokens.RefreshTokenTTL),
 	}
 	_, err = a.dbQueries.GenerateRefreshToken(r.Context(), refreshTokenParams)
 	if err != nil {
@@ -224,6 +390,27 @@ func (a *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 		IsChirpyRed: userDB.IsChirpyRed,
 	}
 
+	// browser sessions keep the tokens in cookies, out of reach of scripts
+	if a.cookieSessions {
+		csrfToken, err := auth.MakeRefreshToken()
+		if err != nil {
+			respondWithError(w, 500, "failed to create csrf token")
+			return
+		}
+		a.setSessionCookies(w, authToken, refreshToken, csrfToken)
+
+		resStruct := struct {
+			User      `json:",inline"`
+			CSRFToken string `json:"csrf_token"`
+		}{
+			User:      user,
+			CSRFToken: csrfToken,
+		}
+
+		respondWithJSON(w, 200, resStruct)
+		return
+	}
+
 	resStruct := struct {
 		User         `json:",inline"`
 		Token        string `json:"token"`
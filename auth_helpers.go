@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/ehumba/chirpy-web-server/internal/auth"
+	"github.com/google/uuid"
+)
+
+func (a *apiConfig) makeAccessToken(ctx context.Context, userID uuid.UUID) (string, error) {
+	roles, err := a.dbQueries.GetUserRoles(ctx, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get roles: %v", err)
+	}
+	return auth.MakeJWT(userID, a.tokens, auth.DefaultScopes, roles)
+}
+
+// validateAccessToken checks the signature and claims of an access token and
+// rejects tokens that were revoked before they expired.
+func (a *apiConfig) validateAccessToken(ctx context.Context, token string) (*auth.Claims, error) {
+	claims, err := auth.ValidateJWT(token, a.tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	revoked, err := a.dbQueries.IsAccessTokenRevoked(ctx, claims.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check token revocation: %v", err)
+	}
+	if revoked {
+		return nil, fmt.Errorf("token has been revoked")
+	}
+
+	return claims, nil
+}
+
+const (
+	tokenTypeSession             = "session"
+	tokenTypePersonalAccessToken = "personal_access_token"
+)
+
+// principal is the caller behind an authenticated request.
+type principal struct {
+	UserID    uuid.UUID
+	Scopes    []string
+	Roles     []string
+	TokenType string
+	// zero if the token doesn't expire
+	ExpiresAt time.Time
+}
+
+func (p *principal) HasScope(scope string) bool {
+	return slices.Contains(p.Scopes, scope)
+}
+
+func (p *principal) HasRole(role string) bool {
+	return slices.Contains(p.Roles, role)
+}
+
+// authenticate accepts both access tokens from a login and personal access
+// tokens. Personal access tokens never carry roles.
+func (a *apiConfig) authenticate(ctx context.Context, token string) (*principal, error) {
+	var caller *principal
+	if auth.IsPersonalAccessToken(token) {
+		pat, err := a.dbQueries.GetPersonalAccessTokenByHash(ctx, auth.HashPersonalAccessToken(token))
+		if err != nil {
+			return nil, fmt.Errorf("invalid personal access token: %v", err)
+		}
+
+		err = a.dbQueries.TouchPersonalAccessToken(ctx, pat.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update personal access token: %v", err)
+		}
+
+		caller = &principal{
+			UserID:    pat.UserID,
+			Scopes:    pat.Scopes,
+			TokenType: tokenTypePersonalAccessToken,
+			ExpiresAt: pat.ExpiresAt.Time,
+		}
+	} else {
+		claims, err := a.validateAccessToken(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+
+		caller = &principal{
+			UserID:    claims.UserID,
+			Scopes:    claims.Scopes,
+			Roles:     claims.Roles,
+			TokenType: tokenTypeSession,
+		}
+		if claims.ExpiresAt != nil {
+			caller.ExpiresAt = claims.ExpiresAt.Time
+		}
+	}
+
+	// access tokens outlive the refresh tokens revoked by an account
+	// deletion, and a personal access token can outlive a revocation that
+	// failed halfway
+	pending, err := a.dbQueries.IsAccountPendingDeletion(ctx, caller.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check account status: %v", err)
+	}
+	if pending {
+		return nil, fmt.Errorf("account is scheduled for deletion")
+	}
+	return caller, nil
+}
+
+// requireScope responds with 403 and returns false if the caller's token
+// was not granted the scope.
+func requireScope(w http.ResponseWriter, caller *principal, scope string) bool {
+	if !caller.HasScope(scope) {
+		setAuthenticateHeader(w, "insufficient_scope", "the token is missing the "+scope+" scope", scope)
+		respondWithError(w, 403, "token is missing the "+scope+" scope")
+		return false
+	}
+	return true
+}
+
+// requireSession responds with 403 and returns false unless the caller used
+// an access token from a login. Managing credentials is not possible with
+// personal access tokens.
+func requireSession(w http.ResponseWriter, caller *principal) bool {
+	if caller.TokenType != tokenTypeSession {
+		setAuthenticateHeader(w, "insufficient_scope", "this endpoint requires a login session", "")
+		respondWithError(w, 403, "this endpoint requires a login session")
+		return false
+	}
+	return true
+}
+
+// validatePassword checks a new password against the password policy and
+// the breached password list.
+func (a *apiConfig) validatePassword(password string) ([]fieldError, error) {
+	errs := []fieldError{}
+	for _, violation := range a.passwordPolicy.Validate(password) {
+		errs = append(errs, fieldError{
+			Field:   "password",
+			Code:    violation.Code,
+			Message: violation.Message,
+		})
+	}
+
+	if a.breachedPasswords == nil || len(errs) > 0 {
+		return errs, nil
+	}
+
+	count, err := a.breachedPasswords.Count(password)
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		errs = append(errs, fieldError{
+			Field:   "password",
+			Code:    "breached",
+			Message: "this password has appeared in a data breach, please choose another one",
+		})
+	}
+	return errs, nil
+}
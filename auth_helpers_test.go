@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ehumba/chirpy-web-server/internal/auth"
+	"github.com/ehumba/chirpy-web-server/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestAuthenticateRejectsAccountPendingDeletion(t *testing.T) {
+	tests := []struct {
+		name      string
+		makeToken func(t *testing.T, a *apiConfig, userID uuid.UUID) string
+	}{
+		{
+			name: "access token",
+			makeToken: func(t *testing.T, a *apiConfig, userID uuid.UUID) string {
+				token, err := auth.MakeJWT(userID, a.tokens, auth.DefaultScopes, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return token
+			},
+		},
+		{
+			name: "personal access token",
+			makeToken: func(t *testing.T, a *apiConfig, userID uuid.UUID) string {
+				token, err := auth.MakePersonalAccessToken()
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = a.dbQueries.CreatePersonalAccessToken(context.Background(), database.CreatePersonalAccessTokenParams{
+					UserID:    userID,
+					Name:      "bot",
+					TokenHash: auth.HashPersonalAccessToken(token),
+					Scopes:    []string{auth.ScopeChirpsRead},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return token
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, q := newTestDB(t)
+			a := &apiConfig{
+				db:        db,
+				dbQueries: q,
+				tokens: auth.TokenConfig{
+					Keys:           auth.NewHMACKeySet("test-secret"),
+					Issuer:         "chirpy",
+					Audience:       []string{"chirpy"},
+					AccessTokenTTL: time.Hour,
+				},
+			}
+			ctx := context.Background()
+			userDB := createTestUser(t, q, "alice@example.com")
+			token := tt.makeToken(t, a, userDB.ID)
+
+			caller, err := a.authenticate(ctx, token)
+			if err != nil {
+				t.Fatalf("authenticate() error = %v", err)
+			}
+			if caller.UserID != userDB.ID {
+				t.Fatalf("authenticate() UserID = %v, want %v", caller.UserID, userDB.ID)
+			}
+
+			// the token itself stays valid, as if revoking it had failed
+			_, err = q.ScheduleAccountDeletion(ctx, database.ScheduleAccountDeletionParams{
+				UserID:     userDB.ID,
+				PurgeAfter: time.Now().Add(accountDeletionGracePeriod),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = a.authenticate(ctx, token)
+			if err == nil {
+				t.Fatal("authenticate() accepted a token of an account pending deletion")
+			}
+		})
+	}
+}
@@ -1,78 +1,307 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"net/http"
+	"time"
+	"unicode/utf8"
 
 	"github.com/ehumba/chirpy-web-server/internal/auth"
 	"github.com/ehumba/chirpy-web-server/internal/database"
 	"github.com/google/uuid"
 )
 
+// handlerUpdate changes only the fields present in the request. A new
+// email address takes effect once it has been confirmed, see
+// handlerConfirmEmailChange. Both changes need a login session and the
+// current password, and a new password logs out every other session.
 func (a *apiConfig) handlerUpdate(w http.ResponseWriter, r *http.Request) {
-	token, err := auth.GetBearerToken(r.Header)
+	caller := principalFromContext(r.Context())
+	if !requireScope(w, caller, auth.ScopeProfileWrite) {
+		return
+	}
+	if !requireSession(w, caller) {
+		return
+	}
+	userID := caller.UserID
+
+	type reqParams struct {
+		Email           *string `json:"email"`
+		Password        *string `json:"password"`
+		CurrentPassword string  `json:"current_password"`
+	}
+
+	params := reqParams{}
+	err := decodeJSON(r, &params)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+
+	if params.Email == nil && params.Password == nil {
+		respondWithError(w, 400, "nothing to update")
+		return
+	}
+
+	validationErrs := []fieldError{}
+	if params.Password != nil {
+		validationErrs, err = a.validatePassword(*params.Password)
+		if err != nil {
+			respondWithError(w, 500, "failed to validate password")
+			return
+		}
+	}
+	if params.Email != nil {
+		validationErrs = append(validationErrs, validateEmail(*params.Email)...)
+	}
+	if len(validationErrs) > 0 {
+		respondWithValidationErrors(w, validationErrs)
+		return
+	}
+
+	userDB, err := a.dbQueries.LookUpByID(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, 500, "error while retrieving user data")
+		return
+	}
+
+	// the password check is as open to guessing as the login itself
+	accountKey := accountThrottleKey(userDB.Email)
+	lockedUntil, err := a.loginLockedUntil(r.Context(), accountKey)
+	if err != nil {
+		respondWithError(w, 500, "failed to check login attempts")
+		return
+	}
+	if !lockedUntil.IsZero() {
+		respondWithLockout(w, lockedUntil)
+		return
+	}
+
+	// accounts created through a linked provider have no password to
+	// confirm yet
+	err = auth.CheckPasswordHash(params.CurrentPassword, userDB.HashedPassword)
+	if err != nil && !errors.Is(err, auth.ErrUnknownHash) {
+		err = a.recordLoginFailure(r.Context(), accountKey, accountLoginThrottle)
+		if err != nil {
+			respondWithError(w, 500, "failed to record login attempt")
+			return
+		}
+		respondWithError(w, 401, "incorrect current password")
+		return
+	}
+
+	// the email is checked first, so a taken address leaves the password
+	// unchanged as well
+	pendingEmail := ""
+	if params.Email != nil && *params.Email != userDB.Email {
+		ok := a.requestEmailChange(w, r, userDB, *params.Email)
+		if !ok {
+			return
+		}
+		pendingEmail = *params.Email
+	}
+
+	refreshToken := ""
+	if params.Password != nil {
+		hashedPassword, err := a.passwordHasher.Hash(*params.Password)
+		if err != nil {
+			respondWithError(w, 500, "failed to hash password")
+			return
+		}
+
+		tx, err := a.db.BeginTx(r.Context(), nil)
+		if err != nil {
+			respondWithError(w, 500, "failed to start transaction")
+			return
+		}
+		defer tx.Rollback()
+		qtx := a.dbQueries.WithTx(tx)
+
+		err = qtx.UpdateUserPassword(r.Context(), database.UpdateUserPasswordParams{
+			ID:             userID,
+			HashedPassword: hashedPassword,
+		})
+		if err != nil {
+			respondWithError(w, 500, "error while updating user data")
+			return
+		}
+
+		// whoever knew the old password may still hold tokens; the caller
+		// keeps its session with a new refresh token
+		err = qtx.RevokeRefreshTokensForUser(r.Context(), userID)
+		if err != nil {
+			respondWithError(w, 500, "failed to revoke refresh tokens")
+			return
+		}
+		err = qtx.RevokePersonalAccessTokensForUser(r.Context(), userID)
+		if err != nil {
+			respondWithError(w, 500, "failed to revoke personal access tokens")
+			return
+		}
+
+		refreshToken, err = auth.MakeRefreshToken()
+		if err != nil {
+			respondWithError(w, 500, "failed to create refresh token")
+			return
+		}
+		_, err = qtx.GenerateRefreshToken(r.Context(), database.GenerateRefreshTokenParams{
+			Token:     refreshToken,
+			UserID:    userID,
+			ExpiresAt: time.Now().Add(a.tokens.RefreshTokenTTL),
+		})
+		if err != nil {
+			respondWithError(w, 500, "failed to save refresh token")
+			return
+		}
+
+		passwordUserDB, err := qtx.LookUpByID(r.Context(), userID)
+		if err != nil {
+			respondWithError(w, 500, "error while retrieving updated user data")
+			return
+		}
+		err = publishEvent(r.Context(), qtx, eventUserUpdated, userID, User{
+			ID:          passwordUserDB.ID,
+			CreatedAt:   passwordUserDB.CreatedAt,
+			UpdatedAt:   passwordUserDB.UpdatedAt,
+			Email:       passwordUserDB.Email,
+			IsChirpyRed: passwordUserDB.IsChirpyRed,
+		})
+		if err != nil {
+			respondWithError(w, 500, "error while updating user data")
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			respondWithError(w, 500, "error while updating user data")
+			return
+		}
+		a.events.Wake()
+
+		if a.cookieSessions {
+			a.setRefreshCookie(w, refreshToken)
+			refreshToken = ""
+		}
+	}
+
+	updatedUserDb, err := a.dbQueries.LookUpByID(r.Context(), userID)
 	if err != nil {
-		respondWithError(w, 401, "no authorization header")
+		respondWithError(w, 500, "error while retrieving updated user data")
 		return
 	}
 
-	userID, err := auth.ValidateJWT(token, a.secret)
+	resStruct := struct {
+		User         `json:",inline"`
+		PendingEmail string `json:"pending_email,omitempty"`
+		RefreshToken string `json:"refresh_token,omitempty"`
+	}{
+		User: User{
+			ID:          updatedUserDb.ID,
+			CreatedAt:   updatedUserDb.CreatedAt,
+			UpdatedAt:   updatedUserDb.UpdatedAt,
+			Email:       updatedUserDb.Email,
+			IsChirpyRed: updatedUserDb.IsChirpyRed,
+		},
+		PendingEmail: pendingEmail,
+		RefreshToken: refreshToken,
+	}
+
+	respondWithJSON(w, 200, resStruct)
+}
+
+func (a *apiConfig) handlerEditChirp(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := uuid.Parse(r.PathValue("chirpID"))
 	if err != nil {
-		respondWithError(w, 401, "invalid user")
+		respondWithError(w, 400, "invalid chirp ID format")
+		return
+	}
+
+	caller := principalFromContext(r.Context())
+	if !requireScope(w, caller, auth.ScopeChirpsWrite) {
 		return
 	}
 
 	type reqParams struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Body string `json:"body"`
 	}
 
-	decoder := json.NewDecoder(r.Body)
 	params := reqParams{}
-	err = decoder.Decode(&params)
+	err = decodeJSON(r, &params)
 	if err != nil {
-		respondWithError(w, 400, "could not decode update parameters")
+		respondWithAPIError(w, err)
 		return
 	}
 
-	if params.Email == "" || params.Password == "" {
-		respondWithError(w, 400, "email and password are required")
+	chirpToEdit, err := a.dbQueries.GetChirp(r.Context(), chirpID)
+	if err != nil {
+		respondWithError(w, 404, "chirp not found")
 		return
 	}
 
-	hashedPassword, err := auth.HashPassword(params.Password)
+	if caller.UserID != chirpToEdit.UserID {
+		respondWithError(w, 403, "forbidden: you can only edit your own chirps")
+		return
+	}
+
+	limits, err := a.entitlementsFor(r.Context(), caller.UserID)
 	if err != nil {
-		respondWithError(w, 500, "invalid password")
+		respondWithError(w, 500, "failed to look up entitlements")
+		return
+	}
+	if limits.EditWindow == 0 {
+		respondWithError(w, 403, "editing chirps requires Chirpy Red")
+		return
+	}
+	if time.Since(chirpToEdit.CreatedAt) > limits.EditWindow {
+		respondWithError(w, 403, "this chirp can no longer be edited")
 		return
 	}
 
-	updateParams := database.UpdateUserDataParams{
-		ID:             userID,
-		Email:          params.Email,
-		HashedPassword: hashedPassword,
+	cleansedBody := removeProfane(params.Body)
+	if utf8.RuneCountInString(cleansedBody) > limits.MaxChirpLength {
+		respondWithError(w, 400, "Chirp is too long")
+		return
 	}
 
-	err = a.dbQueries.UpdateUserData(r.Context(), updateParams)
+	tx, err := a.db.BeginTx(r.Context(), nil)
 	if err != nil {
-		respondWithError(w, 500, "error while updating user data")
+		respondWithError(w, 500, "failed to start transaction")
 		return
 	}
+	defer tx.Rollback()
+	qtx := a.dbQueries.WithTx(tx)
 
-	updatedUserDb, err := a.dbQueries.LookUpByID(r.Context(), userID)
+	chirpDB, err := qtx.UpdateChirpBody(r.Context(), database.UpdateChirpBodyParams{
+		ID:   chirpID,
+		Body: cleansedBody,
+	})
 	if err != nil {
-		respondWithError(w, 500, "error while retrieving updated user data")
+		respondWithError(w, 500, "failed to update chirp")
+		return
+	}
+
+	chirp := Chirp{
+		ID:        chirpDB.ID,
+		CreatedAt: chirpDB.CreatedAt,
+		UpdatedAt: chirpDB.UpdatedAt,
+		Body:      chirpDB.Body,
+		UserID:    chirpDB.UserID,
+	}
+
+	err = publishEvent(r.Context(), qtx, eventChirpUpdated, caller.UserID, chirp)
+	if err != nil {
+		respondWithError(w, 500, "failed to update chirp")
 		return
 	}
 
-	updatedUser := User{
-		ID:          updatedUserDb.ID,
-		CreatedAt:   updatedUserDb.CreatedAt,
-		UpdatedAt:   updatedUserDb.UpdatedAt,
-		Email:       updatedUserDb.Email,
-		IsChirpyRed: updatedUserDb.IsChirpyRed,
+	err = tx.Commit()
+	if err != nil {
+		respondWithError(w, 500, "failed to save chirp")
+		return
 	}
+	a.events.Wake()
 
-	respondWithJSON(w, 200, updatedUser)
+	respondWithJSON(w, 200, chirp)
 }
 
 func (a *apiConfig) handlerDeleteChirp(w http.ResponseWriter, r *http.Request) {
@@ -83,34 +312,55 @@ func (a *apiConfig) handlerDeleteChirp(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	authToken, err := auth.GetBearerToken(r.Header)
+	caller := principalFromContext(r.Context())
+	if !requireScope(w, caller, auth.ScopeChirpsWrite) {
+		return
+	}
+	userID := caller.UserID
+
+	chirpToDelete, err := a.dbQueries.GetChirp(r.Context(), chirpID)
 	if err != nil {
-		respondWithError(w, 401, "invalid authorization")
+		respondWithError(w, 404, "chirp not found")
 		return
 	}
 
-	userID, err := auth.ValidateJWT(authToken, a.secret)
+	if userID != chirpToDelete.UserID {
+		respondWithError(w, 403, "forbidden: you can only delete your own chirps")
+		return
+	}
+
+	tx, err := a.db.BeginTx(r.Context(), nil)
 	if err != nil {
-		respondWithError(w, 401, "unauthorized access")
+		respondWithError(w, 500, "failed to start transaction")
 		return
 	}
+	defer tx.Rollback()
+	qtx := a.dbQueries.WithTx(tx)
 
-	chirpToDelete, err := a.dbQueries.GetChirp(r.Context(), chirpID)
+	err = qtx.DeleteChirp(r.Context(), chirpID)
 	if err != nil {
-		respondWithError(w, 404, "chirp not found")
+		respondWithError(w, 500, "failed to delete chirp")
 		return
 	}
 
-	if userID != chirpToDelete.UserID {
-		respondWithError(w, 403, "forbidden: you can only delete your own chirps")
+	err = publishEvent(r.Context(), qtx, eventChirpDeleted, userID, Chirp{
+		ID:        chirpToDelete.ID,
+		CreatedAt: chirpToDelete.CreatedAt,
+		UpdatedAt: chirpToDelete.UpdatedAt,
+		Body:      chirpToDelete.Body,
+		UserID:    chirpToDelete.UserID,
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to delete chirp")
 		return
 	}
 
-	err = a.dbQueries.DeleteChirp(r.Context(), chirpID)
+	err = tx.Commit()
 	if err != nil {
 		respondWithError(w, 500, "failed to delete chirp")
 		return
 	}
+	a.events.Wake()
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/ehumba/chirpy-web-server/internal/auth"
+	"github.com/ehumba/chirpy-web-server/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerBlockUser stops direct messages between the caller and a user in
+// both directions.
+func (a *apiConfig) handlerBlockUser(w http.ResponseWriter, r *http.Request) {
+	blockedID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid user ID format")
+		return
+	}
+
+	caller := principalFromContext(r.Context())
+	if !requireScope(w, caller, auth.ScopeChirpsWrite) {
+		return
+	}
+
+	if blockedID == caller.UserID {
+		respondWithError(w, 400, "you can't block yourself")
+		return
+	}
+
+	_, err = a.dbQueries.LookUpByID(r.Context(), blockedID)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, 404, "user not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "failed to look up user")
+		return
+	}
+
+	err = a.dbQueries.BlockUser(r.Context(), database.BlockUserParams{
+		BlockerID: caller.UserID,
+		BlockedID: blockedID,
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to block user")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *apiConfig) handlerUnblockUser(w http.ResponseWriter, r *http.Request) {
+	blockedID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid user ID format")
+		return
+	}
+
+	caller := principalFromContext(r.Context())
+	if !requireScope(w, caller, auth.ScopeChirpsWrite) {
+		return
+	}
+
+	err = a.dbQueries.UnblockUser(r.Context(), database.UnblockUserParams{
+		BlockerID: caller.UserID,
+		BlockedID: blockedID,
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to unblock user")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *apiConfig) handlerGetBlockedUsers(w http.ResponseWriter, r *http.Request) {
+	caller := principalFromContext(r.Context())
+	if !requireScope(w, caller, auth.ScopeChirpsRead) {
+		return
+	}
+
+	blocksDB, err := a.dbQueries.GetBlockedUsers(r.Context(), caller.UserID)
+	if err != nil {
+		respondWithError(w, 500, "failed to get blocked users")
+		return
+	}
+
+	type blockedUser struct {
+		UserID    uuid.UUID `json:"user_id"`
+		BlockedAt time.Time `json:"blocked_at"`
+	}
+
+	blocked := []blockedUser{}
+	for _, blockDB := range blocksDB {
+		blocked = append(blocked, blockedUser{
+			UserID:    blockDB.BlockedID,
+			BlockedAt: blockDB.CreatedAt,
+		})
+	}
+
+	respondWithJSON(w, 200, blocked)
+}
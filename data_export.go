@@ -0,0 +1,444 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"time"
+
+	"github.com/ehumba/chirpy-web-server/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	dataExportRetention    = 7 * 24 * time.Hour
+	dataExportLinkTTL      = time.Hour
+	dataExportPollInterval = 5 * time.Second
+)
+
+type exportedSession struct {
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+}
+
+type exportedIdentity struct {
+	CreatedAt time.Time `json:"created_at"`
+	Issuer    string    `json:"issuer"`
+	Email     string    `json:"email"`
+}
+
+type exportedBlock struct {
+	UserID    uuid.UUID `json:"user_id"`
+	BlockedAt time.Time `json:"blocked_at"`
+}
+
+type exportedWebhookEndpoint struct {
+	WebhookEndpoint
+	Deliveries []WebhookDelivery `json:"deliveries"`
+}
+
+type exportedSubscription struct {
+	Plan               string    `json:"plan"`
+	Status             string    `json:"status"`
+	CurrentPeriodStart time.Time `json:"current_period_start"`
+	CurrentPeriodEnd   time.Time `json:"current_period_end"`
+}
+
+type exportedSubscriptionEvent struct {
+	CreatedAt time.Time `json:"created_at"`
+	Event     string    `json:"event"`
+	exportedSubscription
+}
+
+type exportedMembership struct {
+	IsChirpyRed  bool                        `json:"is_chirpy_red"`
+	Subscription *exportedSubscription       `json:"subscription"`
+	History      []exportedSubscriptionEvent `json:"history"`
+}
+
+// personalData is everything Chirpy stores about a user, minus secrets such
+// as password hashes and token values.
+type personalData struct {
+	ExportedAt           time.Time                 `json:"exported_at"`
+	Profile              User                      `json:"profile"`
+	Roles                []string                  `json:"roles"`
+	TwoFactorEnabled     bool                      `json:"two_factor_enabled"`
+	Membership           exportedMembership        `json:"membership"`
+	Chirps               []Chirp                   `json:"chirps"`
+	Sessions             []exportedSession         `json:"sessions"`
+	PersonalAccessTokens []PersonalAccessToken     `json:"personal_access_tokens"`
+	Passkeys             []Passkey                 `json:"passkeys"`
+	LinkedIdentities     []exportedIdentity        `json:"linked_identities"`
+	Notifications        []Notification            `json:"notifications"`
+	Conversations        []Conversation            `json:"conversations"`
+	Messages             []Message                 `json:"messages"`
+	BlockedUsers         []exportedBlock           `json:"blocked_users"`
+	WebhookEndpoints     []exportedWebhookEndpoint `json:"webhook_endpoints"`
+}
+
+func (a *apiConfig) collectPersonalData(ctx context.Context, userID uuid.UUID) (personalData, error) {
+	userDB, err := a.dbQueries.LookUpByID(ctx, userID)
+	if err != nil {
+		return personalData{}, fmt.Errorf("failed to look up user: %v", err)
+	}
+
+	data := personalData{
+		ExportedAt: time.Now().UTC(),
+		Profile: User{
+			ID:          userDB.ID,
+			CreatedAt:   userDB.CreatedAt,
+			UpdatedAt:   userDB.UpdatedAt,
+			Email:       userDB.Email,
+			IsChirpyRed: userDB.IsChirpyRed,
+		},
+		Roles: []string{},
+		Membership: exportedMembership{
+			IsChirpyRed: userDB.IsChirpyRed,
+			History:     []exportedSubscriptionEvent{},
+		},
+		Chirps:               []Chirp{},
+		Sessions:             []exportedSession{},
+		PersonalAccessTokens: []PersonalAccessToken{},
+		Passkeys:             []Passkey{},
+		LinkedIdentities:     []exportedIdentity{},
+		Notifications:        []Notification{},
+		Conversations:        []Conversation{},
+		Messages:             []Message{},
+		BlockedUsers:         []exportedBlock{},
+		WebhookEndpoints:     []exportedWebhookEndpoint{},
+	}
+
+	roles, err := a.dbQueries.GetUserRoles(ctx, userID)
+	if err != nil {
+		return personalData{}, fmt.Errorf("failed to get roles: %v", err)
+	}
+	data.Roles = append(data.Roles, roles...)
+
+	totp, err := a.dbQueries.GetTOTP(ctx, userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return personalData{}, fmt.Errorf("failed to get two-factor settings: %v", err)
+	}
+	data.TwoFactorEnabled = err == nil && totp.EnabledAt.Valid
+
+	subscription, err := a.dbQueries.GetSubscription(ctx, userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return personalData{}, fmt.Errorf("failed to get subscription: %v", err)
+	}
+	if err == nil {
+		data.Membership.Subscription = &exportedSubscription{
+			Plan:               subscription.Plan,
+			Status:             subscription.Status,
+			CurrentPeriodStart: subscription.CurrentPeriodStart,
+			CurrentPeriodEnd:   subscription.CurrentPeriodEnd,
+		}
+	}
+
+	history, err := a.dbQueries.GetSubscriptionHistory(ctx, userID)
+	if err != nil {
+		return personalData{}, fmt.Errorf("failed to get subscription history: %v", err)
+	}
+	for _, entry := range history {
+		data.Membership.History = append(data.Membership.History, exportedSubscriptionEvent{
+			CreatedAt: entry.CreatedAt,
+			Event:     entry.Event,
+			exportedSubscription: exportedSubscription{
+				Plan:               entry.Plan,
+				Status:             entry.Status,
+				CurrentPeriodStart: entry.CurrentPeriodStart,
+				CurrentPeriodEnd:   entry.CurrentPeriodEnd,
+			},
+		})
+	}
+
+	chirps, err := a.dbQueries.GetChirpsFromAuthor(ctx, userID)
+	if err != nil {
+		return personalData{}, fmt.Errorf("failed to get chirps: %v", err)
+	}
+	for _, chirpDB := range chirps {
+		data.Chirps = append(data.Chirps, Chirp{
+			ID:        chirpDB.ID,
+			CreatedAt: chirpDB.CreatedAt,
+			UpdatedAt: chirpDB.UpdatedAt,
+			Body:      chirpDB.Body,
+			UserID:    chirpDB.UserID,
+		})
+	}
+
+	refreshTokens, err := a.dbQueries.GetRefreshTokensForUser(ctx, userID)
+	if err != nil {
+		return personalData{}, fmt.Errorf("failed to get sessions: %v", err)
+	}
+	for _, refreshToken := range refreshTokens {
+		session := exportedSession{
+			CreatedAt: refreshToken.CreatedAt,
+			ExpiresAt: refreshToken.ExpiresAt,
+		}
+		if refreshToken.RevokedAt.Valid {
+			session.RevokedAt = &refreshToken.RevokedAt.Time
+		}
+		data.Sessions = append(data.Sessions, session)
+	}
+
+	pats, err := a.dbQueries.GetPersonalAccessTokensForUser(ctx, userID)
+	if err != nil {
+		return personalData{}, fmt.Errorf("failed to get personal access tokens: %v", err)
+	}
+	for _, pat := range pats {
+		data.PersonalAccessTokens = append(data.PersonalAccessTokens, personalAccessTokenFromDB(pat))
+	}
+
+	credentials, err := a.dbQueries.GetWebAuthnCredentialsForUser(ctx, userID)
+	if err != nil {
+		return personalData{}, fmt.Errorf("failed to get passkeys: %v", err)
+	}
+	for _, credential := range credentials {
+		data.Passkeys = append(data.Passkeys, passkeyFromDB(credential))
+	}
+
+	identities, err := a.dbQueries.GetUserIdentitiesForUser(ctx, userID)
+	if err != nil {
+		return personalData{}, fmt.Errorf("failed to get linked identities: %v", err)
+	}
+	for _, identity := range identities {
+		data.LinkedIdentities = append(data.LinkedIdentities, exportedIdentity{
+			CreatedAt: identity.CreatedAt,
+			Issuer:    identity.Issuer,
+			Email:     identity.Email,
+		})
+	}
+
+	notifications, err := a.dbQueries.GetNotificationsForUser(ctx, userID)
+	if err != nil {
+		return personalData{}, fmt.Errorf("failed to get notifications: %v", err)
+	}
+	for _, notificationDB := range notifications {
+		data.Notifications = append(data.Notifications, notificationFromDB(notificationDB))
+	}
+
+	conversations, err := a.loadConversations(ctx, userID)
+	if err != nil {
+		return personalData{}, fmt.Errorf("failed to get conversations: %v", err)
+	}
+	data.Conversations = append(data.Conversations, conversations...)
+
+	// the whole conversations, like the user sees them
+	messages, err := a.dbQueries.GetMessagesForUser(ctx, userID)
+	if err != nil {
+		return personalData{}, fmt.Errorf("failed to get messages: %v", err)
+	}
+	for _, messageDB := range messages {
+		data.Messages = append(data.Messages, messageFromDB(messageDB))
+	}
+
+	blocks, err := a.dbQueries.GetBlockedUsers(ctx, userID)
+	if err != nil {
+		return personalData{}, fmt.Errorf("failed to get blocked users: %v", err)
+	}
+	for _, blockDB := range blocks {
+		data.BlockedUsers = append(data.BlockedUsers, exportedBlock{
+			UserID:    blockDB.BlockedID,
+			BlockedAt: blockDB.CreatedAt,
+		})
+	}
+
+	// without the signing secrets
+	endpoints, err := a.dbQueries.GetWebhookEndpointsForUser(ctx, userID)
+	if err != nil {
+		return personalData{}, fmt.Errorf("failed to get webhook endpoints: %v", err)
+	}
+	for _, endpointDB := range endpoints {
+		deliveries, err := a.dbQueries.GetWebhookDeliveries(ctx, endpointDB.ID)
+		if err != nil {
+			return personalData{}, fmt.Errorf("failed to get webhook deliveries: %v", err)
+		}
+		endpoint := exportedWebhookEndpoint{
+			WebhookEndpoint: webhookEndpointFromDB(endpointDB),
+			Deliveries:      []WebhookDelivery{},
+		}
+		for _, deliveryDB := range deliveries {
+			endpoint.Deliveries = append(endpoint.Deliveries, webhookDeliveryFromDB(deliveryDB))
+		}
+		data.WebhookEndpoints = append(data.WebhookEndpoints, endpoint)
+	}
+
+	return data, nil
+}
+
+var personalDataTemplate = template.Must(template.New("export").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <title>Your Chirpy data</title>
+  </head>
+  <body>
+    <h1>Your Chirpy data</h1>
+    <p>Exported on {{.ExportedAt.Format "2006-01-02 15:04 MST"}}</p>
+
+    <h2>Profile</h2>
+    <ul>
+      <li>ID: {{.Profile.ID}}</li>
+      <li>Email: {{.Profile.Email}}</li>
+      <li>Member since: {{.Profile.CreatedAt.Format "2006-01-02"}}</li>
+      <li>Chirpy Red: {{if .Membership.IsChirpyRed}}yes{{else}}no{{end}}</li>
+      <li>Two-factor authentication: {{if .TwoFactorEnabled}}enabled{{else}}disabled{{end}}</li>
+      {{range .Roles}}<li>Role: {{.}}</li>{{end}}
+    </ul>
+
+    <h2>Chirpy Red</h2>
+    {{with .Membership.Subscription}}<p>Plan {{.Plan}}, {{.Status}} until {{.CurrentPeriodEnd.Format "2006-01-02"}}</p>{{end}}
+    <ul>
+      {{range .Membership.History}}<li>{{.CreatedAt.Format "2006-01-02"}}: {{.Event}} ({{.Status}})</li>
+      {{end}}
+    </ul>
+
+    <h2>Chirps ({{len .Chirps}})</h2>
+    {{range .Chirps}}<p><small>{{.CreatedAt.Format "2006-01-02 15:04"}}</small><br>{{.Body}}</p>
+    {{end}}
+
+    <h2>Sessions</h2>
+    <ul>
+      {{range .Sessions}}<li>{{.CreatedAt.Format "2006-01-02 15:04"}}{{if .RevokedAt}} (logged out){{end}}</li>
+      {{end}}
+    </ul>
+
+    <h2>Personal access tokens</h2>
+    <ul>
+      {{range .PersonalAccessTokens}}<li>{{.Name}} ({{range $i, $s := .Scopes}}{{if $i}}, {{end}}{{$s}}{{end}})</li>
+      {{end}}
+    </ul>
+
+    <h2>Passkeys</h2>
+    <ul>
+      {{range .Passkeys}}<li>{{.Name}}, added {{.CreatedAt.Format "2006-01-02"}}</li>
+      {{end}}
+    </ul>
+
+    <h2>Linked accounts</h2>
+    <ul>
+      {{range .LinkedIdentities}}<li>{{.Issuer}} ({{.Email}})</li>
+      {{end}}
+    </ul>
+
+    <h2>Conversations ({{len .Conversations}})</h2>
+    {{range .Messages}}<p><small>{{.CreatedAt.Format "2006-01-02 15:04"}}, conversation {{.ConversationID}}, from {{.SenderID}}</small><br>{{.Body}}</p>
+    {{end}}
+
+    <h2>Blocked users</h2>
+    <ul>
+      {{range .BlockedUsers}}<li>{{.UserID}}, since {{.BlockedAt.Format "2006-01-02"}}</li>
+      {{end}}
+    </ul>
+
+    <h2>Webhooks</h2>
+    <ul>
+      {{range .WebhookEndpoints}}<li>{{.URL}} ({{if .Enabled}}enabled{{else}}disabled{{end}}, {{len .Deliveries}} recent deliveries)</li>
+      {{end}}
+    </ul>
+
+    <h2>Notifications</h2>
+    <ul>
+      {{range .Notifications}}<li>{{.UpdatedAt.Format "2006-01-02 15:04"}}: {{.Type}} from {{.ActorCount}} {{if eq .ActorCount 1}}user{{else}}users{{end}}{{if .ReadAt}} (read){{end}}</li>
+      {{end}}
+    </ul>
+  </body>
+</html>
+`))
+
+// buildDataExportArchive writes the personal data as data.json and, if
+// requested, a human-readable index.html into a zip archive.
+func buildDataExportArchive(data personalData, includeHTML bool) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	archive := zip.NewWriter(buf)
+
+	f, err := archive.Create("data.json")
+	if err != nil {
+		return nil, err
+	}
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(data); err != nil {
+		return nil, err
+	}
+
+	if includeHTML {
+		f, err := archive.Create("index.html")
+		if err != nil {
+			return nil, err
+		}
+		if err := personalDataTemplate.Execute(f, data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// processDataExports builds the requested exports in the background and
+// removes the ones that have expired.
+func (a *apiConfig) processDataExports(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := a.dbQueries.DeleteExpiredDataExports(ctx)
+		if err != nil {
+			log.Printf("failed to delete expired data exports: %v", err)
+		}
+
+		for {
+			export, err := a.dbQueries.ClaimPendingDataExport(ctx)
+			if errors.Is(err, sql.ErrNoRows) {
+				break
+			}
+			if err != nil {
+				log.Printf("failed to claim data export: %v", err)
+				break
+			}
+			a.runDataExport(ctx, export)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *apiConfig) runDataExport(ctx context.Context, export database.DataExport) {
+	archive, err := a.buildDataExport(ctx, export)
+	if err != nil {
+		log.Printf("failed to build data export %s: %v", export.ID, err)
+		err = a.dbQueries.FailDataExport(ctx, export.ID)
+		if err != nil {
+			log.Printf("failed to mark data export %s as failed: %v", export.ID, err)
+		}
+		return
+	}
+
+	err = a.dbQueries.CompleteDataExport(ctx, database.CompleteDataExportParams{
+		ID:      export.ID,
+		Archive: archive,
+	})
+	if err != nil {
+		log.Printf("failed to save data export %s: %v", export.ID, err)
+	}
+}
+
+func (a *apiConfig) buildDataExport(ctx context.Context, export database.DataExport) ([]byte, error) {
+	data, err := a.collectPersonalData(ctx, export.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return buildDataExportArchive(data, export.IncludeHtml)
+}
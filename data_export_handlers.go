@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ehumba/chirpy-web-server/internal/auth"
+	"github.com/ehumba/chirpy-web-server/internal/database"
+	"github.com/google/uuid"
+)
+
+const dataExportReady = "ready"
+
+func (a *apiConfig) handlerCreateDataExport(w http.ResponseWriter, r *http.Request) {
+	caller := principalFromContext(r.Context())
+	if !requireSession(w, caller) {
+		return
+	}
+
+	type reqParams struct {
+		IncludeHTML bool `json:"include_html"`
+	}
+
+	params := reqParams{}
+	if r.ContentLength != 0 {
+		err := decodeJSON(r, &params)
+		if err != nil {
+			respondWithAPIError(w, err)
+			return
+		}
+	}
+
+	export, err := a.dbQueries.CreateDataExport(r.Context(), database.CreateDataExportParams{
+		UserID:      caller.UserID,
+		IncludeHtml: params.IncludeHTML,
+		ExpiresAt:   time.Now().Add(dataExportRetention),
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to create data export")
+		return
+	}
+
+	respondWithJSON(w, 202, a.dataExportFromDB(export))
+}
+
+func (a *apiConfig) handlerGetDataExport(w http.ResponseWriter, r *http.Request) {
+	caller := principalFromContext(r.Context())
+	if !requireSession(w, caller) {
+		return
+	}
+
+	exportID, err := uuid.Parse(r.PathValue("exportID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid export ID format")
+		return
+	}
+
+	export, err := a.dbQueries.GetDataExport(r.Context(), exportID)
+	if err != nil || export.UserID != caller.UserID {
+		respondWithError(w, 404, "data export not found")
+		return
+	}
+
+	respondWithJSON(w, 200, a.dataExportFromDB(export))
+}
+
+// handlerDownloadDataExport serves the archive to anyone with a valid signed
+// link, so it can be opened directly in a browser or shared with a download
+// manager.
+func (a *apiConfig) handlerDownloadDataExport(w http.ResponseWriter, r *http.Request) {
+	err := auth.VerifySignedLink(a.linkKey, r.URL.Path, r.URL.Query(), time.Now())
+	if errors.Is(err, auth.ErrLinkExpired) {
+		respondWithError(w, 410, "download link has expired")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 403, "invalid download link")
+		return
+	}
+
+	exportID, err := uuid.Parse(r.PathValue("exportID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid export ID format")
+		return
+	}
+
+	export, err := a.dbQueries.GetDataExport(r.Context(), exportID)
+	if err != nil || export.Status != dataExportReady {
+		respondWithError(w, 404, "data export not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="chirpy-data-`+export.CreatedAt.Format("2006-01-02")+`.zip"`)
+	w.Header().Set("Content-Length", strconv.Itoa(len(export.Archive)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(200)
+	w.Write(export.Archive)
+}
+
+func (a *apiConfig) dataExportFromDB(export database.DataExport) DataExport {
+	dataExport := DataExport{
+		ID:          export.ID,
+		CreatedAt:   export.CreatedAt,
+		Status:      export.Status,
+		IncludeHTML: export.IncludeHtml,
+		ExpiresAt:   export.ExpiresAt,
+	}
+	if export.Status == dataExportReady {
+		dataExport.DownloadURL = auth.SignLink(a.linkKey, "/api/exports/"+export.ID.String()+"/download", time.Now().Add(dataExportLinkTTL))
+	}
+	return dataExport
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/ehumba/chirpy-web-server/internal/database"
+	"github.com/google/uuid"
+)
+
+// exportedSections builds the archive of the user's data and returns the
+// top-level sections of its data.json.
+func exportedSections(t *testing.T, data personalData) map[string]json.RawMessage {
+	t.Helper()
+	archive, err := buildDataExportArchive(data, true)
+	if err != nil {
+		t.Fatalf("buildDataExportArchive() error = %v", err)
+	}
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := reader.Open("data.json")
+	if err != nil {
+		t.Fatalf("archive has no data.json: %v", err)
+	}
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sections := map[string]json.RawMessage{}
+	err = json.Unmarshal(content, &sections)
+	if err != nil {
+		t.Fatalf("invalid data.json: %v", err)
+	}
+	return sections
+}
+
+// wantExportedItems fails the test unless the section is a list with n items.
+func wantExportedItems(t *testing.T, sections map[string]json.RawMessage, section string, n int) {
+	t.Helper()
+	items := []json.RawMessage{}
+	err := json.Unmarshal(sections[section], &items)
+	if err != nil {
+		t.Errorf("%s is not a list: %s", section, sections[section])
+		return
+	}
+	if len(items) != n {
+		t.Errorf("%s has %d items, want %d", section, len(items), n)
+	}
+}
+
+func TestCollectPersonalData(t *testing.T) {
+	db, q := newTestDB(t)
+	a := &apiConfig{db: db, dbQueries: q}
+	ctx := context.Background()
+
+	alice := createTestUser(t, q, "alice@example.com")
+	bob := createTestUser(t, q, "bob@example.com")
+	createTestChirp(t, q, alice.ID, "my first chirp")
+	mention := createTestChirp(t, q, bob.ID, "hi @alice@example.com")
+	err := notifyMentions(ctx, q, mention)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conversation, err := q.CreateConversation(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, userID := range []uuid.UUID{alice.ID, bob.ID} {
+		err = q.AddConversationParticipant(ctx, database.AddConversationParticipantParams{
+			ConversationID: conversation.ID,
+			UserID:         userID,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = q.CreateMessage(ctx, database.CreateMessageParams{
+			ConversationID: conversation.ID,
+			SenderID:       userID,
+			Body:           "hello",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	carol := createTestUser(t, q, "carol@example.com")
+	err = q.BlockUser(ctx, database.BlockUserParams{
+		BlockerID: alice.ID,
+		BlockedID: carol.ID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endpoint, err := q.CreateWebhookEndpoint(ctx, database.CreateWebhookEndpointParams{
+		UserID: alice.ID,
+		Url:    "https://hooks.example.com/chirpy",
+		Secret: "whsec_not_exported",
+		Events: []string{"chirp.created"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = q.CreateWebhookDelivery(ctx, database.CreateWebhookDeliveryParams{
+		EndpointID: endpoint.ID,
+		Event:      "chirp.created",
+		Payload:    `{"body":"my first chirp"}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := a.collectPersonalData(ctx, alice.ID)
+	if err != nil {
+		t.Fatalf("collectPersonalData() error = %v", err)
+	}
+	if data.Profile.Email != alice.Email {
+		t.Errorf("Profile.Email = %q, want %q", data.Profile.Email, alice.Email)
+	}
+
+	sections := exportedSections(t, data)
+	wantExportedItems(t, sections, "chirps", 1)
+	wantExportedItems(t, sections, "sessions", 0)
+	wantExportedItems(t, sections, "personal_access_tokens", 0)
+	wantExportedItems(t, sections, "passkeys", 0)
+	wantExportedItems(t, sections, "linked_identities", 0)
+	wantExportedItems(t, sections, "notifications", 1)
+	wantExportedItems(t, sections, "conversations", 1)
+	wantExportedItems(t, sections, "messages", 2)
+	wantExportedItems(t, sections, "blocked_users", 1)
+	wantExportedItems(t, sections, "webhook_endpoints", 1)
+	if len(data.WebhookEndpoints) == 1 && len(data.WebhookEndpoints[0].Deliveries) != 1 {
+		t.Errorf("webhook endpoint has %d deliveries, want 1", len(data.WebhookEndpoints[0].Deliveries))
+	}
+	if bytes.Contains(sections["webhook_endpoints"], []byte(endpoint.Secret)) {
+		t.Error("the export contains the webhook signing secret")
+	}
+}
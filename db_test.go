@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/ehumba/chirpy-web-server/internal/database"
+	"github.com/google/uuid"
+	_ "github.com/lib/pq"
+)
+
+// newTestDB migrates a fresh schema in the database at TEST_DATABASE_URL and
+// drops it when the test ends. Tests that need Postgres are skipped without
+// it.
+func newTestDB(t *testing.T) (*sql.DB, *database.Queries) {
+	t.Helper()
+	dbURL := os.Getenv("TEST_DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	schema := "chirpy_test_" + hex.EncodeToString(suffix)
+
+	admin, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		t.Fatalf("failed to open the test database: %v", err)
+	}
+	defer admin.Close()
+	_, err = admin.Exec("CREATE SCHEMA " + schema)
+	if err != nil {
+		t.Fatalf("failed to create the test schema: %v", err)
+	}
+	t.Cleanup(func() {
+		admin, err := sql.Open("postgres", dbURL)
+		if err != nil {
+			return
+		}
+		defer admin.Close()
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+	})
+
+	u, err := url.Parse(dbURL)
+	if err != nil {
+		t.Fatalf("TEST_DATABASE_URL must be a URL: %v", err)
+	}
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+
+	db, err := sql.Open("postgres", u.String())
+	if err != nil {
+		t.Fatalf("failed to open the test schema: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	migrations, err := filepath.Glob("sql/schema/*.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(migrations)
+	for _, migration := range migrations {
+		content, err := os.ReadFile(migration)
+		if err != nil {
+			t.Fatal(err)
+		}
+		up, _, _ := strings.Cut(string(content), "-- +goose Down")
+		_, err = db.Exec(up)
+		if err != nil {
+			t.Fatalf("failed to apply %s: %v", migration, err)
+		}
+	}
+	return db, database.New(db)
+}
+
+func createTestUser(t *testing.T, q *database.Queries, email string) database.User {
+	t.Helper()
+	userDB, err := q.CreateUser(context.Background(), database.CreateUserParams{
+		Email:          email,
+		HashedPassword: "unset",
+	})
+	if err != nil {
+		t.Fatalf("failed to create user %s: %v", email, err)
+	}
+	return userDB
+}
+
+func createTestChirp(t *testing.T, q *database.Queries, userID uuid.UUID, body string) Chirp {
+	t.Helper()
+	chirpDB, err := q.CreateChirp(context.Background(), database.CreateChirpParams{
+		Body:   body,
+		UserID: userID,
+	})
+	if err != nil {
+		t.Fatalf("failed to create chirp: %v", err)
+	}
+	return Chirp{
+		ID:        chirpDB.ID,
+		CreatedAt: chirpDB.CreatedAt,
+		UpdatedAt: chirpDB.UpdatedAt,
+		Body:      chirpDB.Body,
+		UserID:    chirpDB.UserID,
+	}
+}
@@ -0,0 +1,655 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ehumba/chirpy-web-server/internal/auth"
+	"github.com/ehumba/chirpy-web-server/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	// including the user who started the conversation
+	maxConversationParticipants = 10
+	maxMessageLength            = 1000
+	defaultMessagesPageSize     = 50
+	maxMessagesPageSize         = 100
+)
+
+func (a *apiConfig) handlerCreateConversation(w http.ResponseWriter, r *http.Request) {
+	caller := principalFromContext(r.Context())
+	if !requireScope(w, caller, auth.ScopeMessagesWrite) {
+		return
+	}
+
+	type reqParams struct {
+		ParticipantIDs []uuid.UUID `json:"participant_ids"`
+		// defaults to true
+		ProfanityFilter *bool `json:"profanity_filter"`
+	}
+
+	params := reqParams{}
+	err := decodeJSON(r, &params)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+
+	participantIDs := []uuid.UUID{}
+	seen := map[uuid.UUID]bool{caller.UserID: true}
+	for _, id := range params.ParticipantIDs {
+		if !seen[id] {
+			seen[id] = true
+			participantIDs = append(participantIDs, id)
+		}
+	}
+
+	validationErrs := []fieldError{}
+	if len(participantIDs) == 0 {
+		validationErrs = append(validationErrs, fieldError{Field: "participant_ids", Code: "required", Message: "at least one other participant is required"})
+	}
+	if len(participantIDs)+1 > maxConversationParticipants {
+		validationErrs = append(validationErrs, fieldError{Field: "participant_ids", Code: "too_many", Message: "a conversation can have at most " + strconv.Itoa(maxConversationParticipants) + " participants"})
+	}
+	if len(validationErrs) > 0 {
+		respondWithValidationErrors(w, validationErrs)
+		return
+	}
+
+	for _, id := range participantIDs {
+		_, err := a.dbQueries.LookUpByID(r.Context(), id)
+		if errors.Is(err, sql.ErrNoRows) {
+			validationErrs = append(validationErrs, fieldError{Field: "participant_ids", Code: "not_found", Message: "unknown user: " + id.String()})
+			continue
+		}
+		if err != nil {
+			respondWithError(w, 500, "failed to look up user")
+			return
+		}
+	}
+	if len(validationErrs) > 0 {
+		respondWithValidationErrors(w, validationErrs)
+		return
+	}
+
+	blocked, err := a.dbQueries.HasBlockBetween(r.Context(), database.HasBlockBetweenParams{
+		UserID:   caller.UserID,
+		OtherIds: participantIDs,
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to check blocks")
+		return
+	}
+	if blocked {
+		respondWithError(w, 403, "you can't message users you blocked or who blocked you")
+		return
+	}
+
+	// there is only one one-to-one conversation between two users
+	if len(participantIDs) == 1 {
+		existing, err := a.dbQueries.GetDirectConversation(r.Context(), database.GetDirectConversationParams{
+			UserID:  caller.UserID,
+			OtherID: participantIDs[0],
+		})
+		if err == nil {
+			conversation, err := a.loadConversation(r.Context(), existing.ID, caller.UserID)
+			if err != nil {
+				respondWithError(w, 500, "failed to get conversation")
+				return
+			}
+			respondWithJSON(w, 200, conversation)
+			return
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, 500, "failed to get conversation")
+			return
+		}
+	}
+
+	profanityFilter := true
+	if params.ProfanityFilter != nil {
+		profanityFilter = *params.ProfanityFilter
+	}
+
+	tx, err := a.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondWithError(w, 500, "failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+	qtx := a.dbQueries.WithTx(tx)
+
+	conversationDB, err := qtx.CreateConversation(r.Context(), profanityFilter)
+	if err != nil {
+		respondWithError(w, 500, "failed to create conversation")
+		return
+	}
+
+	for _, id := range append([]uuid.UUID{caller.UserID}, participantIDs...) {
+		err = qtx.AddConversationParticipant(r.Context(), database.AddConversationParticipantParams{
+			ConversationID: conversationDB.ID,
+			UserID:         id,
+		})
+		if err != nil {
+			respondWithError(w, 500, "failed to add participant")
+			return
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		respondWithError(w, 500, "failed to save conversation")
+		return
+	}
+
+	conversation, err := a.loadConversation(r.Context(), conversationDB.ID, caller.UserID)
+	if err != nil {
+		respondWithError(w, 500, "failed to get conversation")
+		return
+	}
+
+	respondWithJSON(w, 201, conversation)
+}
+
+func (a *apiConfig) handlerGetConversations(w http.ResponseWriter, r *http.Request) {
+	caller := principalFromContext(r.Context())
+	if !requireScope(w, caller, auth.ScopeMessagesRead) {
+		return
+	}
+
+	conversations, err := a.loadConversations(r.Context(), caller.UserID)
+	if err != nil {
+		respondWithError(w, 500, "failed to get conversations")
+		return
+	}
+
+	respondWithJSON(w, 200, conversations)
+}
+
+func (a *apiConfig) handlerGetConversation(w http.ResponseWriter, r *http.Request) {
+	conversationID, err := uuid.Parse(r.PathValue("conversationID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid conversation ID format")
+		return
+	}
+
+	caller := principalFromContext(r.Context())
+	if !requireScope(w, caller, auth.ScopeMessagesRead) {
+		return
+	}
+
+	conversation, err := a.loadConversation(r.Context(), conversationID, caller.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, 404, "conversation not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "failed to get conversation")
+		return
+	}
+
+	respondWithJSON(w, 200, conversation)
+}
+
+// handlerUpdateConversation changes the settings every participant shares.
+func (a *apiConfig) handlerUpdateConversation(w http.ResponseWriter, r *http.Request) {
+	conversationID, err := uuid.Parse(r.PathValue("conversationID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid conversation ID format")
+		return
+	}
+
+	caller := principalFromContext(r.Context())
+	if !requireScope(w, caller, auth.ScopeMessagesWrite) {
+		return
+	}
+
+	type reqParams struct {
+		ProfanityFilter *bool `json:"profanity_filter"`
+	}
+
+	params := reqParams{}
+	err = decodeJSON(r, &params)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	if params.ProfanityFilter == nil {
+		respondWithValidationErrors(w, []fieldError{{Field: "profanity_filter", Code: "required", Message: "profanity_filter is required"}})
+		return
+	}
+
+	_, err = a.dbQueries.GetConversationForUser(r.Context(), database.GetConversationForUserParams{
+		ID:     conversationID,
+		UserID: caller.UserID,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, 404, "conversation not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "failed to get conversation")
+		return
+	}
+
+	err = a.dbQueries.SetConversationProfanityFilter(r.Context(), database.SetConversationProfanityFilterParams{
+		ID:              conversationID,
+		ProfanityFilter: *params.ProfanityFilter,
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to update conversation")
+		return
+	}
+
+	conversation, err := a.loadConversation(r.Context(), conversationID, caller.UserID)
+	if err != nil {
+		respondWithError(w, 500, "failed to get conversation")
+		return
+	}
+
+	respondWithJSON(w, 200, conversation)
+}
+
+func (a *apiConfig) handlerGetMessages(w http.ResponseWriter, r *http.Request) {
+	conversationID, err := uuid.Parse(r.PathValue("conversationID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid conversation ID format")
+		return
+	}
+
+	caller := principalFromContext(r.Context())
+	if !requireScope(w, caller, auth.ScopeMessagesRead) {
+		return
+	}
+
+	query := r.URL.Query()
+
+	limit := defaultMessagesPageSize
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxMessagesPageSize {
+			respondWithError(w, 400, "limit must be between 1 and "+strconv.Itoa(maxMessagesPageSize))
+			return
+		}
+		limit = n
+	}
+
+	// the first page starts after the newest possible message
+	beforeCreatedAt := time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+	beforeID := uuid.Max
+	if s := query.Get("cursor"); s != "" {
+		var ok bool
+		beforeCreatedAt, beforeID, ok = decodePageCursor(s)
+		if !ok {
+			respondWithError(w, 400, "invalid cursor")
+			return
+		}
+	}
+
+	_, err = a.dbQueries.GetConversationForUser(r.Context(), database.GetConversationForUserParams{
+		ID:     conversationID,
+		UserID: caller.UserID,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, 404, "conversation not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "failed to get conversation")
+		return
+	}
+
+	messagesDB, err := a.dbQueries.GetMessages(r.Context(), database.GetMessagesParams{
+		ConversationID:  conversationID,
+		BeforeCreatedAt: beforeCreatedAt,
+		BeforeID:        beforeID,
+		MaxMessages:     int32(limit),
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to get messages")
+		return
+	}
+
+	messages := []Message{}
+	for _, messageDB := range messagesDB {
+		messages = append(messages, messageFromDB(messageDB))
+	}
+
+	nextCursor := ""
+	if len(messagesDB) == limit {
+		last := messagesDB[len(messagesDB)-1]
+		nextCursor = encodePageCursor(last.CreatedAt, last.ID)
+	}
+
+	resStruct := struct {
+		Messages   []Message `json:"messages"`
+		NextCursor string    `json:"next_cursor,omitempty"`
+	}{
+		Messages:   messages,
+		NextCursor: nextCursor,
+	}
+
+	respondWithJSON(w, 200, resStruct)
+}
+
+func (a *apiConfig) handlerSendMessage(w http.ResponseWriter, r *http.Request) {
+	conversationID, err := uuid.Parse(r.PathValue("conversationID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid conversation ID format")
+		return
+	}
+
+	caller := principalFromContext(r.Context())
+	if !requireScope(w, caller, auth.ScopeMessagesWrite) {
+		return
+	}
+
+	type reqParams struct {
+		Body string `json:"body"`
+	}
+
+	params := reqParams{}
+	err = decodeJSON(r, &params)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+
+	conversationDB, err := a.dbQueries.GetConversationForUser(r.Context(), database.GetConversationForUserParams{
+		ID:     conversationID,
+		UserID: caller.UserID,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, 404, "conversation not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "failed to get conversation")
+		return
+	}
+
+	body := params.Body
+	if conversationDB.ProfanityFilter {
+		body = removeProfane(body)
+	}
+	if body == "" {
+		respondWithValidationErrors(w, []fieldError{{Field: "body", Code: "required", Message: "body is required"}})
+		return
+	}
+	if utf8.RuneCountInString(body) > maxMessageLength {
+		respondWithValidationErrors(w, []fieldError{{Field: "body", Code: "too_long", Message: "messages can be at most " + strconv.Itoa(maxMessageLength) + " characters long"}})
+		return
+	}
+
+	participantsDB, err := a.dbQueries.GetConversationParticipants(r.Context(), conversationID)
+	if err != nil {
+		respondWithError(w, 500, "failed to get participants")
+		return
+	}
+	recipientIDs := []uuid.UUID{}
+	for _, participantDB := range participantsDB {
+		if participantDB.UserID != caller.UserID {
+			recipientIDs = append(recipientIDs, participantDB.UserID)
+		}
+	}
+
+	blocked, err := a.dbQueries.HasBlockBetween(r.Context(), database.HasBlockBetweenParams{
+		UserID:   caller.UserID,
+		OtherIds: recipientIDs,
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to check blocks")
+		return
+	}
+	if blocked {
+		respondWithError(w, 403, "you can't message users you blocked or who blocked you")
+		return
+	}
+
+	tx, err := a.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondWithError(w, 500, "failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+	qtx := a.dbQueries.WithTx(tx)
+
+	messageDB, err := qtx.CreateMessage(r.Context(), database.CreateMessageParams{
+		ConversationID: conversationID,
+		SenderID:       caller.UserID,
+		Body:           body,
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to send message")
+		return
+	}
+
+	err = qtx.SetConversationLastMessageAt(r.Context(), database.SetConversationLastMessageAtParams{
+		ID:            conversationID,
+		LastMessageAt: sql.NullTime{Time: messageDB.CreatedAt, Valid: true},
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to send message")
+		return
+	}
+
+	// the sender has read everything up to their own message
+	err = qtx.MarkConversationRead(r.Context(), database.MarkConversationReadParams{
+		ConversationID: conversationID,
+		UserID:         caller.UserID,
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to send message")
+		return
+	}
+
+	message := messageFromDB(messageDB)
+	err = publishEvent(r.Context(), qtx, eventMessageCreated, caller.UserID, message)
+	if err != nil {
+		respondWithError(w, 500, "failed to send message")
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		respondWithError(w, 500, "failed to save message")
+		return
+	}
+	a.events.Wake()
+
+	respondWithJSON(w, 201, message)
+}
+
+// handlerMarkConversationRead is the read receipt of a participant. It
+// covers every message sent so far and clears the conversation's
+// notifications.
+func (a *apiConfig) handlerMarkConversationRead(w http.ResponseWriter, r *http.Request) {
+	conversationID, err := uuid.Parse(r.PathValue("conversationID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid conversation ID format")
+		return
+	}
+
+	caller := principalFromContext(r.Context())
+	if !requireScope(w, caller, auth.ScopeMessagesWrite) {
+		return
+	}
+
+	_, err = a.dbQueries.GetConversationForUser(r.Context(), database.GetConversationForUserParams{
+		ID:     conversationID,
+		UserID: caller.UserID,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, 404, "conversation not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "failed to get conversation")
+		return
+	}
+
+	err = a.dbQueries.MarkConversationRead(r.Context(), database.MarkConversationReadParams{
+		ConversationID: conversationID,
+		UserID:         caller.UserID,
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to mark conversation as read")
+		return
+	}
+
+	err = a.dbQueries.MarkConversationNotificationsRead(r.Context(), database.MarkConversationNotificationsReadParams{
+		UserID:         caller.UserID,
+		ConversationID: uuid.NullUUID{UUID: conversationID, Valid: true},
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to mark notifications as read")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *apiConfig) handlerMuteConversation(w http.ResponseWriter, r *http.Request) {
+	a.setConversationMuted(w, r, true)
+}
+
+func (a *apiConfig) handlerUnmuteConversation(w http.ResponseWriter, r *http.Request) {
+	a.setConversationMuted(w, r, false)
+}
+
+// setConversationMuted turns message notifications for the caller off or
+// back on. Muting only affects the caller.
+func (a *apiConfig) setConversationMuted(w http.ResponseWriter, r *http.Request, muted bool) {
+	conversationID, err := uuid.Parse(r.PathValue("conversationID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid conversation ID format")
+		return
+	}
+
+	caller := principalFromContext(r.Context())
+	if !requireScope(w, caller, auth.ScopeMessagesWrite) {
+		return
+	}
+
+	_, err = a.dbQueries.GetConversationForUser(r.Context(), database.GetConversationForUserParams{
+		ID:     conversationID,
+		UserID: caller.UserID,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, 404, "conversation not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "failed to get conversation")
+		return
+	}
+
+	err = a.dbQueries.SetConversationMuted(r.Context(), database.SetConversationMutedParams{
+		ConversationID: conversationID,
+		UserID:         caller.UserID,
+		Muted:          muted,
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to update conversation")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadConversations returns the conversations of a user, the most recently
+// active first.
+func (a *apiConfig) loadConversations(ctx context.Context, userID uuid.UUID) ([]Conversation, error) {
+	conversationsDB, err := a.dbQueries.GetConversationsForUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	participantsDB, err := a.dbQueries.GetParticipantsOfUserConversations(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	participants := map[uuid.UUID][]ConversationParticipant{}
+	for _, participantDB := range participantsDB {
+		participants[participantDB.ConversationID] = append(participants[participantDB.ConversationID], participantFromDB(participantDB))
+	}
+
+	conversations := []Conversation{}
+	for _, conversationDB := range conversationsDB {
+		conversation := Conversation{
+			ID:              conversationDB.ID,
+			CreatedAt:       conversationDB.CreatedAt,
+			UpdatedAt:       conversationDB.UpdatedAt,
+			ProfanityFilter: conversationDB.ProfanityFilter,
+			Muted:           conversationDB.Muted,
+			UnreadCount:     conversationDB.UnreadCount,
+			Participants:    participants[conversationDB.ID],
+		}
+		if conversationDB.LastMessageAt.Valid {
+			conversation.LastMessageAt = &conversationDB.LastMessageAt.Time
+		}
+		conversations = append(conversations, conversation)
+	}
+	return conversations, nil
+}
+
+// loadConversation returns a conversation as seen by one of its
+// participants, or sql.ErrNoRows if the user isn't one.
+func (a *apiConfig) loadConversation(ctx context.Context, conversationID, userID uuid.UUID) (Conversation, error) {
+	conversationDB, err := a.dbQueries.GetConversationForUser(ctx, database.GetConversationForUserParams{
+		ID:     conversationID,
+		UserID: userID,
+	})
+	if err != nil {
+		return Conversation{}, err
+	}
+
+	participantsDB, err := a.dbQueries.GetConversationParticipants(ctx, conversationID)
+	if err != nil {
+		return Conversation{}, err
+	}
+
+	conversation := Conversation{
+		ID:              conversationDB.ID,
+		CreatedAt:       conversationDB.CreatedAt,
+		UpdatedAt:       conversationDB.UpdatedAt,
+		ProfanityFilter: conversationDB.ProfanityFilter,
+		Muted:           conversationDB.Muted,
+		UnreadCount:     conversationDB.UnreadCount,
+		Participants:    []ConversationParticipant{},
+	}
+	if conversationDB.LastMessageAt.Valid {
+		conversation.LastMessageAt = &conversationDB.LastMessageAt.Time
+	}
+	for _, participantDB := range participantsDB {
+		conversation.Participants = append(conversation.Participants, participantFromDB(participantDB))
+	}
+	return conversation, nil
+}
+
+func participantFromDB(participantDB database.ConversationParticipant) ConversationParticipant {
+	participant := ConversationParticipant{
+		UserID:   participantDB.UserID,
+		JoinedAt: participantDB.JoinedAt,
+	}
+	if participantDB.LastReadAt.Valid {
+		participant.LastReadAt = &participantDB.LastReadAt.Time
+	}
+	return participant
+}
+
+func messageFromDB(messageDB database.Message) Message {
+	return Message{
+		ID:             messageDB.ID,
+		CreatedAt:      messageDB.CreatedAt,
+		ConversationID: messageDB.ConversationID,
+		SenderID:       messageDB.SenderID,
+		Body:           messageDB.Body,
+	}
+}
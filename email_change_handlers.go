@@ -0,0 +1,154 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ehumba/chirpy-web-server/internal/auth"
+	"github.com/ehumba/chirpy-web-server/internal/database"
+	"github.com/ehumba/chirpy-web-server/internal/mailer"
+)
+
+const emailChangeTimeout = 24 * time.Hour
+
+// requestEmailChange stores a pending email change and mails the
+// confirmation token to the new address. It writes the error response
+// itself and returns false if the change can't be started.
+func (a *apiConfig) requestEmailChange(w http.ResponseWriter, r *http.Request, userDB database.User, newEmail string) bool {
+	_, err := a.dbQueries.LookUpByEmail(r.Context(), newEmail)
+	if err == nil {
+		respondWithAPIError(w, conflictError("email"))
+		return false
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, 500, "failed to look up user")
+		return false
+	}
+
+	token, err := auth.MakeRefreshToken()
+	if err != nil {
+		respondWithError(w, 500, "failed to create confirmation token")
+		return false
+	}
+
+	_, err = a.dbQueries.UpsertEmailChange(r.Context(), database.UpsertEmailChangeParams{
+		UserID:    userDB.ID,
+		NewEmail:  newEmail,
+		TokenHash: auth.HashToken(token),
+		ExpiresAt: time.Now().Add(emailChangeTimeout),
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to save email change")
+		return false
+	}
+
+	err = a.mailer.Send(r.Context(), mailer.Message{
+		To:      newEmail,
+		Subject: "Confirm your new Chirpy email address",
+		Body: "Someone asked to use this address for their Chirpy account.\n\n" +
+			"To confirm, send this token to POST /api/users/email/confirm within 24 hours:\n\n" +
+			token + "\n\n" +
+			"If this wasn't you, you can ignore this message.",
+	})
+	if err != nil {
+		respondWithError(w, 502, "failed to send confirmation email")
+		return false
+	}
+
+	a.notify(r, mailer.Message{
+		To:      userDB.Email,
+		Subject: "Your Chirpy email address is being changed",
+		Body: "Someone asked to change the email address of your Chirpy account to " + newEmail + ".\n\n" +
+			"The change only takes effect once it is confirmed from the new address. " +
+			"If this wasn't you, change your password now.",
+	})
+
+	return true
+}
+
+func (a *apiConfig) handlerConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	type reqParams struct {
+		Token string `json:"token"`
+	}
+
+	params := reqParams{}
+	err := decodeJSON(r, &params)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+
+	tx, err := a.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondWithError(w, 500, "failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+	qtx := a.dbQueries.WithTx(tx)
+
+	// consumed in the transaction, so the token still works if the change
+	// fails
+	change, err := qtx.ConsumeEmailChange(r.Context(), auth.HashToken(params.Token))
+	if err != nil {
+		respondWithError(w, 400, "invalid or expired confirmation token")
+		return
+	}
+
+	oldUserDB, err := qtx.LookUpByID(r.Context(), change.UserID)
+	if err != nil {
+		respondWithError(w, 404, "user not found")
+		return
+	}
+
+	// the address may have been taken since the change was requested
+	userDB, err := qtx.UpdateUserEmail(r.Context(), database.UpdateUserEmailParams{
+		ID:    change.UserID,
+		Email: change.NewEmail,
+	})
+	if err != nil {
+		respondWithAPIError(w, dbError(err, "failed to update email"))
+		return
+	}
+
+	user := User{
+		ID:          userDB.ID,
+		CreatedAt:   userDB.CreatedAt,
+		UpdatedAt:   userDB.UpdatedAt,
+		Email:       userDB.Email,
+		IsChirpyRed: userDB.IsChirpyRed,
+	}
+
+	err = publishEvent(r.Context(), qtx, eventUserUpdated, user.ID, user)
+	if err != nil {
+		respondWithError(w, 500, "failed to update email")
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		respondWithError(w, 500, "failed to update email")
+		return
+	}
+	a.events.Wake()
+
+	a.notify(r, mailer.Message{
+		To:      oldUserDB.Email,
+		Subject: "Your Chirpy email address was changed",
+		Body: "The email address of your Chirpy account was changed to " + change.NewEmail + ".\n\n" +
+			"If this wasn't you, contact support.",
+	})
+
+	respondWithJSON(w, 200, user)
+}
+
+// notify sends an informational message. Failures are only logged, since
+// the request itself succeeded.
+func (a *apiConfig) notify(r *http.Request, msg mailer.Message) {
+	err := a.mailer.Send(r.Context(), msg)
+	if err != nil {
+		log.Printf("failed to send %q to %s: %v", msg.Subject, msg.To, err)
+	}
+}
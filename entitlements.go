@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	tierFree = "free"
+	tierRed  = "red"
+)
+
+// entitlements are the limits that depend on what a user pays for. All
+// premium rules live in tierEntitlements, handlers only ask for the
+// caller's entitlements and compare against them.
+type entitlements struct {
+	Tier           string
+	MaxChirpLength int
+	// how long after posting a chirp can still be edited, 0 disables editing
+	EditWindow    time.Duration
+	ChirpsPerHour int
+}
+
+var tierEntitlements = map[string]entitlements{
+	tierFree: {
+		Tier:           tierFree,
+		MaxChirpLength: 140,
+		EditWindow:     0,
+		ChirpsPerHour:  30,
+	},
+	tierRed: {
+		Tier:           tierRed,
+		MaxChirpLength: 500,
+		EditWindow:     15 * time.Minute,
+		ChirpsPerHour:  300,
+	},
+}
+
+func (a *apiConfig) entitlementsFor(ctx context.Context, userID uuid.UUID) (entitlements, error) {
+	userDB, err := a.dbQueries.LookUpByID(ctx, userID)
+	if err != nil {
+		return entitlements{}, fmt.Errorf("failed to look up user: %v", err)
+	}
+	if userDB.IsChirpyRed {
+		return tierEntitlements[tierRed], nil
+	}
+	return tierEntitlements[tierFree], nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ehumba/chirpy-web-server/internal/database"
+	"github.com/google/uuid"
+)
+
+// Domain events. They are written to the outbox in the transaction that
+// made the change, so an event exists if and only if the change was
+// committed.
+const (
+	eventChirpCreated        = "chirp.created"
+	eventChirpUpdated        = "chirp.updated"
+	eventChirpDeleted        = "chirp.deleted"
+	eventUserUpdated         = "user.updated"
+	eventSubscriptionUpdated = "subscription.updated"
+	eventNotificationCreated = "notification.created"
+	eventMessageCreated      = "message.created"
+
+	// only published to connected clients, never written to the outbox
+	eventPresenceChanged = "presence.changed"
+)
+
+const (
+	outboxEventPending    = "pending"
+	outboxEventDispatched = "dispatched"
+	outboxEventFailed     = "failed"
+
+	eventDispatchInterval = time.Second
+	eventMaxAttempts      = 10
+	eventRetention        = 7 * 24 * time.Hour
+	eventCleanupInterval  = time.Hour
+
+	// held from assigning a dispatch sequence number until the commit, so
+	// events become visible in sequence order
+	outboxDispatchLock = 0x63686972707900
+)
+
+type domainEvent struct {
+	ID int64
+	// position in the dispatch order, set once the event was dispatched.
+	// Retried events are dispatched after later ones, so clients that
+	// resume use this instead of the id.
+	Seq       int64
+	Type      string
+	UserID    uuid.UUID
+	CreatedAt time.Time
+	Data      json.RawMessage
+}
+
+// eventHandler reacts to a domain event. q is bound to the transaction that
+// marks the event as dispatched, so anything written through it is saved
+// exactly once. Returning an error rolls the event back for every
+// subscriber and retries it later.
+type eventHandler func(ctx context.Context, q *database.Queries, event domainEvent) error
+
+type eventSubscriber struct {
+	name   string
+	handle eventHandler
+}
+
+// eventBus delivers outbox events to in-process subscribers.
+type eventBus struct {
+	subscribers []eventSubscriber
+	// listeners are told about events after they were dispatched
+	listeners []func(event domainEvent)
+	wake      chan struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{wake: make(chan struct{}, 1)}
+}
+
+// Subscribe registers a handler for all events. It must be called before
+// dispatchEvents is started.
+func (b *eventBus) Subscribe(name string, handle eventHandler) {
+	b.subscribers = append(b.subscribers, eventSubscriber{name: name, handle: handle})
+}
+
+// Listen registers a function that is called with every event once it has
+// been dispatched. Unlike subscribers, listeners can't fail and must not
+// block, they are meant for pushing events to connected clients.
+func (b *eventBus) Listen(listener func(event domainEvent)) {
+	b.listeners = append(b.listeners, listener)
+}
+
+// Wake tells the dispatcher that new events were committed, so they don't
+// wait for the next poll.
+func (b *eventBus) Wake() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// publishEvent adds an event to the outbox. q must be bound to the
+// transaction that makes the change, and Wake should be called once it is
+// committed.
+func publishEvent(ctx context.Context, q *database.Queries, eventType string, userID uuid.UUID, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s event: %v", eventType, err)
+	}
+	return q.CreateOutboxEvent(ctx, database.CreateOutboxEventParams{
+		EventType: eventType,
+		UserID:    userID,
+		Payload:   string(payload),
+	})
+}
+
+// dispatchEvents hands committed events to the subscribers in the order
+// they were written. An event that keeps failing is retried with backoff,
+// so later events can overtake it.
+func (a *apiConfig) dispatchEvents(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastCleanup := time.Time{}
+	for {
+		for a.dispatchNextEvent(ctx) {
+		}
+
+		if time.Since(lastCleanup) > eventCleanupInterval {
+			err := a.dbQueries.DeleteOldOutboxEvents(ctx, time.Now().Add(-eventRetention))
+			if err != nil {
+				log.Printf("failed to delete old events: %v", err)
+			}
+			lastCleanup = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-a.events.wake:
+		}
+	}
+}
+
+// dispatchNextEvent dispatches one pending event and reports whether there
+// may be more. Like processNextPolkaEvent, a failed attempt is rolled back
+// to a savepoint so that only the failure is recorded.
+func (a *apiConfig) dispatchNextEvent(ctx context.Context) bool {
+	tx, err := a.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("failed to start transaction: %v", err)
+		return false
+	}
+	defer tx.Rollback()
+	qtx := a.dbQueries.WithTx(tx)
+
+	outboxEvent, err := qtx.ClaimPendingOutboxEvent(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false
+	}
+	if err != nil {
+		log.Printf("failed to claim event: %v", err)
+		return false
+	}
+
+	_, err = tx.ExecContext(ctx, "SAVEPOINT dispatch_event")
+	if err != nil {
+		log.Printf("failed to create savepoint: %v", err)
+		return false
+	}
+
+	event := domainEvent{
+		ID:        outboxEvent.ID,
+		Type:      outboxEvent.EventType,
+		UserID:    outboxEvent.UserID,
+		CreatedAt: outboxEvent.CreatedAt,
+		Data:      json.RawMessage(outboxEvent.Payload),
+	}
+
+	var dispatchErr error
+	for _, subscriber := range a.events.subscribers {
+		err = subscriber.handle(ctx, qtx, event)
+		if err != nil {
+			dispatchErr = fmt.Errorf("%s: %v", subscriber.name, err)
+			break
+		}
+	}
+
+	if dispatchErr == nil {
+		_, err = tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", outboxDispatchLock)
+		if err == nil {
+			var seq sql.NullInt64
+			seq, err = qtx.MarkOutboxEventDispatched(ctx, event.ID)
+			event.Seq = seq.Int64
+		}
+	} else {
+		log.Printf("failed to dispatch event %d: %v", event.ID, dispatchErr)
+		_, err = tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT dispatch_event")
+		if err == nil {
+			attempts := int(outboxEvent.Attempts) + 1
+			failure := database.RecordOutboxEventFailureParams{
+				ID:            event.ID,
+				Status:        outboxEventPending,
+				NextAttemptAt: time.Now().Add(webhookRetryDelay(attempts)),
+				LastError:     sql.NullString{String: dispatchErr.Error(), Valid: true},
+			}
+			if attempts >= eventMaxAttempts {
+				failure.Status = outboxEventFailed
+			}
+			err = qtx.RecordOutboxEventFailure(ctx, failure)
+		}
+	}
+	if err != nil {
+		log.Printf("failed to update event %d: %v", event.ID, err)
+		return false
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("failed to save event %d: %v", event.ID, err)
+		return false
+	}
+
+	if dispatchErr == nil {
+		for _, listener := range a.events.listeners {
+			listener(event)
+		}
+	}
+	return true
+}
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"net/http"
+	"os"
 	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
 )
 
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) error {
@@ -22,6 +28,16 @@ func respondWithError(w http.ResponseWriter, code int, msg string) error {
 	return respondWithJSON(w, code, map[string]string{"error": msg})
 }
 
+type fieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func respondWithValidationErrors(w http.ResponseWriter, errs []fieldError) error {
+	return respondWithAPIError(w, &apiError{Code: 400, Message: "validation failed", Fields: errs})
+}
+
 func removeProfane(post string) string {
 	forbiddenWords := []string{"kerfuffle", "sharbert", "fornax"}
 	for _, word := range forbiddenWords {
@@ -30,3 +46,38 @@ func removeProfane(post string) string {
 	}
 	return post
 }
+
+func getEnvDefault(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// page cursors point at the last item of a page, which is ordered by a
+// timestamp with the id breaking ties. Grouped notifications move to the
+// front when they are updated, so they are paged by updated_at.
+func encodePageCursor(timestamp time.Time, id uuid.UUID) string {
+	raw := timestamp.UTC().Format(time.RFC3339Nano) + "," + id.String()
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodePageCursor(cursor string) (time.Time, uuid.UUID, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, uuid.UUID{}, false
+	}
+	timestamp, idString, found := strings.Cut(string(raw), ",")
+	if !found {
+		return time.Time{}, uuid.UUID{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return time.Time{}, uuid.UUID{}, false
+	}
+	id, err := uuid.Parse(idString)
+	if err != nil {
+		return time.Time{}, uuid.UUID{}, false
+	}
+	return t, id, true
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/google/uuid"
@@ -21,3 +22,100 @@ type Chirp struct {
 	Body      string    `json:"body"`
 	UserID    uuid.UUID `json:"user_id"`
 }
+
+type Passkey struct {
+	ID         string     `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Name       string     `json:"name"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+type PersonalAccessToken struct {
+	ID         uuid.UUID  `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+type DataExport struct {
+	ID          uuid.UUID `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	Status      string    `json:"status"`
+	IncludeHTML bool      `json:"include_html"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	DownloadURL string    `json:"download_url,omitempty"`
+}
+
+type WebhookEndpoint struct {
+	ID                  uuid.UUID  `json:"id"`
+	CreatedAt           time.Time  `json:"created_at"`
+	URL                 string     `json:"url"`
+	Events              []string   `json:"events"`
+	Enabled             bool       `json:"enabled"`
+	ConsecutiveFailures int32      `json:"consecutive_failures"`
+	DisabledAt          *time.Time `json:"disabled_at"`
+}
+
+type WebhookDelivery struct {
+	ID             uuid.UUID       `json:"id"`
+	CreatedAt      time.Time       `json:"created_at"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int32           `json:"attempts"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at"`
+	LastAttemptAt  *time.Time      `json:"last_attempt_at"`
+	ResponseStatus *int32          `json:"response_status"`
+	LastError      string          `json:"last_error,omitempty"`
+}
+
+type PolkaEvent struct {
+	ID            string          `json:"id"`
+	Event         string          `json:"event"`
+	ReceivedAt    time.Time       `json:"received_at"`
+	Status        string          `json:"status"`
+	Attempts      int32           `json:"attempts"`
+	NextAttemptAt *time.Time      `json:"next_attempt_at"`
+	ProcessedAt   *time.Time      `json:"processed_at"`
+	LastError     string          `json:"last_error,omitempty"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+type Notification struct {
+	ID             uuid.UUID   `json:"id"`
+	CreatedAt      time.Time   `json:"created_at"`
+	UpdatedAt      time.Time   `json:"updated_at"`
+	Type           string      `json:"type"`
+	ChirpID        *uuid.UUID  `json:"chirp_id"`
+	ConversationID *uuid.UUID  `json:"conversation_id"`
+	ActorIDs       []uuid.UUID `json:"actor_ids"`
+	ActorCount     int32       `json:"actor_count"`
+	ReadAt         *time.Time  `json:"read_at"`
+}
+
+type Conversation struct {
+	ID              uuid.UUID                 `json:"id"`
+	CreatedAt       time.Time                 `json:"created_at"`
+	UpdatedAt       time.Time                 `json:"updated_at"`
+	ProfanityFilter bool                      `json:"profanity_filter"`
+	LastMessageAt   *time.Time                `json:"last_message_at"`
+	Muted           bool                      `json:"muted"`
+	UnreadCount     int64                     `json:"unread_count"`
+	Participants    []ConversationParticipant `json:"participants"`
+}
+
+type ConversationParticipant struct {
+	UserID     uuid.UUID  `json:"user_id"`
+	JoinedAt   time.Time  `json:"joined_at"`
+	LastReadAt *time.Time `json:"last_read_at"`
+}
+
+type Message struct {
+	ID             uuid.UUID `json:"id"`
+	CreatedAt      time.Time `json:"created_at"`
+	ConversationID uuid.UUID `json:"conversation_id"`
+	SenderID       uuid.UUID `json:"sender_id"`
+	Body           string    `json:"body"`
+}
@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// BreachedPasswordList is a local copy of a k-anonymity password range
+// database such as Have I Been Pwned's. Dir holds one file per five
+// character SHA-1 prefix, each line being "SUFFIX:COUNT", so a lookup only
+// needs to read one small file.
+type BreachedPasswordList struct {
+	Dir string
+}
+
+// Count returns how often the password appears in known breaches.
+func (l BreachedPasswordList) Count(password string) (int, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	file, err := os.Open(filepath.Join(l.Dir, prefix))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to open breached password range: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		candidate, count, found := strings.Cut(line, ":")
+		if !strings.EqualFold(candidate, suffix) {
+			continue
+		}
+		if !found {
+			return 1, nil
+		}
+		n, err := strconv.Atoi(count)
+		if err != nil {
+			return 1, nil
+		}
+		return n, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read breached password range: %v", err)
+	}
+	return 0, nil
+}
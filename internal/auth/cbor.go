@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// decodeCBOR decodes the subset of CBOR used by WebAuthn attestation objects
+// and COSE keys. It returns the decoded value and the number of bytes read.
+// Maps are returned as map[any]any with int64 or string keys.
+func decodeCBOR(data []byte) (any, int, error) {
+	return decodeCBORItem(data, 0)
+}
+
+const maxCBORDepth = 16
+
+func decodeCBORItem(data []byte, depth int) (any, int, error) {
+	if depth > maxCBORDepth {
+		return nil, 0, fmt.Errorf("cbor: nesting too deep")
+	}
+	if len(data) == 0 {
+		return nil, 0, fmt.Errorf("cbor: unexpected end of data")
+	}
+
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+
+	arg, n, err := cborArgument(data, info)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, 0, fmt.Errorf("cbor: integer overflow")
+		}
+		return int64(arg), n, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, 0, fmt.Errorf("cbor: integer overflow")
+		}
+		return -1 - int64(arg), n, nil
+	case 2, 3:
+		if uint64(len(data)-n) < arg {
+			return nil, 0, fmt.Errorf("cbor: string exceeds data")
+		}
+		end := n + int(arg)
+		if major == 2 {
+			return append([]byte(nil), data[n:end]...), end, nil
+		}
+		return string(data[n:end]), end, nil
+	case 4:
+		if arg > uint64(len(data)) {
+			return nil, 0, fmt.Errorf("cbor: array exceeds data")
+		}
+		items := make([]any, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			item, m, err := decodeCBORItem(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			items = append(items, item)
+			n += m
+		}
+		return items, n, nil
+	case 5:
+		if arg > uint64(len(data)) {
+			return nil, 0, fmt.Errorf("cbor: map exceeds data")
+		}
+		items := make(map[any]any, arg)
+		for i := uint64(0); i < arg; i++ {
+			key, m, err := decodeCBORItem(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			n += m
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, 0, fmt.Errorf("cbor: unsupported map key type %T", key)
+			}
+			value, m, err := decodeCBORItem(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			n += m
+			items[key] = value
+		}
+		return items, n, nil
+	case 7:
+		switch info {
+		case 20:
+			return false, n, nil
+		case 21:
+			return true, n, nil
+		case 22, 23:
+			return nil, n, nil
+		}
+		return nil, 0, fmt.Errorf("cbor: unsupported simple value %d", info)
+	}
+	return nil, 0, fmt.Errorf("cbor: unsupported major type %d", major)
+}
+
+func cborArgument(data []byte, info byte) (uint64, int, error) {
+	switch {
+	case info < 24:
+		return uint64(info), 1, nil
+	case info == 24 && len(data) >= 2:
+		return uint64(data[1]), 2, nil
+	case info == 25 && len(data) >= 3:
+		return uint64(binary.BigEndian.Uint16(data[1:3])), 3, nil
+	case info == 26 && len(data) >= 5:
+		return uint64(binary.BigEndian.Uint32(data[1:5])), 5, nil
+	case info == 27 && len(data) >= 9:
+		return binary.BigEndian.Uint64(data[1:9]), 9, nil
+	case info > 27:
+		return 0, 0, fmt.Errorf("cbor: indefinite lengths are not supported")
+	}
+	return 0, 0, fmt.Errorf("cbor: unexpected end of data")
+}
@@ -1,20 +1,185 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
 
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
 
-func HashPassword(password string) (string, error) {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return "", fmt.Errorf("failed to hash password: %v", err)
+const (
+	AlgorithmArgon2id = "argon2id"
+	AlgorithmBcrypt   = "bcrypt"
+)
+
+var (
+	ErrEmptyPassword   = errors.New("password must not be empty")
+	ErrPasswordTooLong = fmt.Errorf("password must not be longer than %d bytes", MaxPasswordBytes)
+	ErrUnknownHash     = errors.New("unknown password hash format")
+)
+
+type Argon2Params struct {
+	Memory      uint32 // in KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// PasswordHasher creates hashes with the configured algorithm and verifies
+// hashes of every supported algorithm. Argon2id hashes use the PHC string
+// format ($argon2id$v=19$m=...,t=...,p=...$salt$hash), bcrypt hashes the
+// usual $2a$ format, so the stored hash always says how it was made.
+type PasswordHasher struct {
+	Algorithm  string
+	BcryptCost int
+	Argon2     Argon2Params
+
+	dummyOnce sync.Once
+	dummyHash string
+}
+
+func NewPasswordHasher() *PasswordHasher {
+	return &PasswordHasher{
+		Algorithm:  AlgorithmArgon2id,
+		BcryptCost: bcrypt.DefaultCost,
+		Argon2: Argon2Params{
+			Memory:      64 * 1024,
+			Iterations:  3,
+			Parallelism: 2,
+			SaltLength:  16,
+			KeyLength:   32,
+		},
+	}
+}
+
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	if password == "" {
+		return "", ErrEmptyPassword
+	}
+
+	switch h.Algorithm {
+	case AlgorithmArgon2id:
+		return h.hashArgon2id(password)
+	case AlgorithmBcrypt:
+		// bcrypt would otherwise silently ignore the rest of the password
+		if len(password) > MaxPasswordBytes {
+			return "", ErrPasswordTooLong
+		}
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+		if err != nil {
+			return "", fmt.Errorf("failed to hash password: %v", err)
+		}
+		return string(hashedPassword), nil
+	}
+	return "", fmt.Errorf("unsupported password hash algorithm: %q", h.Algorithm)
+}
+
+func (h *PasswordHasher) hashArgon2id(password string) (string, error) {
+	p := h.Argon2
+	salt := make([]byte, p.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %v", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		p.Memory,
+		p.Iterations,
+		p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// NeedsRehash reports whether a hash was made with a different algorithm or
+// different parameters than the ones currently configured.
+func (h *PasswordHasher) NeedsRehash(hash string) bool {
+	switch h.Algorithm {
+	case AlgorithmArgon2id:
+		params, _, _, err := decodeArgon2id(hash)
+		if err != nil {
+			return true
+		}
+		return params.Memory != h.Argon2.Memory ||
+			params.Iterations != h.Argon2.Iterations ||
+			params.Parallelism != h.Argon2.Parallelism ||
+			params.KeyLength != h.Argon2.KeyLength
+	case AlgorithmBcrypt:
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost != h.BcryptCost
 	}
-	return string(hashedPassword), nil
+	return false
+}
+
+// CheckDummy verifies the password against a throwaway hash. It is used
+// when a login names an unknown account, so the response time does not
+// reveal whether the email exists.
+func (h *PasswordHasher) CheckDummy(password string) {
+	h.dummyOnce.Do(func() {
+		h.dummyHash, _ = h.Hash("chirpy-dummy-password")
+	})
+	CheckPasswordHash(password, h.dummyHash)
 }
 
 func CheckPasswordHash(password, hash string) error {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err
+	if strings.HasPrefix(hash, "$argon2id$") {
+		params, salt, key, err := decodeArgon2id(hash)
+		if err != nil {
+			return err
+		}
+		candidate := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+		if subtle.ConstantTimeCompare(candidate, key) != 1 {
+			return fmt.Errorf("password does not match")
+		}
+		return nil
+	}
+
+	if strings.HasPrefix(hash, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	}
+
+	return ErrUnknownHash
+}
+
+func decodeArgon2id(hash string) (Argon2Params, []byte, []byte, error) {
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != AlgorithmArgon2id {
+		return Argon2Params{}, nil, nil, ErrUnknownHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return Argon2Params{}, nil, nil, fmt.Errorf("unsupported argon2 version: %q", parts[2])
+	}
+
+	params := Argon2Params{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return Argon2Params{}, nil, nil, fmt.Errorf("invalid argon2 parameters: %v", err)
+	}
+	if params.Iterations == 0 || params.Parallelism == 0 {
+		return Argon2Params{}, nil, nil, fmt.Errorf("invalid argon2 parameters")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Argon2Params{}, nil, nil, fmt.Errorf("invalid argon2 salt: %v", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return Argon2Params{}, nil, nil, fmt.Errorf("invalid argon2 hash")
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
 }
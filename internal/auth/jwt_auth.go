@@ -1,8 +1,10 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
 
@@ -10,59 +12,95 @@ import (
 	"github.com/google/uuid"
 )
 
-func MakeJWT(userID uuid.UUID, tokenSecret string, expiresIn time.Duration) (string, error) {
-	currentTime := jwt.NewNumericDate(time.Now())
-	expTime := jwt.NewNumericDate(time.Now().Add(expiresIn))
-	claims := jwt.RegisteredClaims{
-		Issuer:    "chirpy",
-		IssuedAt:  currentTime,
-		ExpiresAt: expTime,
-		Subject:   userID.String(),
-	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+type TokenConfig struct {
+	Keys            *KeySet
+	Issuer          string
+	Audience        []string
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	// tolerated clock difference between chirpy and other verifiers
+	Leeway time.Duration
+}
+
+type Claims struct {
+	jwt.RegisteredClaims
+	Scopes []string  `json:"scopes,omitempty"`
+	Roles  []string  `json:"roles,omitempty"`
+	UserID uuid.UUID `json:"-"`
+}
+
+func (c *Claims) HasScope(scope string) bool {
+	return slices.Contains(c.Scopes, scope)
+}
 
-	return token.SignedString([]byte(tokenSecret))
+func (c *Claims) HasRole(role string) bool {
+	return slices.Contains(c.Roles, role)
 }
 
-func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
-	callback := jwt.Keyfunc(func(t *jwt.Token) (any, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
-		}
-		return []byte(tokenSecret), nil
-	})
+func MakeJWT(userID uuid.UUID, cfg TokenConfig, scopes, roles []string) (string, error) {
+	now := time.Now()
+	claims := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Issuer:    cfg.Issuer,
+			Audience:  cfg.Audience,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(cfg.AccessTokenTTL)),
+			Subject:   userID.String(),
+		},
+		Scopes: scopes,
+		Roles:  roles,
+	}
+
+	return cfg.Keys.sign(claims)
+}
 
-	token, err := jwt.ParseWithClaims(tokenString, &jwt.RegisteredClaims{}, callback)
+func ValidateJWT(tokenString string, cfg TokenConfig) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, cfg.Keys.keyfunc,
+		jwt.WithIssuer(cfg.Issuer),
+		jwt.WithAudience(cfg.Audience...),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(cfg.Leeway),
+	)
 	if err != nil {
-		return uuid.Nil, fmt.Errorf("invalid token: %v", err)
+		return nil, fmt.Errorf("invalid token: %v", err)
 	}
 
-	claims, ok := token.Claims.(*jwt.RegisteredClaims)
-	if !ok {
-		return uuid.Nil, fmt.Errorf("error")
+	if claims.ID == "" {
+		return nil, fmt.Errorf("invalid token: missing token id")
 	}
 
-	idString := claims.Subject
-	id, err := uuid.Parse(idString)
+	id, err := uuid.Parse(claims.Subject)
 	if err != nil {
-		return uuid.Nil, fmt.Errorf("invalid subject id: %v", err)
+		return nil, fmt.Errorf("invalid subject id: %v", err)
 	}
-	return id, nil
+	claims.UserID = id
+
+	return claims, nil
 }
 
+var (
+	ErrNoAuthHeader        = errors.New("no authorization")
+	ErrMalformedAuthHeader = errors.New("invalid authorization header")
+)
+
 func GetBearerToken(headers http.Header) (string, error) {
 	authHeader := headers.Get("Authorization")
 	if authHeader == "" {
-		return "", fmt.Errorf("no authorization")
+		return "", ErrNoAuthHeader
 	}
 
-	if !strings.HasPrefix(authHeader, "Bearer ") {
-		return "", fmt.Errorf("invalid authorization header")
+	// the scheme is case-insensitive (RFC 7235)
+	if !strings.HasPrefix(strings.ToLower(authHeader), "bearer ") {
+		return "", ErrMalformedAuthHeader
 	}
 
-	token := strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer "))
+	token := strings.TrimSpace(authHeader[len("bearer "):])
 	if token == "" {
-		return "", fmt.Errorf("invalid token")
+		return "", ErrMalformedAuthHeader
 	}
 
 	return token, nil
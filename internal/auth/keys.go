@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// legacyKeyID identifies the shared HS256 secret. Tokens signed with it
+// carry no kid header.
+const legacyKeyID = ""
+
+type signingKey struct {
+	id      string
+	method  jwt.SigningMethod
+	private crypto.PrivateKey
+	public  crypto.PublicKey
+}
+
+// KeySet holds the key used to sign new tokens and every key that is still
+// accepted for verification, so keys can be rotated without logging users out.
+type KeySet struct {
+	signing *signingKey
+	keys    map[string]*signingKey
+}
+
+func NewHMACKeySet(secret string) *KeySet {
+	key := &signingKey{
+		id:      legacyKeyID,
+		method:  jwt.SigningMethodHS256,
+		private: []byte(secret),
+		public:  []byte(secret),
+	}
+	return &KeySet{
+		signing: key,
+		keys:    map[string]*signingKey{legacyKeyID: key},
+	}
+}
+
+// LoadKeySet reads every <kid>.pem file in dir. Private keys can sign and
+// verify, public keys are only used to verify tokens signed by retired keys.
+// If legacySecret is set, HS256 tokens signed with it are still accepted.
+func LoadKeySet(dir, signingKeyID, legacySecret string) (*KeySet, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keys: %v", err)
+	}
+	sort.Strings(paths)
+
+	set := &KeySet{keys: map[string]*signingKey{}}
+	if legacySecret != "" {
+		set.keys[legacyKeyID] = NewHMACKeySet(legacySecret).signing
+	}
+
+	for _, path := range paths {
+		kid := strings.TrimSuffix(filepath.Base(path), ".pem")
+		key, err := loadPEMKey(kid, path)
+		if err != nil {
+			return nil, err
+		}
+		set.keys[kid] = key
+	}
+
+	signing, ok := set.keys[signingKeyID]
+	if !ok || signingKeyID == legacyKeyID {
+		return nil, fmt.Errorf("signing key %q not found in %s", signingKeyID, dir)
+	}
+	if signing.private == nil {
+		return nil, fmt.Errorf("signing key %q has no private key", signingKeyID)
+	}
+	set.signing = signing
+
+	return set, nil
+}
+
+func loadPEMKey(kid, path string) (*signingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key %s: %v", path, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("key %s is not PEM encoded", path)
+	}
+
+	key := &signingKey{id: kid}
+	switch block.Type {
+	case "PRIVATE KEY":
+		private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse key %s: %v", path, err)
+		}
+		key.private = private
+		key.public = private.(crypto.Signer).Public()
+	case "PUBLIC KEY":
+		public, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse key %s: %v", path, err)
+		}
+		key.public = public
+	default:
+		return nil, fmt.Errorf("key %s has unsupported PEM type %q", path, block.Type)
+	}
+
+	switch public := key.public.(type) {
+	case *rsa.PublicKey:
+		key.method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		key.method = jwt.SigningMethodEdDSA
+	case *ecdsa.PublicKey:
+		if public.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("key %s: only P-256 EC keys are supported", path)
+		}
+		key.method = jwt.SigningMethodES256
+	default:
+		return nil, fmt.Errorf("key %s has unsupported type %T", path, key.public)
+	}
+
+	return key, nil
+}
+
+func (k *KeySet) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.signing.method, claims)
+	if k.signing.id != legacyKeyID {
+		token.Header["kid"] = k.signing.id
+	}
+	return token.SignedString(k.signing.private)
+}
+
+func (k *KeySet) keyfunc(t *jwt.Token) (any, error) {
+	kid, _ := t.Header["kid"].(string)
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id: %q", kid)
+	}
+	// the key decides the algorithm, never the token header
+	if t.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+	}
+	return key.public, nil
+}
+
+// JWKS returns the public verification keys. The shared HS256 secret is
+// never published.
+func (k *KeySet) JWKS() JWKSet {
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	set := JWKSet{Keys: []JWK{}}
+	for _, id := range ids {
+		key := k.keys[id]
+		jwk := JWK{Kid: key.id, Use: "sig", Alg: key.method.Alg()}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case *ecdsa.PublicKey:
+			size := (public.Curve.Params().BitSize + 7) / 8
+			jwk.Kty = "EC"
+			jwk.Crv = public.Curve.Params().Name
+			jwk.X = base64.RawURLEncoding.EncodeToString(public.X.FillBytes(make([]byte, size)))
+			jwk.Y = base64.RawURLEncoding.EncodeToString(public.Y.FillBytes(make([]byte, size)))
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func testTokenConfig(keys *KeySet) TokenConfig {
+	return TokenConfig{
+		Keys:           keys,
+		Issuer:         "chirpy",
+		Audience:       []string{"chirpy"},
+		AccessTokenTTL: time.Hour,
+	}
+}
+
+func TestLoadKeySetLegacySecret(t *testing.T) {
+	dir := t.TempDir()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "2025-01.pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	legacyToken, err := MakeJWT(uuid.New(), testTokenConfig(NewHMACKeySet("shared-secret")), DefaultScopes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		legacySecret string
+		wantValid    bool
+	}{
+		{name: "without the legacy secret", legacySecret: "", wantValid: false},
+		{name: "with the legacy secret", legacySecret: "shared-secret", wantValid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := LoadKeySet(dir, "2025-01", tt.legacySecret)
+			if err != nil {
+				t.Fatalf("LoadKeySet() error = %v", err)
+			}
+			cfg := testTokenConfig(keys)
+
+			_, err = ValidateJWT(legacyToken, cfg)
+			if (err == nil) != tt.wantValid {
+				t.Errorf("ValidateJWT() of an HS256 token error = %v, want valid %v", err, tt.wantValid)
+			}
+
+			// new tokens are signed with the asymmetric key either way
+			token, err := MakeJWT(uuid.New(), cfg, DefaultScopes, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = ValidateJWT(token, cfg)
+			if err != nil {
+				t.Errorf("ValidateJWT() of a new token error = %v", err)
+			}
+		})
+	}
+}
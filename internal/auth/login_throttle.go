@@ -0,0 +1,27 @@
+package auth
+
+import "time"
+
+// LoginThrottle describes how long logins are locked after repeated
+// failures. The first FreeAttempts failures are not punished, after that the
+// lockout doubles with every failure up to MaxLockout.
+type LoginThrottle struct {
+	FreeAttempts int
+	BaseLockout  time.Duration
+	MaxLockout   time.Duration
+}
+
+func (t LoginThrottle) LockoutFor(failures int) time.Duration {
+	if failures < t.FreeAttempts {
+		return 0
+	}
+
+	lockout := t.BaseLockout
+	for i := t.FreeAttempts; i < failures; i++ {
+		lockout *= 2
+		if lockout >= t.MaxLockout {
+			return t.MaxLockout
+		}
+	}
+	return lockout
+}
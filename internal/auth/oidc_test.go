@@ -0,0 +1,327 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testOIDCClientID     = "chirpy-client"
+	testOIDCClientSecret = "chirpy-secret"
+	testOIDCRedirectURL  = "https://chirpy.example/api/oidc/callback"
+	testOIDCKeyID        = "issuer-key"
+)
+
+// testIssuer is an OpenID provider with discovery, JWKS and token endpoints.
+// Codes are handed out by authorize and redeemed for the ID token queued
+// with them.
+type testIssuer struct {
+	server *httptest.Server
+	key    *ecdsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]testAuthorization
+}
+
+type testAuthorization struct {
+	codeChallenge string
+	idToken       string
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate issuer key: %v", err)
+	}
+	issuer := &testIssuer{
+		key:   key,
+		codes: map[string]testAuthorization{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                issuer.server.URL,
+			AuthorizationEndpoint: issuer.server.URL + "/authorize",
+			TokenEndpoint:         issuer.server.URL + "/token",
+			JWKSURI:               issuer.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(JWKSet{Keys: []JWK{{
+			Kty: "EC",
+			Kid: testOIDCKeyID,
+			Use: "sig",
+			Alg: "ES256",
+			Crv: "P-256",
+			X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+		}}})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, ok := r.BasicAuth()
+		if !ok || clientID != testOIDCClientID || clientSecret != testOIDCClientSecret {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		if r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("redirect_uri") != testOIDCRedirectURL {
+			http.Error(w, `{"error":"invalid_request"}`, http.StatusBadRequest)
+			return
+		}
+
+		issuer.mu.Lock()
+		authorization, ok := issuer.codes[r.PostFormValue("code")]
+		delete(issuer.codes, r.PostFormValue("code"))
+		issuer.mu.Unlock()
+
+		sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != authorization.codeChallenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": authorization.idToken})
+	})
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+func (i *testIssuer) provider() *OIDCProvider {
+	p := NewOIDCProvider(i.server.URL, testOIDCClientID, testOIDCClientSecret, testOIDCRedirectURL)
+	p.HTTPClient = i.server.Client()
+	return p
+}
+
+// authorize plays the user signing in at the provider: it follows the
+// authorization URL and returns the code the provider would redirect with.
+func (i *testIssuer) authorize(t *testing.T, authURL string, idToken string) (code, state string) {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("invalid authorization URL: %v", err)
+	}
+	query := u.Query()
+	if query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("code_challenge_method = %q, want S256", query.Get("code_challenge_method"))
+	}
+
+	code = "code-" + query.Get("state")
+	i.mu.Lock()
+	i.codes[code] = testAuthorization{
+		codeChallenge: query.Get("code_challenge"),
+		idToken:       idToken,
+	}
+	i.mu.Unlock()
+	return code, query.Get("state")
+}
+
+func (i *testIssuer) validClaims(nonce string) OIDCClaims {
+	now := time.Now()
+	return OIDCClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    i.server.URL,
+			Subject:   "provider-user-1",
+			Audience:  jwt.ClaimStrings{testOIDCClientID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(5 * time.Minute)),
+		},
+		Email:         "user@example.com",
+		EmailVerified: true,
+		Nonce:         nonce,
+	}
+}
+
+func (i *testIssuer) sign(t *testing.T, claims OIDCClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = testOIDCKeyID
+	signed, err := token.SignedString(i.key)
+	if err != nil {
+		t.Fatalf("failed to sign id token: %v", err)
+	}
+	return signed
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := newTestIssuer(t)
+	provider := issuer.provider()
+	ctx := context.Background()
+
+	verifier, challenge, err := MakePKCEVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := provider.AuthCodeURL(ctx, "state-1", "nonce-1", challenge)
+	if err != nil {
+		t.Fatalf("AuthCodeURL() error = %v", err)
+	}
+
+	code, state := issuer.authorize(t, authURL, issuer.sign(t, issuer.validClaims("nonce-1")))
+	if state != "state-1" {
+		t.Errorf("state = %q, want %q", state, "state-1")
+	}
+
+	rawIDToken, err := provider.Exchange(ctx, code, verifier)
+	if err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+
+	claims, err := provider.VerifyIDToken(ctx, rawIDToken, "nonce-1")
+	if err != nil {
+		t.Fatalf("VerifyIDToken() error = %v", err)
+	}
+	if claims.Subject != "provider-user-1" || claims.Email != "user@example.com" || !claims.EmailVerified {
+		t.Errorf("VerifyIDToken() = %+v", claims)
+	}
+}
+
+func TestOIDCExchangeRequiresCodeVerifier(t *testing.T) {
+	issuer := newTestIssuer(t)
+	provider := issuer.provider()
+	ctx := context.Background()
+
+	_, challenge, err := MakePKCEVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := provider.AuthCodeURL(ctx, "state-1", "nonce-1", challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := issuer.authorize(t, authURL, issuer.sign(t, issuer.validClaims("nonce-1")))
+
+	// a stolen code is useless without the verifier of the login that
+	// requested it
+	otherVerifier, _, err := MakePKCEVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.Exchange(ctx, code, otherVerifier); err == nil {
+		t.Fatal("Exchange() with the wrong code verifier succeeded")
+	}
+}
+
+func TestOIDCVerifyIDTokenRejects(t *testing.T) {
+	issuer := newTestIssuer(t)
+	otherIssuer := newTestIssuer(t)
+
+	tests := []struct {
+		name   string
+		modify func(claims *OIDCClaims)
+		// signs with the key of another provider
+		foreignKey bool
+	}{
+		{
+			name:   "nonce mismatch",
+			modify: func(claims *OIDCClaims) { claims.Nonce = "another-nonce" },
+		},
+		{
+			name:   "wrong issuer",
+			modify: func(claims *OIDCClaims) { claims.Issuer = otherIssuer.server.URL },
+		},
+		{
+			name:   "wrong audience",
+			modify: func(claims *OIDCClaims) { claims.Audience = jwt.ClaimStrings{"another-client"} },
+		},
+		{
+			name: "expired",
+			modify: func(claims *OIDCClaims) {
+				claims.IssuedAt = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+				claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-10 * time.Minute))
+			},
+		},
+		{
+			name:   "without expiry",
+			modify: func(claims *OIDCClaims) { claims.ExpiresAt = nil },
+		},
+		{
+			name:   "without subject",
+			modify: func(claims *OIDCClaims) { claims.Subject = "" },
+		},
+		{
+			name:       "foreign signing key",
+			modify:     func(claims *OIDCClaims) {},
+			foreignKey: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := issuer.validClaims("nonce-1")
+			tt.modify(&claims)
+
+			signer := issuer
+			if tt.foreignKey {
+				signer = otherIssuer
+			}
+			rawIDToken := signer.sign(t, claims)
+
+			_, err := issuer.provider().VerifyIDToken(context.Background(), rawIDToken, "nonce-1")
+			if err == nil {
+				t.Fatal("VerifyIDToken() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestOIDCVerifyIDTokenRejectsUnsignedToken(t *testing.T) {
+	issuer := newTestIssuer(t)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodNone, issuer.validClaims("nonce-1"))
+	token.Header["kid"] = testOIDCKeyID
+	rawIDToken, err := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = issuer.provider().VerifyIDToken(context.Background(), rawIDToken, "nonce-1")
+	if err == nil {
+		t.Fatal("VerifyIDToken() accepted an unsigned token")
+	}
+}
+
+func TestOIDCVerifyIDTokenReportsUnverifiedEmail(t *testing.T) {
+	issuer := newTestIssuer(t)
+	provider := issuer.provider()
+	ctx := context.Background()
+
+	verifier, challenge, err := MakePKCEVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := provider.AuthCodeURL(ctx, "state-1", "nonce-1", challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the callback refuses to create or claim accounts with such an address
+	claims := issuer.validClaims("nonce-1")
+	claims.EmailVerified = false
+	code, _ := issuer.authorize(t, authURL, issuer.sign(t, claims))
+
+	rawIDToken, err := provider.Exchange(ctx, code, verifier)
+	if err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	verified, err := provider.VerifyIDToken(ctx, rawIDToken, "nonce-1")
+	if err != nil {
+		t.Fatalf("VerifyIDToken() error = %v", err)
+	}
+	if verified.EmailVerified {
+		t.Error("EmailVerified = true for an unverified address")
+	}
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+// bcrypt ignores everything after the first 72 bytes of a password
+const MaxPasswordBytes = 72
+
+type PasswordPolicy struct {
+	MinLength int
+	// zero means no limit; set it to MaxPasswordBytes when new passwords
+	// are hashed with bcrypt
+	MaxBytes         int
+	RequireUppercase bool
+	RequireLowercase bool
+	RequireDigit     bool
+	RequireSymbol    bool
+}
+
+type PolicyViolation struct {
+	Code    string
+	Message string
+}
+
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{MinLength: 8}
+}
+
+func (p PasswordPolicy) Validate(password string) []PolicyViolation {
+	violations := []PolicyViolation{}
+
+	if !utf8.ValidString(password) {
+		return append(violations, PolicyViolation{"invalid_encoding", "password must be valid UTF-8"})
+	}
+	if length := utf8.RuneCountInString(password); length < p.MinLength {
+		violations = append(violations, PolicyViolation{
+			"too_short",
+			fmt.Sprintf("password must be at least %d characters long", p.MinLength),
+		})
+	}
+	if p.MaxBytes > 0 && len(password) > p.MaxBytes {
+		violations = append(violations, PolicyViolation{
+			"too_long",
+			fmt.Sprintf("password must not be longer than %d bytes", p.MaxBytes),
+		})
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			hasSymbol = true
+		}
+	}
+
+	if p.RequireUppercase && !hasUpper {
+		violations = append(violations, PolicyViolation{"missing_uppercase", "password must contain an uppercase letter"})
+	}
+	if p.RequireLowercase && !hasLower {
+		violations = append(violations, PolicyViolation{"missing_lowercase", "password must contain a lowercase letter"})
+	}
+	if p.RequireDigit && !hasDigit {
+		violations = append(violations, PolicyViolation{"missing_digit", "password must contain a digit"})
+	}
+	if p.RequireSymbol && !hasSymbol {
+		violations = append(violations, PolicyViolation{"missing_symbol", "password must contain a symbol"})
+	}
+
+	return violations
+}
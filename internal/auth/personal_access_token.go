@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// PersonalAccessTokenPrefix marks long-lived tokens so they can be told apart
+// from JWTs in the Authorization header and found by secret scanners.
+const PersonalAccessTokenPrefix = "chirpy_pat_"
+
+// AllScopes lists the scopes a personal access token can be granted.
+var AllScopes = []string{ScopeChirpsRead, ScopeChirpsWrite, ScopeProfileWrite, ScopeNotificationsRead, ScopeMessagesRead, ScopeMessagesWrite}
+
+func MakePersonalAccessToken() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("failed to generate token: %v", err)
+	}
+	return PersonalAccessTokenPrefix + hex.EncodeToString(key), nil
+}
+
+func IsPersonalAccessToken(token string) bool {
+	return strings.HasPrefix(token, PersonalAccessTokenPrefix)
+}
+
+// HashPersonalAccessToken returns the value stored in the database. The
+// tokens are random, so a fast hash is enough.
+func HashPersonalAccessToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func ValidScope(scope string) bool {
+	return slices.Contains(AllScopes, scope)
+}
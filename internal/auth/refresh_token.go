@@ -2,6 +2,7 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 )
 
@@ -11,3 +12,10 @@ func MakeRefreshToken() (string, error) {
 	encodedData := hex.EncodeToString(key)
 	return encodedData, nil
 }
+
+// HashToken is used for single-use tokens that are sent to the user and
+// only stored as a hash, e.g. email confirmation tokens.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
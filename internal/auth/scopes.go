@@ -0,0 +1,15 @@
+package auth
+
+const (
+	ScopeChirpsRead        = "chirps:read"
+	ScopeChirpsWrite       = "chirps:write"
+	ScopeProfileWrite      = "profile:write"
+	ScopeNotificationsRead = "notifications:read"
+	ScopeMessagesRead      = "messages:read"
+	ScopeMessagesWrite     = "messages:write"
+)
+
+// DefaultScopes are granted to tokens issued by an interactive login.
+var DefaultScopes = []string{ScopeChirpsRead, ScopeChirpsWrite, ScopeProfileWrite, ScopeNotificationsRead, ScopeMessagesRead, ScopeMessagesWrite}
+
+const RoleAdmin = "admin"
@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// test vectors of RFC 4226, appendix D
+var hotpTestKey = []byte("12345678901234567890")
+
+var hotpTestCodes = []string{
+	"755224", "287082", "359152", "969429", "338314",
+	"254676", "287922", "162583", "399871", "520489",
+}
+
+func TestTOTPCode(t *testing.T) {
+	for step, want := range hotpTestCodes {
+		got := totpCode(hotpTestKey, int64(step))
+		if got != want {
+			t.Errorf("totpCode(step %d) = %s, want %s", step, got, want)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString(hotpTestKey)
+	now := time.Unix(5*totpPeriod+10, 0)
+
+	tests := []struct {
+		name     string
+		code     string
+		wantStep int64
+		wantOK   bool
+	}{
+		{name: "current period", code: hotpTestCodes[5], wantStep: 5, wantOK: true},
+		{name: "previous period", code: hotpTestCodes[4], wantStep: 4, wantOK: true},
+		{name: "next period", code: hotpTestCodes[6], wantStep: 6, wantOK: true},
+		{name: "with spaces", code: " 254 676 ", wantStep: 5, wantOK: true},
+		{name: "outside of the skew", code: hotpTestCodes[3], wantOK: false},
+		{name: "too short", code: "25467", wantOK: false},
+		{name: "too long", code: "2546760", wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := ValidateTOTP(tt.code, secret, now)
+			if ok != tt.wantOK || (ok && step != tt.wantStep) {
+				t.Errorf("ValidateTOTP(%q) = %d, %v, want %d, %v", tt.code, step, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,296 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// COSE algorithm identifiers supported for passkeys.
+const (
+	COSEAlgES256 = -7
+	COSEAlgEdDSA = -8
+	COSEAlgRS256 = -257
+)
+
+const (
+	authDataFlagUserPresent  = 0x01
+	authDataFlagUserVerified = 0x04
+	authDataFlagAttestedData = 0x40
+)
+
+type WebAuthnConfig struct {
+	RPID   string
+	RPName string
+	Origin string
+}
+
+type WebAuthnCredential struct {
+	ID        []byte
+	PublicKey []byte
+	SignCount uint32
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+func MakeWebAuthnChallenge() (string, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return "", fmt.Errorf("failed to generate challenge: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(challenge), nil
+}
+
+// DecodeBase64URL accepts base64url with or without padding, which is how
+// browsers and most client libraries encode WebAuthn binary fields.
+func DecodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// ClientDataChallenge returns the challenge embedded in clientDataJSON so
+// callers can look up the pending ceremony before verifying it.
+func ClientDataChallenge(clientDataJSON []byte) (string, error) {
+	data := clientData{}
+	if err := json.Unmarshal(clientDataJSON, &data); err != nil {
+		return "", fmt.Errorf("invalid client data: %v", err)
+	}
+	return data.Challenge, nil
+}
+
+func (c WebAuthnConfig) VerifyRegistration(challenge string, clientDataJSON, attestationObject []byte) (WebAuthnCredential, error) {
+	if err := c.verifyClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return WebAuthnCredential{}, err
+	}
+
+	decoded, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return WebAuthnCredential{}, fmt.Errorf("invalid attestation object: %v", err)
+	}
+	attestation, ok := decoded.(map[any]any)
+	if !ok {
+		return WebAuthnCredential{}, fmt.Errorf("invalid attestation object")
+	}
+
+	// we request "none" attestation, so there is no statement to verify
+	if format, _ := attestation["fmt"].(string); format != "none" {
+		return WebAuthnCredential{}, fmt.Errorf("unsupported attestation format: %q", format)
+	}
+
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return WebAuthnCredential{}, fmt.Errorf("missing authenticator data")
+	}
+
+	authData, err := c.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	if authData.Flags&authDataFlagAttestedData == 0 {
+		return WebAuthnCredential{}, fmt.Errorf("missing attested credential data")
+	}
+
+	if _, err := ParseCOSEKey(authData.PublicKey); err != nil {
+		return WebAuthnCredential{}, err
+	}
+
+	return WebAuthnCredential{
+		ID:        authData.CredentialID,
+		PublicKey: authData.PublicKey,
+		SignCount: authData.SignCount,
+	}, nil
+}
+
+// VerifyAssertion checks a login assertion against the stored public key and
+// returns the authenticator's new signature counter.
+func (c WebAuthnConfig) VerifyAssertion(challenge string, publicKey []byte, storedSignCount uint32, clientDataJSON, rawAuthData, signature []byte) (uint32, error) {
+	if err := c.verifyClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return 0, err
+	}
+
+	authData, err := c.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return 0, err
+	}
+
+	key, err := ParseCOSEKey(publicKey)
+	if err != nil {
+		return 0, err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte(nil), rawAuthData...), clientDataHash[:]...)
+	if err := verifyCOSESignature(key, signed, signature); err != nil {
+		return 0, err
+	}
+
+	// a counter that does not increase indicates a cloned authenticator;
+	// authenticators that do not implement counters always report zero
+	if (authData.SignCount != 0 || storedSignCount != 0) && authData.SignCount <= storedSignCount {
+		return 0, fmt.Errorf("signature counter did not increase")
+	}
+
+	return authData.SignCount, nil
+}
+
+func (c WebAuthnConfig) verifyClientData(clientDataJSON []byte, ceremony, challenge string) error {
+	data := clientData{}
+	if err := json.Unmarshal(clientDataJSON, &data); err != nil {
+		return fmt.Errorf("invalid client data: %v", err)
+	}
+	if data.Type != ceremony {
+		return fmt.Errorf("unexpected client data type: %q", data.Type)
+	}
+	if data.Challenge != challenge {
+		return fmt.Errorf("challenge mismatch")
+	}
+	if data.Origin != c.Origin {
+		return fmt.Errorf("unexpected origin: %q", data.Origin)
+	}
+	return nil
+}
+
+func (c WebAuthnConfig) parseAuthenticatorData(data []byte) (authenticatorData, error) {
+	if len(data) < 37 {
+		return authenticatorData{}, fmt.Errorf("authenticator data too short")
+	}
+
+	authData := authenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+
+	rpIDHash := sha256.Sum256([]byte(c.RPID))
+	if !bytes.Equal(authData.RPIDHash, rpIDHash[:]) {
+		return authenticatorData{}, fmt.Errorf("relying party id mismatch")
+	}
+	if authData.Flags&authDataFlagUserPresent == 0 {
+		return authenticatorData{}, fmt.Errorf("user presence flag not set")
+	}
+	if authData.Flags&authDataFlagUserVerified == 0 {
+		return authenticatorData{}, fmt.Errorf("user verification flag not set")
+	}
+
+	if authData.Flags&authDataFlagAttestedData == 0 {
+		return authData, nil
+	}
+
+	// attested credential data: aaguid (16), id length (2), id, COSE key
+	rest := data[37:]
+	if len(rest) < 18 {
+		return authenticatorData{}, fmt.Errorf("attested credential data too short")
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLen {
+		return authenticatorData{}, fmt.Errorf("credential id exceeds authenticator data")
+	}
+	authData.CredentialID = rest[:idLen]
+	rest = rest[idLen:]
+
+	_, n, err := decodeCBOR(rest)
+	if err != nil {
+		return authenticatorData{}, fmt.Errorf("invalid credential public key: %v", err)
+	}
+	authData.PublicKey = rest[:n]
+
+	return authData, nil
+}
+
+// ParseCOSEKey converts a COSE_Key into an ecdsa, ed25519 or rsa public key.
+func ParseCOSEKey(data []byte) (crypto.PublicKey, error) {
+	decoded, _, err := decodeCBOR(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid COSE key: %v", err)
+	}
+	key, ok := decoded.(map[any]any)
+	if !ok {
+		return nil, fmt.Errorf("invalid COSE key")
+	}
+
+	kty, _ := key[int64(1)].(int64)
+	alg, _ := key[int64(3)].(int64)
+
+	switch {
+	case kty == 2 && alg == COSEAlgES256:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, fmt.Errorf("invalid P-256 key")
+		}
+		uncompressed := append(append([]byte{0x04}, x...), y...)
+		if _, err := ecdh.P256().NewPublicKey(uncompressed); err != nil {
+			return nil, fmt.Errorf("invalid P-256 key: %v", err)
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	case kty == 1 && alg == COSEAlgEdDSA:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	case kty == 3 && alg == COSEAlgRS256:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid RSA key")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported COSE key type %d with algorithm %d", kty, alg)
+}
+
+func verifyCOSESignature(key crypto.PublicKey, signed, signature []byte) error {
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		if !ecdsa.VerifyASN1(k, digest[:], signature) {
+			return fmt.Errorf("invalid signature")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, signed, signature) {
+			return fmt.Errorf("invalid signature")
+		}
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature); err != nil {
+			return fmt.Errorf("invalid signature: %v", err)
+		}
+	default:
+		return fmt.Errorf("unsupported key type %T", key)
+	}
+	return nil
+}
@@ -0,0 +1,437 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"sort"
+	"testing"
+)
+
+var testWebAuthn = WebAuthnConfig{
+	RPID:   "chirpy.example",
+	RPName: "Chirpy",
+	Origin: "https://chirpy.example",
+}
+
+// softAuthenticator is a passkey in software: it makes the same attestation
+// objects and assertions a browser passes on from a real authenticator.
+type softAuthenticator struct {
+	credentialID []byte
+	alg          int64
+	ecKey        *ecdsa.PrivateKey
+	edKey        ed25519.PrivateKey
+	signCount    uint32
+	rpID         string
+	origin       string
+}
+
+func newSoftAuthenticator(t *testing.T, alg int64) *softAuthenticator {
+	t.Helper()
+	a := &softAuthenticator{
+		credentialID: []byte("credential-" + t.Name()),
+		alg:          alg,
+		rpID:         testWebAuthn.RPID,
+		origin:       testWebAuthn.Origin,
+	}
+	var err error
+	switch alg {
+	case COSEAlgES256:
+		a.ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case COSEAlgEdDSA:
+		_, a.edKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		t.Fatalf("unsupported algorithm %d", alg)
+	}
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	return a
+}
+
+func (a *softAuthenticator) coseKey() []byte {
+	if a.alg == COSEAlgEdDSA {
+		return encodeTestCBOR(map[int64]any{
+			1:  int64(1),
+			3:  int64(COSEAlgEdDSA),
+			-1: int64(6),
+			-2: []byte(a.edKey.Public().(ed25519.PublicKey)),
+		})
+	}
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	a.ecKey.X.FillBytes(x)
+	a.ecKey.Y.FillBytes(y)
+	return encodeTestCBOR(map[int64]any{
+		1:  int64(2),
+		3:  int64(COSEAlgES256),
+		-1: int64(1),
+		-2: x,
+		-3: y,
+	})
+}
+
+func (a *softAuthenticator) authData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	flags := byte(authDataFlagUserPresent | authDataFlagUserVerified)
+	if attested {
+		flags |= authDataFlagAttestedData
+	}
+
+	data := append([]byte(nil), rpIDHash[:]...)
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if attested {
+		data = append(data, make([]byte, 16)...) // aaguid
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		data = append(data, a.coseKey()...)
+	}
+	return data
+}
+
+func (a *softAuthenticator) clientData(ceremony, challenge string) []byte {
+	data, _ := json.Marshal(clientData{
+		Type:      ceremony,
+		Challenge: challenge,
+		Origin:    a.origin,
+	})
+	return data
+}
+
+func (a *softAuthenticator) register(challenge string) (clientDataJSON, attestationObject []byte) {
+	attestationObject = encodeTestCBOR(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authData(true),
+	})
+	return a.clientData("webauthn.create", challenge), attestationObject
+}
+
+func (a *softAuthenticator) assert(t *testing.T, challenge string) (clientDataJSON, authData, signature []byte) {
+	t.Helper()
+	clientDataJSON = a.clientData("webauthn.get", challenge)
+	authData = a.authData(false)
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte(nil), authData...), clientDataHash[:]...)
+	if a.alg == COSEAlgEdDSA {
+		return clientDataJSON, authData, ed25519.Sign(a.edKey, signed)
+	}
+	digest := sha256.Sum256(signed)
+	signature, err := ecdsa.SignASN1(rand.Reader, a.ecKey, digest[:])
+	if err != nil {
+		t.Fatalf("failed to sign assertion: %v", err)
+	}
+	return clientDataJSON, authData, signature
+}
+
+func TestWebAuthnRegistrationAndAssertion(t *testing.T) {
+	for name, alg := range map[string]int64{"ES256": COSEAlgES256, "EdDSA": COSEAlgEdDSA} {
+		t.Run(name, func(t *testing.T) {
+			authenticator := newSoftAuthenticator(t, alg)
+
+			challenge, err := MakeWebAuthnChallenge()
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientDataJSON, attestationObject := authenticator.register(challenge)
+			credential, err := testWebAuthn.VerifyRegistration(challenge, clientDataJSON, attestationObject)
+			if err != nil {
+				t.Fatalf("VerifyRegistration() error = %v", err)
+			}
+			if !bytes.Equal(credential.ID, authenticator.credentialID) {
+				t.Errorf("credential id = %q, want %q", credential.ID, authenticator.credentialID)
+			}
+
+			for i := 1; i <= 2; i++ {
+				challenge, err := MakeWebAuthnChallenge()
+				if err != nil {
+					t.Fatal(err)
+				}
+				authenticator.signCount++
+				clientDataJSON, authData, signature := authenticator.assert(t, challenge)
+				signCount, err := testWebAuthn.VerifyAssertion(challenge, credential.PublicKey, credential.SignCount, clientDataJSON, authData, signature)
+				if err != nil {
+					t.Fatalf("VerifyAssertion() #%d error = %v", i, err)
+				}
+				if signCount != uint32(i) {
+					t.Errorf("sign count = %d, want %d", signCount, i)
+				}
+				credential.SignCount = signCount
+			}
+		})
+	}
+}
+
+func TestWebAuthnRegistrationRejects(t *testing.T) {
+	const challenge = "registration-challenge"
+
+	tests := []struct {
+		name   string
+		modify func(a *softAuthenticator)
+		// the challenge the server expects
+		challenge string
+	}{
+		{
+			name:      "wrong rp id hash",
+			modify:    func(a *softAuthenticator) { a.rpID = "evil.example" },
+			challenge: challenge,
+		},
+		{
+			name:      "wrong origin",
+			modify:    func(a *softAuthenticator) { a.origin = "https://evil.example" },
+			challenge: challenge,
+		},
+		{
+			name:      "wrong challenge",
+			modify:    func(a *softAuthenticator) {},
+			challenge: "another-challenge",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authenticator := newSoftAuthenticator(t, COSEAlgES256)
+			tt.modify(authenticator)
+			clientDataJSON, attestationObject := authenticator.register(challenge)
+			_, err := testWebAuthn.VerifyRegistration(tt.challenge, clientDataJSON, attestationObject)
+			if err == nil {
+				t.Fatal("VerifyRegistration() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestWebAuthnAssertionRejects(t *testing.T) {
+	const challenge = "assertion-challenge"
+
+	tests := []struct {
+		name string
+		// modify changes the authenticator before the assertion, tamper the
+		// assertion itself
+		modify          func(a *softAuthenticator)
+		tamper          func(clientDataJSON, authData, signature []byte) ([]byte, []byte, []byte)
+		challenge       string
+		storedSignCount uint32
+	}{
+		{
+			name: "bad signature",
+			tamper: func(clientDataJSON, authData, signature []byte) ([]byte, []byte, []byte) {
+				signature[len(signature)-1] ^= 0xff
+				return clientDataJSON, authData, signature
+			},
+			challenge: challenge,
+		},
+		{
+			name: "tampered authenticator data",
+			tamper: func(clientDataJSON, authData, signature []byte) ([]byte, []byte, []byte) {
+				authData[36]++
+				return clientDataJSON, authData, signature
+			},
+			challenge: challenge,
+		},
+		{
+			name:      "wrong rp id hash",
+			modify:    func(a *softAuthenticator) { a.rpID = "evil.example" },
+			challenge: challenge,
+		},
+		{
+			name:      "wrong origin",
+			modify:    func(a *softAuthenticator) { a.origin = "https://evil.example" },
+			challenge: challenge,
+		},
+		{
+			name:      "wrong challenge",
+			challenge: "another-challenge",
+		},
+		{
+			name: "registration client data",
+			tamper: func(clientDataJSON, authData, signature []byte) ([]byte, []byte, []byte) {
+				return bytes.Replace(clientDataJSON, []byte("webauthn.get"), []byte("webauthn.create"), 1), authData, signature
+			},
+			challenge: challenge,
+		},
+		{
+			name:            "sign count regression",
+			challenge:       challenge,
+			storedSignCount: 5,
+		},
+		{
+			name:            "sign count replay",
+			challenge:       challenge,
+			storedSignCount: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authenticator := newSoftAuthenticator(t, COSEAlgES256)
+			publicKey := authenticator.coseKey()
+			if tt.modify != nil {
+				tt.modify(authenticator)
+			}
+
+			authenticator.signCount = 1
+			clientDataJSON, authData, signature := authenticator.assert(t, challenge)
+			if tt.tamper != nil {
+				clientDataJSON, authData, signature = tt.tamper(clientDataJSON, authData, signature)
+			}
+
+			_, err := testWebAuthn.VerifyAssertion(tt.challenge, publicKey, tt.storedSignCount, clientDataJSON, authData, signature)
+			if err == nil {
+				t.Fatal("VerifyAssertion() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestWebAuthnAssertionWithoutCounter(t *testing.T) {
+	authenticator := newSoftAuthenticator(t, COSEAlgEdDSA)
+	publicKey := authenticator.coseKey()
+
+	// authenticators without a counter always report zero
+	for i := 0; i < 2; i++ {
+		clientDataJSON, authData, signature := authenticator.assert(t, "challenge")
+		signCount, err := testWebAuthn.VerifyAssertion("challenge", publicKey, 0, clientDataJSON, authData, signature)
+		if err != nil {
+			t.Fatalf("VerifyAssertion() error = %v", err)
+		}
+		if signCount != 0 {
+			t.Errorf("sign count = %d, want 0", signCount)
+		}
+	}
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    any
+		wantErr bool
+	}{
+		{name: "small int", data: []byte{0x17}, want: int64(23)},
+		{name: "uint8", data: []byte{0x18, 0xff}, want: int64(255)},
+		{name: "negative int", data: []byte{0x26}, want: int64(-7)},
+		{name: "negative uint16", data: []byte{0x39, 0x01, 0x00}, want: int64(-257)},
+		{name: "text", data: []byte{0x63, 'f', 'm', 't'}, want: "fmt"},
+		{name: "true", data: []byte{0xf5}, want: true},
+		{name: "null", data: []byte{0xf6}, want: nil},
+		{name: "empty", data: []byte{}, wantErr: true},
+		{name: "truncated uint16", data: []byte{0x19, 0x01}, wantErr: true},
+		{name: "string exceeds data", data: []byte{0x45, 0x01}, wantErr: true},
+		{name: "huge string length", data: []byte{0x5b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, wantErr: true},
+		{name: "huge array length", data: []byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, wantErr: true},
+		{name: "integer overflow", data: []byte{0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, wantErr: true},
+		{name: "indefinite length", data: []byte{0x5f}, wantErr: true},
+		{name: "byte string map key", data: []byte{0xa1, 0x41, 0x00, 0x00}, wantErr: true},
+		{name: "float", data: []byte{0xf9, 0x3c, 0x00}, wantErr: true},
+		{name: "tag", data: []byte{0xc0, 0x00}, wantErr: true},
+		{name: "nesting too deep", data: bytes.Repeat([]byte{0x81}, maxCBORDepth+2), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, n, err := decodeCBOR(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("decodeCBOR() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeCBOR() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("decodeCBOR() = %#v, want %#v", got, tt.want)
+			}
+			if n != len(tt.data) {
+				t.Errorf("decodeCBOR() read %d bytes, want %d", n, len(tt.data))
+			}
+		})
+	}
+}
+
+func FuzzDecodeCBOR(f *testing.F) {
+	f.Add(encodeTestCBOR(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": []byte{0x01, 0x02, 0x03},
+	}))
+	f.Add(encodeTestCBOR(map[int64]any{1: int64(2), 3: int64(-7), -1: int64(1), -2: make([]byte, 32), -3: make([]byte, 32)}))
+	f.Add([]byte{0x82, 0xf5, 0xf4})
+	f.Add([]byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, n, err := decodeCBOR(data)
+		if err != nil {
+			return
+		}
+		if n <= 0 || n > len(data) {
+			t.Fatalf("decodeCBOR() read %d bytes of %d", n, len(data))
+		}
+		// whatever decodes must not crash the key parser either
+		ParseCOSEKey(data)
+	})
+}
+
+// encodeTestCBOR encodes the values the tests need: integers, strings, byte
+// strings and maps with sorted keys.
+func encodeTestCBOR(value any) []byte {
+	switch v := value.(type) {
+	case int64:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v))
+		}
+		return cborHead(0, uint64(v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case map[int64]any:
+		keys := make([]int64, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+		data := cborHead(5, uint64(len(v)))
+		for _, key := range keys {
+			data = append(data, encodeTestCBOR(key)...)
+			data = append(data, encodeTestCBOR(v[key])...)
+		}
+		return data
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		data := cborHead(5, uint64(len(v)))
+		for _, key := range keys {
+			data = append(data, encodeTestCBOR(key)...)
+			data = append(data, encodeTestCBOR(v[key])...)
+		}
+		return data
+	}
+	panic("encodeTestCBOR: unsupported type")
+}
+
+func cborHead(major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return []byte{major<<5 | byte(arg)}
+	case arg <= math.MaxUint8:
+		return []byte{major<<5 | 24, byte(arg)}
+	case arg <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(arg))
+	case arg <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(arg))
+	}
+	return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, arg)
+}
@@ -7,10 +7,29 @@ package database
 
 import (
 	"context"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+const countChirpsSince = `-- name: CountChirpsSince :one
+SELECT COUNT(*) FROM chirps
+WHERE user_id = $1
+AND created_at > $2
+`
+
+type CountChirpsSinceParams struct {
+	UserID    uuid.UUID
+	CreatedAt time.Time
+}
+
+func (q *Queries) CountChirpsSince(ctx context.Context, arg CountChirpsSinceParams) (int64, error) {
+	row := q.db.QueryRowContext(ctx, countChirpsSince, arg.UserID, arg.CreatedAt)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
 const createChirp = `-- name: CreateChirp :one
 INSERT INTO chirps(id, created_at, updated_at, body, user_id)
 VALUES(
@@ -137,3 +156,29 @@ func (q *Queries) GetChirpsFromAuthor(ctx context.Context, userID uuid.UUID) ([]
 	}
 	return items, nil
 }
+
+const updateChirpBody = `-- name: UpdateChirpBody :one
+UPDATE chirps
+SET body = $2,
+updated_at = NOW()
+WHERE id = $1
+RETURNING id, created_at, updated_at, body, user_id
+`
+
+type UpdateChirpBodyParams struct {
+	ID   uuid.UUID
+	Body string
+}
+
+func (q *Queries) UpdateChirpBody(ctx context.Context, arg UpdateChirpBodyParams) (Chirp, error) {
+	row := q.db.QueryRowContext(ctx, updateChirpBody, arg.ID, arg.Body)
+	var i Chirp
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Body,
+		&i.UserID,
+	)
+	return i, err
+}
@@ -11,6 +11,18 @@ import (
 	"github.com/google/uuid"
 )
 
+type AccountDeletion struct {
+	UserID      uuid.UUID
+	RequestedAt time.Time
+	PurgeAfter  time.Time
+}
+
+type Block struct {
+	BlockerID uuid.UUID
+	BlockedID uuid.UUID
+	CreatedAt time.Time
+}
+
 type Chirp struct {
 	ID        uuid.UUID
 	CreatedAt time.Time
@@ -19,6 +31,144 @@ type Chirp struct {
 	UserID    uuid.UUID
 }
 
+type Conversation struct {
+	ID              uuid.UUID
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+	ProfanityFilter bool
+	LastMessageAt   sql.NullTime
+}
+
+type ConversationParticipant struct {
+	ConversationID uuid.UUID
+	UserID         uuid.UUID
+	JoinedAt       time.Time
+	LastReadAt     sql.NullTime
+	Muted          bool
+}
+
+type DataExport struct {
+	ID          uuid.UUID
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	UserID      uuid.UUID
+	IncludeHtml bool
+	Status      string
+	Archive     []byte
+	ExpiresAt   time.Time
+}
+
+type EmailChange struct {
+	UserID    uuid.UUID
+	CreatedAt time.Time
+	NewEmail  string
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+type LoginChallenge struct {
+	Token     string
+	CreatedAt time.Time
+	UserID    uuid.UUID
+	ExpiresAt time.Time
+	Attempts  int32
+}
+
+type LoginFailure struct {
+	Key            string
+	FailedAttempts int32
+	LastFailedAt   time.Time
+	LockedUntil    sql.NullTime
+}
+
+type Message struct {
+	ID             uuid.UUID
+	CreatedAt      time.Time
+	ConversationID uuid.UUID
+	SenderID       uuid.UUID
+	Body           string
+}
+
+type Notification struct {
+	ID             uuid.UUID
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	UserID         uuid.UUID
+	Type           string
+	GroupKey       string
+	ChirpID        uuid.NullUUID
+	ActorIds       []uuid.UUID
+	ActorCount     int32
+	ReadAt         sql.NullTime
+	ConversationID uuid.NullUUID
+}
+
+type OidcLoginState struct {
+	State        string
+	CreatedAt    time.Time
+	Nonce        string
+	CodeVerifier string
+	ExpiresAt    time.Time
+	UserID       uuid.NullUUID
+}
+
+type OidcPendingLink struct {
+	TokenHash string
+	CreatedAt time.Time
+	UserID    uuid.UUID
+	Issuer    string
+	Subject   string
+	Email     string
+	ExpiresAt time.Time
+}
+
+type OutboxEvent struct {
+	ID            int64
+	CreatedAt     time.Time
+	EventType     string
+	UserID        uuid.UUID
+	Payload       string
+	Status        string
+	Attempts      int32
+	NextAttemptAt time.Time
+	DispatchedAt  sql.NullTime
+	LastError     sql.NullString
+	DispatchSeq   sql.NullInt64
+}
+
+type PersonalAccessToken struct {
+	ID         uuid.UUID
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	UserID     uuid.UUID
+	Name       string
+	TokenHash  string
+	Scopes     []string
+	ExpiresAt  sql.NullTime
+	LastUsedAt sql.NullTime
+	RevokedAt  sql.NullTime
+}
+
+type PolkaEvent struct {
+	ID            string
+	Event         string
+	ReceivedAt    time.Time
+	Payload       sql.NullString
+	Status        string
+	Attempts      int32
+	NextAttemptAt time.Time
+	ProcessedAt   sql.NullTime
+	LastError     sql.NullString
+}
+
+type RecoveryCode struct {
+	ID        uuid.UUID
+	CreatedAt time.Time
+	UserID    uuid.UUID
+	CodeHash  string
+	UsedAt    sql.NullTime
+}
+
 type RefreshToken struct {
 	Token     string
 	CreatedAt time.Time
@@ -28,6 +178,34 @@ type RefreshToken struct {
 	RevokedAt sql.NullTime
 }
 
+type RevokedAccessToken struct {
+	Jti       string
+	RevokedAt time.Time
+	ExpiresAt time.Time
+}
+
+type Subscription struct {
+	UserID             uuid.UUID
+	CreatedAt          time.Time
+	UpdatedAt          time.Time
+	Plan               string
+	Status             string
+	CurrentPeriodStart time.Time
+	CurrentPeriodEnd   time.Time
+}
+
+type SubscriptionHistory struct {
+	ID                 uuid.UUID
+	CreatedAt          time.Time
+	UserID             uuid.UUID
+	Event              string
+	PolkaEventID       string
+	Plan               string
+	Status             string
+	CurrentPeriodStart time.Time
+	CurrentPeriodEnd   time.Time
+}
+
 type User struct {
 	ID             uuid.UUID
 	CreatedAt      time.Time
@@ -36,3 +214,75 @@ type User struct {
 	HashedPassword string
 	IsChirpyRed    bool
 }
+
+type UserIdentity struct {
+	ID        uuid.UUID
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	UserID    uuid.UUID
+	Issuer    string
+	Subject   string
+	Email     string
+}
+
+type UserRole struct {
+	UserID    uuid.UUID
+	Role      string
+	CreatedAt time.Time
+}
+
+type UserTotp struct {
+	UserID       uuid.UUID
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	Secret       string
+	EnabledAt    sql.NullTime
+	LastUsedStep int64
+}
+
+type WebauthnChallenge struct {
+	Challenge string
+	CreatedAt time.Time
+	UserID    uuid.NullUUID
+	Ceremony  string
+	ExpiresAt time.Time
+}
+
+type WebauthnCredential struct {
+	ID         string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	UserID     uuid.UUID
+	Name       string
+	PublicKey  []byte
+	SignCount  int64
+	LastUsedAt sql.NullTime
+}
+
+type WebhookDelivery struct {
+	ID             uuid.UUID
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	EndpointID     uuid.UUID
+	Event          string
+	Payload        string
+	Status         string
+	Attempts       int32
+	NextAttemptAt  time.Time
+	LastAttemptAt  sql.NullTime
+	ResponseStatus sql.NullInt32
+	LastError      sql.NullString
+}
+
+type WebhookEndpoint struct {
+	ID                  uuid.UUID
+	CreatedAt           time.Time
+	UpdatedAt           time.Time
+	UserID              uuid.UUID
+	Url                 string
+	Secret              string
+	Events              []string
+	Enabled             bool
+	ConsecutiveFailures int32
+	DisabledAt          sql.NullTime
+}
@@ -42,6 +42,31 @@ func (q *Queries) CreateUser(ctx context.Context, arg CreateUserParams) (User, e
 	return i, err
 }
 
+const createUserWithoutPassword = `-- name: CreateUserWithoutPassword :one
+INSERT INTO users (id, created_at, updated_at, email)
+VALUES (
+    gen_random_uuid(),
+    NOW(),
+    NOW(),
+    $1
+)
+RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red
+`
+
+func (q *Queries) CreateUserWithoutPassword(ctx context.Context, email string) (User, error) {
+	row := q.db.QueryRowContext(ctx, createUserWithoutPassword, email)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Email,
+		&i.HashedPassword,
+		&i.IsChirpyRed,
+	)
+	return i, err
+}
+
 const deleteUsers = `-- name: DeleteUsers :exec
 DELETE FROM users
 `
@@ -89,34 +114,62 @@ func (q *Queries) LookUpByID(ctx context.Context, id uuid.UUID) (User, error) {
 	return i, err
 }
 
-const makeChirpyRed = `-- name: MakeChirpyRed :exec
+const updatePasswordHash = `-- name: UpdatePasswordHash :exec
 UPDATE users
-SET is_chirpy_red = TRUE,
-updated_at = NOW()
+SET hashed_password = $2
 WHERE id = $1
-AND is_chirpy_red = FALSE
 `
 
-func (q *Queries) MakeChirpyRed(ctx context.Context, id uuid.UUID) error {
-	_, err := q.db.ExecContext(ctx, makeChirpyRed, id)
+type UpdatePasswordHashParams struct {
+	ID             uuid.UUID
+	HashedPassword string
+}
+
+func (q *Queries) UpdatePasswordHash(ctx context.Context, arg UpdatePasswordHashParams) error {
+	_, err := q.db.ExecContext(ctx, updatePasswordHash, arg.ID, arg.HashedPassword)
 	return err
 }
 
-const updateUserData = `-- name: UpdateUserData :exec
+const updateUserEmail = `-- name: UpdateUserEmail :one
 UPDATE users
 SET email = $2,
-hashed_password = $3,
 updated_at = NOW()
 WHERE id = $1
+RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red
 `
 
-type UpdateUserDataParams struct {
+type UpdateUserEmailParams struct {
+	ID    uuid.UUID
+	Email string
+}
+
+func (q *Queries) UpdateUserEmail(ctx context.Context, arg UpdateUserEmailParams) (User, error) {
+	row := q.db.QueryRowContext(ctx, updateUserEmail, arg.ID, arg.Email)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Email,
+		&i.HashedPassword,
+		&i.IsChirpyRed,
+	)
+	return i, err
+}
+
+const updateUserPassword = `-- name: UpdateUserPassword :exec
+UPDATE users
+SET hashed_password = $2,
+updated_at = NOW()
+WHERE id = $1
+`
+
+type UpdateUserPasswordParams struct {
 	ID             uuid.UUID
-	Email          string
 	HashedPassword string
 }
 
-func (q *Queries) UpdateUserData(ctx context.Context, arg UpdateUserDataParams) error {
-	_, err := q.db.ExecContext(ctx, updateUserData, arg.ID, arg.Email, arg.HashedPassword)
+func (q *Queries) UpdateUserPassword(ctx context.Context, arg UpdateUserPasswordParams) error {
+	_, err := q.db.ExecContext(ctx, updateUserPassword, arg.ID, arg.HashedPassword)
 	return err
 }
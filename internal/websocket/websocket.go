@@ -0,0 +1,348 @@
+// Package websocket implements the server side of the WebSocket protocol
+// (RFC 6455), as far as Chirpy needs it: no extensions and no
+// subprotocols.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Message types, the frame opcodes from RFC 6455 section 5.2
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+	CloseMessage  = 8
+	PingMessage   = 9
+	PongMessage   = 10
+
+	continuationFrame = 0
+)
+
+// Close codes from RFC 6455 section 7.4.1. Codes 4000 to 4999 are free for
+// applications.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+	CloseTryAgainLater   = 1013
+)
+
+const (
+	acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	// control frames can't be longer (RFC 6455 section 5.5)
+	maxControlPayload = 125
+
+	DefaultMaxMessageSize = 64 << 10
+)
+
+var (
+	ErrBadHandshake   = errors.New("websocket: bad handshake")
+	ErrProtocol       = errors.New("websocket: protocol error")
+	ErrMessageTooBig  = errors.New("websocket: message too big")
+	ErrInvalidPayload = errors.New("websocket: invalid utf-8 in text message")
+	ErrClosed         = errors.New("websocket: connection closed")
+)
+
+// CloseError is returned by ReadMessage when the peer closed the
+// connection.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: closed with code %d %s", e.Code, e.Reason)
+}
+
+// Conn is a WebSocket connection. ReadMessage must only be called from one
+// goroutine; writes can happen from any goroutine.
+type Conn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	// MaxMessageSize limits the size of a message after reassembling its
+	// fragments.
+	MaxMessageSize int64
+	// WriteTimeout limits how long a write may block, zero means no limit.
+	// It also applies to the pongs and close frames sent by ReadMessage.
+	WriteTimeout time.Duration
+
+	writeMu   sync.Mutex
+	closeSent bool
+	onPong    func(data []byte)
+}
+
+// Upgrade performs the opening handshake (RFC 6455 section 4.2) and takes
+// over the connection. If the request isn't a valid WebSocket handshake it
+// responds with an error and returns ErrBadHandshake.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet ||
+		!headerContainsToken(r.Header, "Connection", "upgrade") ||
+		!headerContainsToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket upgrade required", http.StatusUpgradeRequired)
+		return nil, ErrBadHandshake
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, ErrBadHandshake
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(w, "invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+
+	netConn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "websocket upgrade not supported", http.StatusInternalServerError)
+		return nil, err
+	}
+	// the server's read and write timeouts don't apply to the upgraded
+	// connection, the caller sets its own deadlines
+	netConn.SetDeadline(time.Time{})
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	_, err = netConn.Write([]byte(response))
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	return &Conn{
+		conn:           netConn,
+		br:             brw.Reader,
+		MaxMessageSize: DefaultMaxMessageSize,
+	}, nil
+}
+
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetPongHandler sets a function that is called from ReadMessage for every
+// pong the peer sends.
+func (c *Conn) SetPongHandler(handler func(data []byte)) {
+	c.onPong = handler
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// ReadMessage returns the next text or binary message. Pings are answered
+// and pongs are passed to the pong handler while waiting for it. When the
+// peer closes the connection, the close is confirmed and a *CloseError is
+// returned.
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	messageType := 0
+	message := []byte{}
+
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			if errors.Is(err, ErrProtocol) {
+				c.WriteClose(CloseProtocolError, "")
+			}
+			return 0, nil, err
+		}
+
+		switch opcode {
+		case PingMessage:
+			err = c.WriteMessage(PongMessage, payload)
+			if err != nil {
+				return 0, nil, err
+			}
+			continue
+		case PongMessage:
+			if c.onPong != nil {
+				c.onPong(payload)
+			}
+			continue
+		case CloseMessage:
+			// echo the status code, a close without one is answered
+			// without one (RFC 6455 section 5.5.1)
+			closeErr := &CloseError{Code: CloseNoStatus}
+			if len(payload) >= 2 {
+				closeErr.Code = int(binary.BigEndian.Uint16(payload))
+				closeErr.Reason = string(payload[2:])
+				c.WriteMessage(CloseMessage, payload[:2])
+			} else {
+				c.WriteMessage(CloseMessage, nil)
+			}
+			return 0, nil, closeErr
+		case TextMessage, BinaryMessage:
+			if messageType != 0 {
+				c.WriteClose(CloseProtocolError, "expected continuation frame")
+				return 0, nil, ErrProtocol
+			}
+			messageType = opcode
+		case continuationFrame:
+			if messageType == 0 {
+				c.WriteClose(CloseProtocolError, "unexpected continuation frame")
+				return 0, nil, ErrProtocol
+			}
+		default:
+			c.WriteClose(CloseProtocolError, "unknown opcode")
+			return 0, nil, ErrProtocol
+		}
+
+		if int64(len(message)+len(payload)) > c.MaxMessageSize {
+			c.WriteClose(CloseMessageTooBig, "")
+			return 0, nil, ErrMessageTooBig
+		}
+		message = append(message, payload...)
+
+		if fin {
+			if messageType == TextMessage && !utf8.Valid(message) {
+				c.WriteClose(CloseInvalidPayload, "")
+				return 0, nil, ErrInvalidPayload
+			}
+			return messageType, message, nil
+		}
+	}
+}
+
+// readFrame reads a single frame and unmasks its payload. Clients must mask
+// every frame (RFC 6455 section 5.1).
+func (c *Conn) readFrame() (bool, int, []byte, error) {
+	var header [2]byte
+	_, err := io.ReadFull(c.br, header[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	rsv := header[0] & 0x70
+	opcode := int(header[0] & 0x0f)
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+
+	if rsv != 0 || !masked {
+		return false, 0, nil, ErrProtocol
+	}
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if opcode >= CloseMessage && (!fin || length > maxControlPayload) {
+		return false, 0, nil, ErrProtocol
+	}
+	if length > uint64(c.MaxMessageSize) {
+		c.WriteClose(CloseMessageTooBig, "")
+		return false, 0, nil, ErrMessageTooBig
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// WriteMessage sends data as a single unmasked frame.
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	if messageType >= CloseMessage && len(data) > maxControlPayload {
+		return ErrProtocol
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	if messageType == CloseMessage {
+		c.closeSent = true
+	}
+
+	frame := make([]byte, 0, len(data)+10)
+	frame = append(frame, 0x80|byte(messageType))
+	switch {
+	case len(data) <= 125:
+		frame = append(frame, byte(len(data)))
+	case len(data) <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(data)))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(data)))
+	}
+	frame = append(frame, data...)
+
+	if c.WriteTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// WriteClose starts the closing handshake. Later writes fail with
+// ErrClosed.
+func (c *Conn) WriteClose(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > maxControlPayload {
+		payload = payload[:maxControlPayload]
+	}
+	return c.WriteMessage(CloseMessage, payload)
+}
+
+// Close closes the underlying connection without a closing handshake.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
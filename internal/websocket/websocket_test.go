@@ -0,0 +1,531 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testFrame is a frame the server sent to the test client.
+type testFrame struct {
+	fin     bool
+	opcode  int
+	payload []byte
+}
+
+// testClient is the client end of a net.Pipe. Frames from the server are
+// collected in the background, since writes on a pipe block until the
+// other end reads them.
+type testClient struct {
+	conn   net.Conn
+	frames chan testFrame
+}
+
+func newTestConn(t *testing.T) (*Conn, *testClient) {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+
+	c := &Conn{
+		conn:           server,
+		br:             bufio.NewReader(server),
+		MaxMessageSize: DefaultMaxMessageSize,
+	}
+	tc := &testClient{
+		conn:   client,
+		frames: make(chan testFrame, 16),
+	}
+	go tc.readFrames(t)
+	return c, tc
+}
+
+func (tc *testClient) readFrames(t *testing.T) {
+	defer close(tc.frames)
+	r := bufio.NewReader(tc.conn)
+	for {
+		var header [2]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return
+		}
+		if header[1]&0x80 != 0 {
+			t.Errorf("server sent a masked frame")
+			return
+		}
+
+		length := uint64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(r, ext[:]); err != nil {
+				return
+			}
+			length = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(r, ext[:]); err != nil {
+				return
+			}
+			length = binary.BigEndian.Uint64(ext[:])
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return
+		}
+		tc.frames <- testFrame{
+			fin:     header[0]&0x80 != 0,
+			opcode:  int(header[0] & 0x0f),
+			payload: payload,
+		}
+	}
+}
+
+// send writes raw frames without waiting for the server to read them.
+func (tc *testClient) send(frames ...[]byte) {
+	go func() {
+		for _, frame := range frames {
+			if _, err := tc.conn.Write(frame); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func (tc *testClient) expectFrame(t *testing.T) testFrame {
+	t.Helper()
+	select {
+	case frame, ok := <-tc.frames:
+		if !ok {
+			t.Fatal("connection closed before the expected frame")
+		}
+		return frame
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a frame")
+	}
+	return testFrame{}
+}
+
+func (tc *testClient) expectClose(t *testing.T, code int) {
+	t.Helper()
+	frame := tc.expectFrame(t)
+	if frame.opcode != CloseMessage {
+		t.Fatalf("opcode = %d, want a close frame", frame.opcode)
+	}
+	if len(frame.payload) < 2 {
+		t.Fatalf("close frame without status code")
+	}
+	if got := int(binary.BigEndian.Uint16(frame.payload)); got != code {
+		t.Errorf("close code = %d, want %d", got, code)
+	}
+}
+
+var testMask = [4]byte{0x37, 0xfa, 0x21, 0x3d}
+
+// clientFrame builds a masked frame like a browser would send it.
+func clientFrame(fin bool, opcode int, payload []byte) []byte {
+	frame := []byte{byte(opcode)}
+	if fin {
+		frame[0] |= 0x80
+	}
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, 0x80|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	frame = append(frame, testMask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^testMask[i%4])
+	}
+	return frame
+}
+
+func closePayload(code int, reason string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...)
+}
+
+func TestReadMessage(t *testing.T) {
+	tests := []struct {
+		name        string
+		messageType int
+		payload     []byte
+	}{
+		{name: "text", messageType: TextMessage, payload: []byte(`{"type":"subscribe"}`)},
+		{name: "empty", messageType: TextMessage, payload: []byte{}},
+		{name: "16-bit length", messageType: BinaryMessage, payload: bytes.Repeat([]byte{0xab}, 1000)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, client := newTestConn(t)
+			client.send(clientFrame(true, tt.messageType, tt.payload))
+
+			messageType, message, err := c.ReadMessage()
+			if err != nil {
+				t.Fatalf("ReadMessage() error = %v", err)
+			}
+			if messageType != tt.messageType || !bytes.Equal(message, tt.payload) {
+				t.Errorf("ReadMessage() = %d %q, want %d %q", messageType, message, tt.messageType, tt.payload)
+			}
+		})
+	}
+}
+
+func TestReadMessageUnmasksWith64BitLength(t *testing.T) {
+	c, client := newTestConn(t)
+
+	// a short payload with the 64-bit length form is still a valid frame
+	payload := []byte("hello")
+	frame := []byte{0x80 | TextMessage, 0x80 | 127}
+	frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	frame = append(frame, testMask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^testMask[i%4])
+	}
+	client.send(frame)
+
+	_, message, err := c.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	if string(message) != "hello" {
+		t.Errorf("ReadMessage() = %q, want %q", message, "hello")
+	}
+}
+
+func TestReadMessageRejectsUnmaskedFrame(t *testing.T) {
+	c, client := newTestConn(t)
+	client.send([]byte{0x80 | TextMessage, 5, 'h', 'e', 'l', 'l', 'o'})
+
+	_, _, err := c.ReadMessage()
+	if !errors.Is(err, ErrProtocol) {
+		t.Fatalf("ReadMessage() error = %v, want %v", err, ErrProtocol)
+	}
+	client.expectClose(t, CloseProtocolError)
+}
+
+func TestReadMessageReassemblesFragments(t *testing.T) {
+	c, client := newTestConn(t)
+	pongs := make(chan []byte, 1)
+	c.SetPongHandler(func(data []byte) { pongs <- data })
+
+	// control frames may arrive between the fragments of a message
+	client.send(
+		clientFrame(false, TextMessage, []byte("Hel")),
+		clientFrame(true, PingMessage, []byte("ping")),
+		clientFrame(false, continuationFrame, []byte("lo, ")),
+		clientFrame(true, PongMessage, []byte("pong")),
+		clientFrame(true, continuationFrame, []byte("world")),
+	)
+
+	messageType, message, err := c.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	if messageType != TextMessage || string(message) != "Hello, world" {
+		t.Errorf("ReadMessage() = %d %q, want a text message %q", messageType, message, "Hello, world")
+	}
+
+	frame := client.expectFrame(t)
+	if frame.opcode != PongMessage || string(frame.payload) != "ping" {
+		t.Errorf("reply to ping = %d %q, want a pong %q", frame.opcode, frame.payload, "ping")
+	}
+	select {
+	case data := <-pongs:
+		if string(data) != "pong" {
+			t.Errorf("pong handler got %q, want %q", data, "pong")
+		}
+	default:
+		t.Error("pong handler was not called")
+	}
+}
+
+func TestReadMessageProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames [][]byte
+	}{
+		{
+			name:   "fragmented ping",
+			frames: [][]byte{clientFrame(false, PingMessage, []byte("ping"))},
+		},
+		{
+			name:   "fragmented close",
+			frames: [][]byte{clientFrame(false, CloseMessage, closePayload(CloseNormal, ""))},
+		},
+		{
+			name:   "control frame too long",
+			frames: [][]byte{clientFrame(true, PingMessage, bytes.Repeat([]byte{'a'}, maxControlPayload+1))},
+		},
+		{
+			name:   "continuation without message",
+			frames: [][]byte{clientFrame(true, continuationFrame, []byte("lo"))},
+		},
+		{
+			name: "new message inside fragments",
+			frames: [][]byte{
+				clientFrame(false, TextMessage, []byte("Hel")),
+				clientFrame(true, TextMessage, []byte("lo")),
+			},
+		},
+		{
+			name:   "reserved bits",
+			frames: [][]byte{append([]byte{0xc0 | TextMessage}, clientFrame(true, TextMessage, []byte("hi"))[1:]...)},
+		},
+		{
+			name:   "unknown opcode",
+			frames: [][]byte{clientFrame(true, 3, []byte("hi"))},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, client := newTestConn(t)
+			client.send(tt.frames...)
+
+			_, _, err := c.ReadMessage()
+			if !errors.Is(err, ErrProtocol) {
+				t.Fatalf("ReadMessage() error = %v, want %v", err, ErrProtocol)
+			}
+			client.expectClose(t, CloseProtocolError)
+		})
+	}
+}
+
+func TestReadMessageRejectsOversizeFrames(t *testing.T) {
+	for name, length := range map[string]uint64{
+		"over the limit": DefaultMaxMessageSize + 1,
+		"terabyte":       1 << 40,
+		// the most significant bit must be zero (RFC 6455 section 5.2)
+		"most significant bit set": 1 << 63,
+		"max uint64":               ^uint64(0),
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, client := newTestConn(t)
+
+			// only the header: the payload must not be read or allocated
+			frame := []byte{0x80 | BinaryMessage, 0x80 | 127}
+			frame = binary.BigEndian.AppendUint64(frame, length)
+			client.send(frame)
+
+			_, _, err := c.ReadMessage()
+			if !errors.Is(err, ErrMessageTooBig) {
+				t.Fatalf("ReadMessage() error = %v, want %v", err, ErrMessageTooBig)
+			}
+			client.expectClose(t, CloseMessageTooBig)
+		})
+	}
+}
+
+func TestReadMessageLimitsReassembledSize(t *testing.T) {
+	c, client := newTestConn(t)
+	c.MaxMessageSize = 10
+
+	client.send(
+		clientFrame(false, BinaryMessage, make([]byte, 6)),
+		clientFrame(true, continuationFrame, make([]byte, 6)),
+	)
+
+	_, _, err := c.ReadMessage()
+	if !errors.Is(err, ErrMessageTooBig) {
+		t.Fatalf("ReadMessage() error = %v, want %v", err, ErrMessageTooBig)
+	}
+	client.expectClose(t, CloseMessageTooBig)
+}
+
+func TestReadMessageRejectsInvalidUTF8(t *testing.T) {
+	c, client := newTestConn(t)
+	client.send(clientFrame(true, TextMessage, []byte{'h', 0xff, 'i'}))
+
+	_, _, err := c.ReadMessage()
+	if !errors.Is(err, ErrInvalidPayload) {
+		t.Fatalf("ReadMessage() error = %v, want %v", err, ErrInvalidPayload)
+	}
+	client.expectClose(t, CloseInvalidPayload)
+}
+
+func TestReadMessageEchoesClose(t *testing.T) {
+	tests := []struct {
+		name       string
+		payload    []byte
+		wantCode   int
+		wantReason string
+		wantEcho   []byte
+	}{
+		{
+			name:       "with status code",
+			payload:    closePayload(CloseGoingAway, "navigating away"),
+			wantCode:   CloseGoingAway,
+			wantReason: "navigating away",
+			wantEcho:   closePayload(CloseGoingAway, ""),
+		},
+		{
+			name:     "without status code",
+			payload:  nil,
+			wantCode: CloseNoStatus,
+			wantEcho: []byte{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, client := newTestConn(t)
+			client.send(clientFrame(true, CloseMessage, tt.payload))
+
+			_, _, err := c.ReadMessage()
+			closeErr := &CloseError{}
+			if !errors.As(err, &closeErr) {
+				t.Fatalf("ReadMessage() error = %v, want a *CloseError", err)
+			}
+			if closeErr.Code != tt.wantCode || closeErr.Reason != tt.wantReason {
+				t.Errorf("ReadMessage() error = %v, want code %d %q", closeErr, tt.wantCode, tt.wantReason)
+			}
+
+			frame := client.expectFrame(t)
+			if frame.opcode != CloseMessage || !bytes.Equal(frame.payload, tt.wantEcho) {
+				t.Errorf("echo = %d %v, want a close frame %v", frame.opcode, frame.payload, tt.wantEcho)
+			}
+
+			// the closing handshake is done, nothing may follow it
+			if err := c.WriteMessage(TextMessage, []byte("late")); !errors.Is(err, ErrClosed) {
+				t.Errorf("WriteMessage() after close error = %v, want %v", err, ErrClosed)
+			}
+		})
+	}
+}
+
+func TestWriteMessage(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 0xffff, 0x10000} {
+		c, client := newTestConn(t)
+		payload := bytes.Repeat([]byte{'x'}, size)
+
+		go c.WriteMessage(BinaryMessage, payload)
+
+		frame := client.expectFrame(t)
+		if !frame.fin || frame.opcode != BinaryMessage || !bytes.Equal(frame.payload, payload) {
+			t.Errorf("%d bytes: got frame fin=%v opcode=%d with %d bytes", size, frame.fin, frame.opcode, len(frame.payload))
+		}
+	}
+}
+
+func TestWriteCloseTruncatesReason(t *testing.T) {
+	c, client := newTestConn(t)
+
+	go c.WriteClose(ClosePolicyViolation, string(bytes.Repeat([]byte{'r'}, 200)))
+
+	frame := client.expectFrame(t)
+	if frame.opcode != CloseMessage || len(frame.payload) != maxControlPayload {
+		t.Errorf("got opcode %d with %d bytes, want a close frame with %d bytes", frame.opcode, len(frame.payload), maxControlPayload)
+	}
+	if err := c.WriteClose(CloseNormal, ""); !errors.Is(err, ErrClosed) {
+		t.Errorf("second WriteClose() error = %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	upgraded := make(chan *Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		upgraded <- c
+	}))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the example handshake from RFC 6455 section 1.3
+	_, err = conn.Write([]byte("GET /ws HTTP/1.1\r\n" +
+		"Host: " + server.Listener.Addr().String() + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusSwitchingProtocols)
+	}
+	if got := res.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Sec-WebSocket-Accept = %q", got)
+	}
+
+	select {
+	case c := <-upgraded:
+		c.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("Upgrade() did not return a connection")
+	}
+}
+
+func TestUpgradeRejectsBadHandshakes(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		header map[string]string
+	}{
+		{
+			name:   "not an upgrade",
+			method: http.MethodGet,
+			header: map[string]string{"Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ=="},
+		},
+		{
+			name:   "post",
+			method: http.MethodPost,
+			header: map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ=="},
+		},
+		{
+			name:   "old version",
+			method: http.MethodGet,
+			header: map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "8", "Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ=="},
+		},
+		{
+			name:   "short key",
+			method: http.MethodGet,
+			header: map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "c2hvcnQ="},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/ws", nil)
+			for name, value := range tt.header {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+
+			_, err := Upgrade(w, r)
+			if !errors.Is(err, ErrBadHandshake) {
+				t.Fatalf("Upgrade() error = %v, want %v", err, ErrBadHandshake)
+			}
+			if w.Code < 400 {
+				t.Errorf("status = %d, want an error status", w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,8 @@
+package main
+
+import "net/http"
+
+func (a *apiConfig) handlerJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, 200, a.tokens.Keys.JWKS())
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ehumba/chirpy-web-server/internal/auth"
+	"github.com/ehumba/chirpy-web-server/internal/database"
+	"github.com/google/uuid"
+)
+
+var (
+	accountLoginThrottle = auth.LoginThrottle{
+		FreeAttempts: 5,
+		BaseLockout:  30 * time.Second,
+		MaxLockout:   time.Hour,
+	}
+	// many users can share an address, so allow more failures per IP
+	ipLoginThrottle = auth.LoginThrottle{
+		FreeAttempts: 20,
+		BaseLockout:  30 * time.Second,
+		MaxLockout:   time.Hour,
+	}
+)
+
+// Failures are counted per email rather than per user ID, so unknown
+// emails are throttled exactly like existing accounts.
+func accountThrottleKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipThrottleKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// loginLockedUntil returns the latest lockout among the keys, or the zero
+// time if none of them is locked.
+func (a *apiConfig) loginLockedUntil(ctx context.Context, keys ...string) (time.Time, error) {
+	lockedUntil := time.Time{}
+	for _, key := range keys {
+		failure, err := a.dbQueries.GetLoginFailure(ctx, key)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return time.Time{}, err
+		}
+		if failure.LockedUntil.Valid && failure.LockedUntil.Time.After(lockedUntil) {
+			lockedUntil = failure.LockedUntil.Time
+		}
+	}
+	if lockedUntil.Before(time.Now()) {
+		return time.Time{}, nil
+	}
+	return lockedUntil, nil
+}
+
+func (a *apiConfig) recordLoginFailure(ctx context.Context, key string, throttle auth.LoginThrottle) error {
+	failure, err := a.dbQueries.RecordLoginFailure(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	lockout := throttle.LockoutFor(int(failure.FailedAttempts))
+	if lockout == 0 {
+		return nil
+	}
+
+	return a.dbQueries.LockLogin(ctx, database.LockLoginParams{
+		Key:         key,
+		LockedUntil: sql.NullTime{Time: time.Now().Add(lockout), Valid: true},
+	})
+}
+
+func respondWithLockout(w http.ResponseWriter, lockedUntil time.Time) {
+	retryAfter := int(time.Until(lockedUntil).Seconds()) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	respondWithError(w, 429, "too many failed login attempts, try again later")
+}
+
+func (a *apiConfig) handlerUnlockAccount(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid user ID format")
+		return
+	}
+
+	caller := principalFromContext(r.Context())
+	if !caller.HasRole(auth.RoleAdmin) {
+		respondWithError(w, 403, "you don't have access to this endpoint")
+		return
+	}
+
+	userDB, err := a.dbQueries.LookUpByID(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, 404, "user not found")
+		return
+	}
+
+	err = a.dbQueries.ClearLoginFailures(r.Context(), accountThrottleKey(userDB.Email))
+	if err != nil {
+		respondWithError(w, 500, "failed to unlock account")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,14 +1,21 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"database/sql"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"sync/atomic"
+	"time"
 
+	"github.com/ehumba/chirpy-web-server/internal/auth"
 	"github.com/ehumba/chirpy-web-server/internal/database"
+	"github.com/ehumba/chirpy-web-server/internal/mailer"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 )
@@ -25,7 +32,146 @@ func main() {
 	dbURL := os.Getenv("DB_URL")
 	platform := os.Getenv("PLATFORM")
 	secret := os.Getenv("SECRET")
-	polkaKey := os.Getenv("POLKA_KEY")
+	jwtKeysDir := os.Getenv("JWT_KEYS_DIR")
+	jwtSigningKeyID := os.Getenv("JWT_SIGNING_KEY_ID")
+	// several keys can be active while Polka rotates its signing secret
+	polkaKeys := []string{}
+	for _, key := range strings.Split(os.Getenv("POLKA_KEYS")+","+os.Getenv("POLKA_KEY"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			polkaKeys = append(polkaKeys, key)
+		}
+	}
+	cookieSessions := os.Getenv("AUTH_COOKIES") == "true"
+	cookieSecure := os.Getenv("AUTH_COOKIES_SECURE") != "false"
+
+	// without a configured key, download links stop working on restart
+	linkKey := []byte(os.Getenv("LINK_SIGNING_KEY"))
+	if len(linkKey) == 0 {
+		linkKey = make([]byte, 32)
+		if _, err := rand.Read(linkKey); err != nil {
+			fmt.Printf("could not generate link signing key: %v", err)
+			return
+		}
+	}
+
+	webAuthn := auth.WebAuthnConfig{
+		RPID:   os.Getenv("WEBAUTHN_RP_ID"),
+		RPName: "Chirpy",
+		Origin: os.Getenv("WEBAUTHN_ORIGIN"),
+	}
+	if webAuthn.RPID == "" {
+		webAuthn.RPID = "localhost"
+	}
+	if webAuthn.Origin == "" {
+		webAuthn.Origin = "http://localhost:8080"
+	}
+
+	// sign with the asymmetric keys if configured, otherwise the shared secret
+	jwtKeys := auth.NewHMACKeySet(secret)
+	if jwtKeysDir != "" {
+		// tokens signed with the shared secret before the switch are only
+		// accepted on request, until they have expired
+		legacySecret := ""
+		if os.Getenv("JWT_ACCEPT_LEGACY_HS256") == "true" {
+			legacySecret = secret
+		}
+		keys, err := auth.LoadKeySet(jwtKeysDir, jwtSigningKeyID, legacySecret)
+		if err != nil {
+			fmt.Printf("could not load signing keys: %v", err)
+			return
+		}
+		jwtKeys = keys
+	}
+
+	tokens := auth.TokenConfig{
+		Keys:            jwtKeys,
+		Issuer:          getEnvDefault("JWT_ISSUER", "chirpy"),
+		Audience:        strings.Split(getEnvDefault("JWT_AUDIENCE", "chirpy"), ","),
+		AccessTokenTTL:  time.Hour,
+		RefreshTokenTTL: 60 * 24 * time.Hour,
+		Leeway:          30 * time.Second,
+	}
+	for name, value := range map[string]*time.Duration{
+		"ACCESS_TOKEN_TTL":  &tokens.AccessTokenTTL,
+		"REFRESH_TOKEN_TTL": &tokens.RefreshTokenTTL,
+		"JWT_LEEWAY":        &tokens.Leeway,
+	} {
+		if os.Getenv(name) == "" {
+			continue
+		}
+		d, err := time.ParseDuration(os.Getenv(name))
+		if err != nil {
+			fmt.Printf("invalid %s: %v", name, err)
+			return
+		}
+		*value = d
+	}
+
+	var oidcProvider *auth.OIDCProvider
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		oidcProvider = auth.NewOIDCProvider(
+			issuer,
+			os.Getenv("OIDC_CLIENT_ID"),
+			os.Getenv("OIDC_CLIENT_SECRET"),
+			os.Getenv("OIDC_REDIRECT_URL"),
+		)
+	}
+
+	passwordPolicy := auth.DefaultPasswordPolicy()
+	if minLength := os.Getenv("PASSWORD_MIN_LENGTH"); minLength != "" {
+		n, err := strconv.Atoi(minLength)
+		if err != nil {
+			fmt.Printf("invalid PASSWORD_MIN_LENGTH: %v", err)
+			return
+		}
+		passwordPolicy.MinLength = n
+	}
+	passwordPolicy.RequireUppercase = os.Getenv("PASSWORD_REQUIRE_UPPERCASE") == "true"
+	passwordPolicy.RequireLowercase = os.Getenv("PASSWORD_REQUIRE_LOWERCASE") == "true"
+	passwordPolicy.RequireDigit = os.Getenv("PASSWORD_REQUIRE_DIGIT") == "true"
+	passwordPolicy.RequireSymbol = os.Getenv("PASSWORD_REQUIRE_SYMBOL") == "true"
+
+	passwordHasher := auth.NewPasswordHasher()
+	if algorithm := os.Getenv("PASSWORD_HASH_ALGORITHM"); algorithm != "" {
+		passwordHasher.Algorithm = algorithm
+	}
+	for name, value := range map[string]any{
+		"BCRYPT_COST":        &passwordHasher.BcryptCost,
+		"ARGON2_MEMORY_KIB":  &passwordHasher.Argon2.Memory,
+		"ARGON2_ITERATIONS":  &passwordHasher.Argon2.Iterations,
+		"ARGON2_PARALLELISM": &passwordHasher.Argon2.Parallelism,
+	} {
+		if os.Getenv(name) == "" {
+			continue
+		}
+		if _, err := fmt.Sscan(os.Getenv(name), value); err != nil {
+			fmt.Printf("invalid %s: %v", name, err)
+			return
+		}
+	}
+	if _, err := passwordHasher.Hash("configuration check"); err != nil {
+		fmt.Printf("invalid password hash configuration: %v", err)
+		return
+	}
+	if passwordHasher.Algorithm == auth.AlgorithmBcrypt {
+		passwordPolicy.MaxBytes = auth.MaxPasswordBytes
+	}
+
+	// without an SMTP server, emails are written to the log
+	var mail mailer.Mailer = mailer.LogMailer{}
+	if smtpAddr := os.Getenv("SMTP_ADDR"); smtpAddr != "" {
+		mail = mailer.SMTPMailer{
+			Addr:     smtpAddr,
+			From:     getEnvDefault("MAIL_FROM", "no-reply@localhost"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+		}
+	}
+
+	var breachedPasswords *auth.BreachedPasswordList
+	if dir := os.Getenv("BREACHED_PASSWORDS_DIR"); dir != "" {
+		breachedPasswords = &auth.BreachedPasswordList{Dir: dir}
+	}
 
 	db, err := sql.Open("postgres", dbURL)
 	dbQueries := database.New(db)
@@ -39,10 +185,22 @@ func main() {
 	handler := http.StripPrefix("/app", http.FileServer(http.Dir("app")))
 
 	apiCfg := apiConfig{
-		dbQueries: dbQueries,
-		platform:  platform,
-		secret:    secret,
-		polkaKey:  polkaKey,
+		db:                db,
+		dbQueries:         dbQueries,
+		platform:          platform,
+		tokens:            tokens,
+		polkaKeys:         polkaKeys,
+		webAuthn:          webAuthn,
+		oidc:              oidcProvider,
+		passwordPolicy:    passwordPolicy,
+		passwordHasher:    passwordHasher,
+		breachedPasswords: breachedPasswords,
+		cookieSessions:    cookieSessions,
+		cookieSecure:      cookieSecure,
+		linkKey:           linkKey,
+		mailer:            mail,
+		events:            newEventBus(),
+		streams:           newStreamHub(),
 	}
 
 	// Handle the root path
@@ -50,17 +208,23 @@ func main() {
 
 	mux.HandleFunc("GET /api/healthz", handlerEndpoint)
 
+	// Public keys for verifying access tokens
+	mux.HandleFunc("GET /.well-known/jwks.json", apiCfg.handlerJWKS)
+
 	// Counter endpoint
 	mux.HandleFunc("GET /admin/metrics", apiCfg.handlerCount)
 
 	// Reset endpoint
 	mux.HandleFunc("POST /admin/reset", apiCfg.handlerReset)
 
+	// Unlock an account after too many failed logins
+	mux.HandleFunc("POST /admin/users/{userID}/unlock", apiCfg.middlewareRequireAuth(apiCfg.handlerUnlockAccount))
+
 	// New user creation endpoint
 	mux.HandleFunc("POST /api/users", apiCfg.handlerCreateUser)
 
 	// Chirp creation endpoint
-	mux.HandleFunc("POST /api/chirps", apiCfg.handlerChirps)
+	mux.HandleFunc("POST /api/chirps", apiCfg.middlewareRequireAuth(apiCfg.handlerChirps))
 
 	// Get Chirps endpoint
 	mux.HandleFunc("GET /api/chirps", apiCfg.handlerGetChirps)
@@ -68,9 +232,43 @@ func main() {
 	// Get Chirp endpoint
 	mux.HandleFunc("GET /api/chirps/{chirpID}", apiCfg.handlerGetChirp)
 
+	// Stream of new and deleted chirps
+	mux.HandleFunc("GET /api/stream", apiCfg.handlerStream)
+
+	// WebSocket for live timelines, notifications and presence
+	mux.HandleFunc("GET /api/ws", apiCfg.handlerWebSocket)
+
 	// Login endpoint
 	mux.HandleFunc("POST /api/login", apiCfg.handlerLogin)
 
+	// Two-factor login step
+	mux.HandleFunc("POST /api/login/2fa", apiCfg.handlerLoginTwoFactor)
+
+	// Two-factor enrollment endpoints
+	mux.HandleFunc("POST /api/users/2fa", apiCfg.middlewareRequireAuth(apiCfg.handlerEnrollTOTP))
+	mux.HandleFunc("POST /api/users/2fa/confirm", apiCfg.middlewareRequireAuth(apiCfg.handlerConfirmTOTP))
+	mux.HandleFunc("DELETE /api/users/2fa", apiCfg.middlewareRequireAuth(apiCfg.handlerDisableTOTP))
+
+	// Passkey login endpoints
+	mux.HandleFunc("POST /api/login/passkey/begin", apiCfg.handlerBeginPasskeyLogin)
+	mux.HandleFunc("POST /api/login/passkey/finish", apiCfg.handlerFinishPasskeyLogin)
+
+	// Passkey management endpoints
+	mux.HandleFunc("POST /api/passkeys/register/begin", apiCfg.middlewareRequireAuth(apiCfg.handlerBeginPasskeyRegistration))
+	mux.HandleFunc("POST /api/passkeys/register/finish", apiCfg.middlewareRequireAuth(apiCfg.handlerFinishPasskeyRegistration))
+	mux.HandleFunc("GET /api/passkeys", apiCfg.middlewareRequireAuth(apiCfg.handlerGetPasskeys))
+	mux.HandleFunc("DELETE /api/passkeys/{credentialID}", apiCfg.middlewareRequireAuth(apiCfg.handlerDeletePasskey))
+
+	// External identity provider login
+	mux.HandleFunc("GET /api/oidc/login", apiCfg.middlewareOptionalAuth(apiCfg.handlerOIDCLogin))
+	mux.HandleFunc("GET /api/oidc/callback", apiCfg.handlerOIDCCallback)
+	mux.HandleFunc("POST /api/oidc/link", apiCfg.handlerOIDCLink)
+
+	// Personal access tokens
+	mux.HandleFunc("POST /api/tokens", apiCfg.middlewareRequireAuth(apiCfg.handlerCreatePersonalAccessToken))
+	mux.HandleFunc("GET /api/tokens", apiCfg.middlewareRequireAuth(apiCfg.handlerGetPersonalAccessTokens))
+	mux.HandleFunc("DELETE /api/tokens/{tokenID}", apiCfg.middlewareRequireAuth(apiCfg.handlerRevokePersonalAccessToken))
+
 	// Refresh endpoint
 	mux.HandleFunc("POST /api/refresh", apiCfg.handlerRefresh)
 
@@ -78,14 +276,82 @@ func main() {
 	mux.HandleFunc("POST /api/revoke", apiCfg.handlerRevoke)
 
 	// Update user data endpoint
-	mux.HandleFunc("PUT /api/users", apiCfg.handlerUpdate)
+	mux.HandleFunc("PATCH /api/users", apiCfg.middlewareRequireAuth(apiCfg.handlerUpdate))
+	mux.HandleFunc("PUT /api/users", apiCfg.middlewareRequireAuth(apiCfg.handlerUpdate))
+
+	// Confirm a new email address
+	mux.HandleFunc("POST /api/users/email/confirm", apiCfg.handlerConfirmEmailChange)
+
+	// Delete the caller's account after a grace period
+	mux.HandleFunc("DELETE /api/users/me", apiCfg.middlewareRequireAuth(apiCfg.handlerDeleteAccount))
+
+	// Personal data export
+	mux.HandleFunc("POST /api/users/me/exports", apiCfg.middlewareRequireAuth(apiCfg.handlerCreateDataExport))
+	mux.HandleFunc("GET /api/users/me/exports/{exportID}", apiCfg.middlewareRequireAuth(apiCfg.handlerGetDataExport))
+	mux.HandleFunc("GET /api/exports/{exportID}/download", apiCfg.handlerDownloadDataExport)
+
+	// Edit chirp
+	mux.HandleFunc("PUT /api/chirps/{chirpID}", apiCfg.middlewareRequireAuth(apiCfg.handlerEditChirp))
 
 	// Delete chirp
-	mux.HandleFunc("DELETE /api/chirps/{chirpID}", apiCfg.handlerDeleteChirp)
+	mux.HandleFunc("DELETE /api/chirps/{chirpID}", apiCfg.middlewareRequireAuth(apiCfg.handlerDeleteChirp))
 
 	// Polka webhooks
 	mux.HandleFunc("POST /api/polka/webhooks", apiCfg.handlerWebhooks)
 
+	// Inspect and replay received Polka events
+	mux.HandleFunc("GET /admin/polka/events", apiCfg.middlewareRequireAuth(apiCfg.handlerGetPolkaEvents))
+	mux.HandleFunc("GET /admin/polka/events/{eventID}", apiCfg.middlewareRequireAuth(apiCfg.handlerGetPolkaEvent))
+	mux.HandleFunc("POST /admin/polka/events/{eventID}/replay", apiCfg.middlewareRequireAuth(apiCfg.handlerReplayPolkaEvent))
+
+	// Notifications
+	mux.HandleFunc("GET /api/notifications", apiCfg.middlewareRequireAuth(apiCfg.handlerGetNotifications))
+	mux.HandleFunc("POST /api/notifications/read", apiCfg.middlewareRequireAuth(apiCfg.handlerMarkAllNotificationsRead))
+	mux.HandleFunc("POST /api/notifications/{notificationID}/read", apiCfg.middlewareRequireAuth(apiCfg.handlerMarkNotificationRead))
+
+	// Outbound webhook endpoints and their delivery logs
+	mux.HandleFunc("POST /api/webhooks", apiCfg.middlewareRequireAuth(apiCfg.handlerCreateWebhookEndpoint))
+	mux.HandleFunc("GET /api/webhooks", apiCfg.middlewareRequireAuth(apiCfg.handlerGetWebhookEndpoints))
+	mux.HandleFunc("DELETE /api/webhooks/{webhookID}", apiCfg.middlewareRequireAuth(apiCfg.handlerDeleteWebhookEndpoint))
+	mux.HandleFunc("POST /api/webhooks/{webhookID}/enable", apiCfg.middlewareRequireAuth(apiCfg.handlerEnableWebhookEndpoint))
+	mux.HandleFunc("GET /api/webhooks/{webhookID}/deliveries", apiCfg.middlewareRequireAuth(apiCfg.handlerGetWebhookDeliveries))
+
+	// Blocking users
+	mux.HandleFunc("POST /api/users/{userID}/block", apiCfg.middlewareRequireAuth(apiCfg.handlerBlockUser))
+	mux.HandleFunc("DELETE /api/users/{userID}/block", apiCfg.middlewareRequireAuth(apiCfg.handlerUnblockUser))
+	mux.HandleFunc("GET /api/users/me/blocks", apiCfg.middlewareRequireAuth(apiCfg.handlerGetBlockedUsers))
+
+	// Direct messages
+	mux.HandleFunc("POST /api/conversations", apiCfg.middlewareRequireAuth(apiCfg.handlerCreateConversation))
+	mux.HandleFunc("GET /api/conversations", apiCfg.middlewareRequireAuth(apiCfg.handlerGetConversations))
+	mux.HandleFunc("GET /api/conversations/{conversationID}", apiCfg.middlewareRequireAuth(apiCfg.handlerGetConversation))
+	mux.HandleFunc("PATCH /api/conversations/{conversationID}", apiCfg.middlewareRequireAuth(apiCfg.handlerUpdateConversation))
+	mux.HandleFunc("GET /api/conversations/{conversationID}/messages", apiCfg.middlewareRequireAuth(apiCfg.handlerGetMessages))
+	mux.HandleFunc("POST /api/conversations/{conversationID}/messages", apiCfg.middlewareRequireAuth(apiCfg.handlerSendMessage))
+	mux.HandleFunc("POST /api/conversations/{conversationID}/read", apiCfg.middlewareRequireAuth(apiCfg.handlerMarkConversationRead))
+	mux.HandleFunc("POST /api/conversations/{conversationID}/mute", apiCfg.middlewareRequireAuth(apiCfg.handlerMuteConversation))
+	mux.HandleFunc("DELETE /api/conversations/{conversationID}/mute", apiCfg.middlewareRequireAuth(apiCfg.handlerUnmuteConversation))
+
+	if adminEmails := os.Getenv("ADMIN_EMAILS"); adminEmails != "" {
+		err = apiCfg.grantAdminRoles(context.Background(), adminEmails)
+		if err != nil {
+			fmt.Printf("could not grant admin roles: %v", err)
+			return
+		}
+	}
+
+	// subscribers of domain events, see events.go
+	apiCfg.events.Subscribe("webhooks", apiCfg.enqueueWebhookEvent)
+	apiCfg.events.Subscribe("notifications", apiCfg.createNotifications)
+	apiCfg.events.Listen(apiCfg.streams.publish)
+
+	go apiCfg.dispatchEvents(context.Background(), eventDispatchInterval)
+	go apiCfg.purgeDeletedAccounts(context.Background(), accountPurgeInterval)
+	go apiCfg.processDataExports(context.Background(), dataExportPollInterval)
+	go apiCfg.expireSubscriptions(context.Background(), subscriptionCheckInterval)
+	go apiCfg.processPolkaEvents(context.Background(), polkaPollInterval)
+	go apiCfg.deliverWebhooks(context.Background(), webhookPollInterval)
+
 	server := http.Server{
 		Addr:    ":8080",
 		Handler: mux,
@@ -95,11 +361,23 @@ func main() {
 }
 
 type apiConfig struct {
-	fileserverHits atomic.Int32
-	dbQueries      *database.Queries
-	platform       string
-	secret         string
-	polkaKey       string
+	fileserverHits    atomic.Int32
+	db                *sql.DB
+	dbQueries         *database.Queries
+	platform          string
+	tokens            auth.TokenConfig
+	polkaKeys         []string
+	webAuthn          auth.WebAuthnConfig
+	oidc              *auth.OIDCProvider
+	passwordPolicy    auth.PasswordPolicy
+	passwordHasher    *auth.PasswordHasher
+	breachedPasswords *auth.BreachedPasswordList
+	cookieSessions    bool
+	cookieSecure      bool
+	linkKey           []byte
+	mailer            mailer.Mailer
+	events            *eventBus
+	streams           *streamHub
 }
 
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
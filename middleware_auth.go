@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ehumba/chirpy-web-server/internal/auth"
+)
+
+type principalContextKey struct{}
+
+// principalFromContext returns the caller that the auth middleware stored in
+// the request context, or nil for anonymous requests.
+func principalFromContext(ctx context.Context) *principal {
+	caller, _ := ctx.Value(principalContextKey{}).(*principal)
+	return caller
+}
+
+// middlewareRequireAuth rejects requests without valid credentials.
+func (a *apiConfig) middlewareRequireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return a.middlewareAuth(next, true)
+}
+
+// middlewareOptionalAuth lets anonymous requests through, but still rejects
+// requests that send invalid credentials.
+func (a *apiConfig) middlewareOptionalAuth(next http.HandlerFunc) http.HandlerFunc {
+	return a.middlewareAuth(next, false)
+}
+
+func (a *apiConfig) middlewareAuth(next http.HandlerFunc, required bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, err := auth.GetBearerToken(r.Header)
+		if errors.Is(err, auth.ErrNoAuthHeader) {
+			// browsers send the access token as a cookie instead, which
+			// other sites can trigger, so those requests need a CSRF token
+			if cookie := a.sessionCookie(r, accessCookieName); cookie != "" {
+				if !validCSRF(r) {
+					respondWithError(w, 403, "invalid csrf token")
+					return
+				}
+				token, err = cookie, nil
+			}
+		}
+		if errors.Is(err, auth.ErrNoAuthHeader) {
+			if required {
+				// no error code when the client didn't try to authenticate (RFC 6750 3.1)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="chirpy"`)
+				respondWithError(w, 401, "authentication required")
+				return
+			}
+			next(w, r)
+			return
+		}
+		if err != nil {
+			setAuthenticateHeader(w, "invalid_request", "malformed authorization header", "")
+			respondWithError(w, 400, "malformed authorization header")
+			return
+		}
+
+		caller, err := a.authenticate(r.Context(), token)
+		if err != nil {
+			setAuthenticateHeader(w, "invalid_token", "the access token is invalid, expired or revoked", "")
+			respondWithError(w, 401, "invalid or expired token")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), principalContextKey{}, caller)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+func setAuthenticateHeader(w http.ResponseWriter, code, description, scope string) {
+	params := []string{
+		`realm="chirpy"`,
+		fmt.Sprintf("error=%q", code),
+		fmt.Sprintf("error_description=%q", description),
+	}
+	if scope != "" {
+		params = append(params, fmt.Sprintf("scope=%q", scope))
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer "+strings.Join(params, ", "))
+}
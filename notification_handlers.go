@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ehumba/chirpy-web-server/internal/auth"
+	"github.com/ehumba/chirpy-web-server/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultNotificationsPageSize = 20
+	maxNotificationsPageSize     = 100
+	// how many of the actors of a group are listed
+	maxNotificationActors = 3
+)
+
+func (a *apiConfig) handlerGetNotifications(w http.ResponseWriter, r *http.Request) {
+	caller := principalFromContext(r.Context())
+	if !requireScope(w, caller, auth.ScopeNotificationsRead) {
+		return
+	}
+
+	query := r.URL.Query()
+
+	limit := defaultNotificationsPageSize
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxNotificationsPageSize {
+			respondWithError(w, 400, "limit must be between 1 and "+strconv.Itoa(maxNotificationsPageSize))
+			return
+		}
+		limit = n
+	}
+
+	// the first page starts after the newest possible notification
+	beforeUpdatedAt := time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+	beforeID := uuid.Max
+	if s := query.Get("cursor"); s != "" {
+		var ok bool
+		beforeUpdatedAt, beforeID, ok = decodePageCursor(s)
+		if !ok {
+			respondWithError(w, 400, "invalid cursor")
+			return
+		}
+	}
+
+	notificationsDB, err := a.dbQueries.GetNotifications(r.Context(), database.GetNotificationsParams{
+		UserID:           caller.UserID,
+		UnreadOnly:       query.Get("unread") == "true",
+		BeforeUpdatedAt:  beforeUpdatedAt,
+		BeforeID:         beforeID,
+		MaxNotifications: int32(limit),
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to get notifications")
+		return
+	}
+
+	unreadCount, err := a.dbQueries.CountUnreadNotifications(r.Context(), caller.UserID)
+	if err != nil {
+		respondWithError(w, 500, "failed to count notifications")
+		return
+	}
+
+	notifications := []Notification{}
+	for _, notificationDB := range notificationsDB {
+		notifications = append(notifications, notificationFromDB(notificationDB))
+	}
+
+	nextCursor := ""
+	if len(notificationsDB) == limit {
+		last := notificationsDB[len(notificationsDB)-1]
+		nextCursor = encodePageCursor(last.UpdatedAt, last.ID)
+	}
+
+	resStruct := struct {
+		Notifications []Notification `json:"notifications"`
+		UnreadCount   int64          `json:"unread_count"`
+		NextCursor    string         `json:"next_cursor,omitempty"`
+	}{
+		Notifications: notifications,
+		UnreadCount:   unreadCount,
+		NextCursor:    nextCursor,
+	}
+
+	respondWithJSON(w, 200, resStruct)
+}
+
+func (a *apiConfig) handlerMarkNotificationRead(w http.ResponseWriter, r *http.Request) {
+	notificationID, err := uuid.Parse(r.PathValue("notificationID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid notification ID format")
+		return
+	}
+
+	caller := principalFromContext(r.Context())
+	if !requireScope(w, caller, auth.ScopeNotificationsRead) {
+		return
+	}
+
+	rows, err := a.dbQueries.MarkNotificationRead(r.Context(), database.MarkNotificationReadParams{
+		ID:     notificationID,
+		UserID: caller.UserID,
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to mark notification as read")
+		return
+	}
+	if rows == 0 {
+		respondWithError(w, 404, "notification not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *apiConfig) handlerMarkAllNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	caller := principalFromContext(r.Context())
+	if !requireScope(w, caller, auth.ScopeNotificationsRead) {
+		return
+	}
+
+	err := a.dbQueries.MarkAllNotificationsRead(r.Context(), caller.UserID)
+	if err != nil {
+		respondWithError(w, 500, "failed to mark notifications as read")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func notificationFromDB(notificationDB database.Notification) Notification {
+	notification := Notification{
+		ID:         notificationDB.ID,
+		CreatedAt:  notificationDB.CreatedAt,
+		UpdatedAt:  notificationDB.UpdatedAt,
+		Type:       notificationDB.Type,
+		ActorIDs:   notificationDB.ActorIds,
+		ActorCount: notificationDB.ActorCount,
+	}
+	if len(notification.ActorIDs) > maxNotificationActors {
+		notification.ActorIDs = notification.ActorIDs[:maxNotificationActors]
+	}
+	if notificationDB.ChirpID.Valid {
+		notification.ChirpID = &notificationDB.ChirpID.UUID
+	}
+	if notificationDB.ConversationID.Valid {
+		notification.ConversationID = &notificationDB.ConversationID.UUID
+	}
+	if notificationDB.ReadAt.Valid {
+		notification.ReadAt = &notificationDB.ReadAt.Time
+	}
+	return notification
+}
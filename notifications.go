@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/ehumba/chirpy-web-server/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	notificationMention = "mention"
+	notificationMessage = "message"
+
+	// mentions beyond this are not notified, so a single chirp can't be
+	// used to spam everyone
+	maxMentionsPerChirp = 10
+)
+
+// users don't have handles, so they are mentioned by their email address,
+// e.g. "@alice@example.com"
+var mentionPattern = regexp.MustCompile(`(?:^|\s)@([^\s@]+@[^\s@]+\.[^\s@]+)`)
+
+// parseMentions returns the distinct addresses mentioned in a chirp, in the
+// order they appear.
+func parseMentions(body string) []string {
+	mentions := []string{}
+	seen := map[string]bool{}
+	for _, m := range mentionPattern.FindAllStringSubmatch(body, -1) {
+		email := strings.TrimRight(m[1], ".,;:!?)")
+		if seen[email] {
+			continue
+		}
+		seen[email] = true
+		mentions = append(mentions, email)
+		if len(mentions) == maxMentionsPerChirp {
+			break
+		}
+	}
+	return mentions
+}
+
+// notificationGroupKey decides which notifications are shown as one, e.g.
+// the new messages of a conversation.
+func notificationGroupKey(notificationType string, subjectID uuid.UUID) string {
+	return notificationType + ":" + subjectID.String()
+}
+
+// createNotifications subscribes notifications to domain events.
+func (a *apiConfig) createNotifications(ctx context.Context, q *database.Queries, event domainEvent) error {
+	switch event.Type {
+	case eventChirpCreated:
+		chirp := Chirp{}
+		err := json.Unmarshal(event.Data, &chirp)
+		if err != nil {
+			return err
+		}
+		return notifyMentions(ctx, q, chirp)
+	case eventMessageCreated:
+		message := Message{}
+		err := json.Unmarshal(event.Data, &message)
+		if err != nil {
+			return err
+		}
+		return notifyMessageRecipients(ctx, q, message)
+	}
+	return nil
+}
+
+// notifyMentions notifies the mentioned users. All unread mentions of a user
+// are one notification, which points to the latest chirp, so it can say
+// "X and 4 others mentioned you".
+func notifyMentions(ctx context.Context, q *database.Queries, chirp Chirp) error {
+	mentions := parseMentions(chirp.Body)
+	if len(mentions) == 0 {
+		return nil
+	}
+
+	// the chirp may have been deleted before the event was dispatched
+	_, err := q.GetChirp(ctx, chirp.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, email := range mentions {
+		userDB, err := q.LookUpByEmail(ctx, email)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if userDB.ID == chirp.UserID {
+			continue
+		}
+		blocked, err := q.HasBlockBetween(ctx, database.HasBlockBetweenParams{
+			UserID:   userDB.ID,
+			OtherIds: []uuid.UUID{chirp.UserID},
+		})
+		if err != nil {
+			return err
+		}
+		if blocked {
+			continue
+		}
+
+		notificationDB, err := q.UpsertNotification(ctx, database.UpsertNotificationParams{
+			UserID:   userDB.ID,
+			Type:     notificationMention,
+			GroupKey: notificationMention,
+			ChirpID:  uuid.NullUUID{UUID: chirp.ID, Valid: true},
+			ActorID:  chirp.UserID,
+		})
+		if err != nil {
+			return err
+		}
+
+		// pushed to the recipient's WebSocket connections
+		err = publishEvent(ctx, q, eventNotificationCreated, userDB.ID, notificationFromDB(notificationDB))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyMessageRecipients notifies the participants of a conversation who
+// didn't mute it. Messages are grouped per conversation until it is read.
+func notifyMessageRecipients(ctx context.Context, q *database.Queries, message Message) error {
+	participants, err := q.GetConversationParticipants(ctx, message.ConversationID)
+	if err != nil {
+		return err
+	}
+
+	for _, participant := range participants {
+		if participant.UserID == message.SenderID || participant.Muted {
+			continue
+		}
+
+		notificationDB, err := q.UpsertNotification(ctx, database.UpsertNotificationParams{
+			UserID:         participant.UserID,
+			Type:           notificationMessage,
+			GroupKey:       notificationGroupKey(notificationMessage, message.ConversationID),
+			ConversationID: uuid.NullUUID{UUID: message.ConversationID, Valid: true},
+			ActorID:        message.SenderID,
+		})
+		if err != nil {
+			return err
+		}
+
+		err = publishEvent(ctx, q, eventNotificationCreated, participant.UserID, notificationFromDB(notificationDB))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ehumba/chirpy-web-server/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestMentionGroupSurvivesDeletingLatestChirp(t *testing.T) {
+	_, q := newTestDB(t)
+	ctx := context.Background()
+
+	alice := createTestUser(t, q, "alice@example.com")
+	bob := createTestUser(t, q, "bob@example.com")
+	carol := createTestUser(t, q, "carol@example.com")
+
+	first := createTestChirp(t, q, bob.ID, "hi @alice@example.com")
+	latest := createTestChirp(t, q, carol.ID, "hello @alice@example.com")
+	for _, chirp := range []Chirp{first, latest} {
+		err := notifyMentions(ctx, q, chirp)
+		if err != nil {
+			t.Fatalf("notifyMentions() error = %v", err)
+		}
+	}
+
+	err := q.DeleteChirp(ctx, latest.ID)
+	if err != nil {
+		t.Fatalf("DeleteChirp() error = %v", err)
+	}
+
+	notificationsDB, err := q.GetNotifications(ctx, database.GetNotificationsParams{
+		UserID:           alice.ID,
+		BeforeUpdatedAt:  time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC),
+		BeforeID:         uuid.Max,
+		MaxNotifications: 10,
+	})
+	if err != nil {
+		t.Fatalf("GetNotifications() error = %v", err)
+	}
+	if len(notificationsDB) != 1 {
+		t.Fatalf("got %d notifications, want the one group", len(notificationsDB))
+	}
+	group := notificationsDB[0]
+	if group.ActorCount != 2 {
+		t.Errorf("ActorCount = %d, want 2", group.ActorCount)
+	}
+	if group.ChirpID.Valid {
+		t.Errorf("ChirpID = %v, want null after the chirp was deleted", group.ChirpID.UUID)
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/ehumba/chirpy-web-server/internal/auth"
+	"github.com/ehumba/chirpy-web-server/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	oidcLoginTimeout = 10 * time.Minute
+	oidcLinkTimeout  = 10 * time.Minute
+	// binds the login state to the browser that started the login
+	oidcStateCookieName = "chirpy_oidc_state"
+)
+
+// handlerOIDCLogin starts a login with the identity provider. A caller who
+// is already logged in links the identity to their account instead.
+func (a *apiConfig) handlerOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if a.oidc == nil {
+		respondWithError(w, 404, "external login is not configured")
+		return
+	}
+
+	state, err := auth.MakeRefreshToken()
+	if err != nil {
+		respondWithError(w, 500, "failed to create login state")
+		return
+	}
+
+	nonce, err := auth.MakeRefreshToken()
+	if err != nil {
+		respondWithError(w, 500, "failed to create login nonce")
+		return
+	}
+
+	verifier, challenge, err := auth.MakePKCEVerifier()
+	if err != nil {
+		respondWithError(w, 500, "failed to create code verifier")
+		return
+	}
+
+	redirectURL, err := a.oidc.AuthCodeURL(r.Context(), state, nonce, challenge)
+	if err != nil {
+		respondWithError(w, 502, "identity provider is unavailable")
+		return
+	}
+
+	linkUserID := uuid.NullUUID{}
+	if caller := principalFromContext(r.Context()); caller != nil && caller.TokenType == tokenTypeSession {
+		linkUserID = uuid.NullUUID{UUID: caller.UserID, Valid: true}
+	}
+
+	err = a.dbQueries.CreateOIDCLoginState(r.Context(), database.CreateOIDCLoginStateParams{
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		ExpiresAt:    time.Now().Add(oidcLoginTimeout),
+		UserID:       linkUserID,
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to save login state")
+		return
+	}
+
+	// Lax, so the cookie comes along on the provider's redirect back
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state,
+		Path:     "/api/oidc",
+		MaxAge:   int(oidcLoginTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   a.cookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, redirectURL, http.StatusFound)
+}
+
+func (a *apiConfig) handlerOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if a.oidc == nil {
+		respondWithError(w, 404, "external login is not configured")
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("error") != "" {
+		respondWithError(w, 401, "external login failed: "+query.Get("error"))
+		return
+	}
+
+	// a callback from someone else's login must not log this browser in
+	cookie, err := r.Cookie(oidcStateCookieName)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(query.Get("state"))) != 1 {
+		respondWithError(w, 400, "login state does not match this browser")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Path:     "/api/oidc",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   a.cookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	loginState, err := a.dbQueries.ConsumeOIDCLoginState(r.Context(), query.Get("state"))
+	if err != nil {
+		respondWithError(w, 400, "invalid or expired login state")
+		return
+	}
+
+	rawIDToken, err := a.oidc.Exchange(r.Context(), query.Get("code"), loginState.CodeVerifier)
+	if err != nil {
+		respondWithError(w, 401, "failed to redeem authorization code")
+		return
+	}
+
+	claims, err := a.oidc.VerifyIDToken(r.Context(), rawIDToken, loginState.Nonce)
+	if err != nil {
+		respondWithError(w, 401, "invalid identity token")
+		return
+	}
+
+	identity, err := a.dbQueries.GetUserIdentity(r.Context(), database.GetUserIdentityParams{
+		Issuer:  a.oidc.Issuer,
+		Subject: claims.Subject,
+	})
+	if err == nil {
+		if loginState.UserID.Valid && loginState.UserID.UUID != identity.UserID {
+			respondWithError(w, 409, "this identity is linked to another account")
+			return
+		}
+		userDB, err := a.dbQueries.LookUpByID(r.Context(), identity.UserID)
+		if err != nil {
+			respondWithError(w, 500, "failed to look up user")
+			return
+		}
+		a.respondWithLogin(w, r, userDB)
+		return
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, 500, "failed to look up identity")
+		return
+	}
+
+	if claims.Email == "" {
+		respondWithError(w, 400, "identity provider did not return an email address")
+		return
+	}
+
+	// first login with this identity: a logged-in caller links it to their
+	// account, everyone else gets a new account
+	var userDB database.User
+	if loginState.UserID.Valid {
+		userDB, err = a.dbQueries.LookUpByID(r.Context(), loginState.UserID.UUID)
+		if err != nil {
+			respondWithError(w, 500, "failed to look up user")
+			return
+		}
+	} else {
+		// anyone can claim an address the provider didn't verify
+		if !claims.EmailVerified {
+			respondWithError(w, 403, "identity provider has not verified this email address")
+			return
+		}
+		userDB, err = a.dbQueries.LookUpByEmail(r.Context(), claims.Email)
+		if err == nil {
+			// the provider's word isn't enough to take over an existing
+			// account, its owner has to confirm with their password
+			a.respondWithPendingLink(w, r, userDB, claims)
+			return
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, 500, "failed to look up user")
+			return
+		}
+		userDB, err = a.dbQueries.CreateUserWithoutPassword(r.Context(), claims.Email)
+		if err != nil {
+			respondWithAPIError(w, dbError(err, "failed to create new user"))
+			return
+		}
+	}
+
+	_, err = a.dbQueries.CreateUserIdentity(r.Context(), database.CreateUserIdentityParams{
+		UserID:  userDB.ID,
+		Issuer:  a.oidc.Issuer,
+		Subject: claims.Subject,
+		Email:   claims.Email,
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to link identity")
+		return
+	}
+
+	a.respondWithLogin(w, r, userDB)
+}
+
+// respondWithPendingLink answers a first login whose email belongs to an
+// existing account with a token that links the identity once the password
+// of that account is confirmed, see handlerOIDCLink.
+func (a *apiConfig) respondWithPendingLink(w http.ResponseWriter, r *http.Request, userDB database.User, claims auth.OIDCClaims) {
+	linkToken, err := auth.MakeRefreshToken()
+	if err != nil {
+		respondWithError(w, 500, "failed to create link token")
+		return
+	}
+
+	err = a.dbQueries.CreateOIDCPendingLink(r.Context(), database.CreateOIDCPendingLinkParams{
+		TokenHash: auth.HashToken(linkToken),
+		UserID:    userDB.ID,
+		Issuer:    a.oidc.Issuer,
+		Subject:   claims.Subject,
+		Email:     claims.Email,
+		ExpiresAt: time.Now().Add(oidcLinkTimeout),
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to save link token")
+		return
+	}
+
+	resStruct := struct {
+		Error     string `json:"error"`
+		LinkToken string `json:"link_token"`
+	}{
+		Error:     "an account with this email already exists, confirm its password to link it",
+		LinkToken: linkToken,
+	}
+
+	respondWithJSON(w, 409, resStruct)
+}
+
+// handlerOIDCLink links a pending identity to the account with the same
+// email once its password is confirmed, and logs the user in.
+func (a *apiConfig) handlerOIDCLink(w http.ResponseWriter, r *http.Request) {
+	if a.oidc == nil {
+		respondWithError(w, 404, "external login is not configured")
+		return
+	}
+
+	type reqParams struct {
+		LinkToken string `json:"link_token"`
+		Password  string `json:"password"`
+	}
+
+	params := reqParams{}
+	err := decodeJSON(r, &params)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+
+	tokenHash := auth.HashToken(params.LinkToken)
+	link, err := a.dbQueries.GetOIDCPendingLink(r.Context(), tokenHash)
+	if err != nil {
+		respondWithError(w, 400, "invalid or expired link token")
+		return
+	}
+
+	userDB, err := a.dbQueries.LookUpByID(r.Context(), link.UserID)
+	if err != nil {
+		respondWithError(w, 404, "user not found")
+		return
+	}
+
+	// the password check is as open to guessing as the login itself
+	accountKey := accountThrottleKey(userDB.Email)
+	lockedUntil, err := a.loginLockedUntil(r.Context(), accountKey)
+	if err != nil {
+		respondWithError(w, 500, "failed to check login attempts")
+		return
+	}
+	if !lockedUntil.IsZero() {
+		respondWithLockout(w, lockedUntil)
+		return
+	}
+
+	err = auth.CheckPasswordHash(params.Password, userDB.HashedPassword)
+	if errors.Is(err, auth.ErrUnknownHash) {
+		respondWithError(w, 409, "log in with your linked account first, then link this one")
+		return
+	}
+	if err != nil {
+		err = a.recordLoginFailure(r.Context(), accountKey, accountLoginThrottle)
+		if err != nil {
+			respondWithError(w, 500, "failed to record login attempt")
+			return
+		}
+		respondWithError(w, 401, "incorrect password")
+		return
+	}
+
+	err = a.dbQueries.DeleteOIDCPendingLink(r.Context(), tokenHash)
+	if err != nil {
+		respondWithError(w, 500, "failed to delete link token")
+		return
+	}
+
+	_, err = a.dbQueries.CreateUserIdentity(r.Context(), database.CreateUserIdentityParams{
+		UserID:  userDB.ID,
+		Issuer:  link.Issuer,
+		Subject: link.Subject,
+		Email:   link.Email,
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to link identity")
+		return
+	}
+
+	a.respondWithLogin(w, r, userDB)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ehumba/chirpy-web-server/internal/auth"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// newTestOIDCProvider serves an identity provider whose ID tokens carry the
+// given email, signed with the nonce of the last login it was sent.
+func newTestOIDCProvider(t *testing.T, email string, emailVerified bool) *auth.OIDCProvider {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var server *httptest.Server
+	var mu sync.Mutex
+	nonce := ""
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 server.URL,
+			"authorization_endpoint": server.URL + "/authorize",
+			"token_endpoint":         server.URL + "/token",
+			"jwks_uri":               server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(auth.JWKSet{Keys: []auth.JWK{{
+			Kty: "EC",
+			Kid: "issuer-key",
+			Alg: "ES256",
+			Crv: "P-256",
+			X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+		}}})
+	})
+	mux.HandleFunc("GET /authorize", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		nonce = r.URL.Query().Get("nonce")
+		mu.Unlock()
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, auth.OIDCClaims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    server.URL,
+				Subject:   "provider-user-1",
+				Audience:  jwt.ClaimStrings{"chirpy-client"},
+				IssuedAt:  jwt.NewNumericDate(time.Now()),
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(5 * time.Minute)),
+			},
+			Email:         email,
+			EmailVerified: emailVerified,
+			Nonce:         nonce,
+		})
+		token.Header["kid"] = "issuer-key"
+		idToken, err := token.SignedString(key)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idToken})
+	})
+	server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	provider := auth.NewOIDCProvider(server.URL, "chirpy-client", "chirpy-secret", "http://chirpy.example/api/oidc/callback")
+	provider.HTTPClient = server.Client()
+	return provider
+}
+
+// completeOIDCLogin starts a login, signs in at the provider and returns the
+// response of the callback.
+func completeOIDCLogin(t *testing.T, a *apiConfig) *httptest.ResponseRecorder {
+	t.Helper()
+	login := httptest.NewRecorder()
+	a.handlerOIDCLogin(login, httptest.NewRequest("GET", "/api/oidc/login", nil))
+	if login.Code != http.StatusFound {
+		t.Fatalf("login status = %d, body %s", login.Code, login.Body)
+	}
+
+	authURL := login.Header().Get("Location")
+	res, err := a.oidc.HTTPClient.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callbackQuery := url.Values{
+		"code":  {"code-1"},
+		"state": {u.Query().Get("state")},
+	}
+	req := httptest.NewRequest("GET", "/api/oidc/callback?"+callbackQuery.Encode(), nil)
+	for _, cookie := range login.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	callback := httptest.NewRecorder()
+	a.handlerOIDCCallback(callback, req)
+	return callback
+}
+
+func TestOIDCCallbackRejectsUnverifiedEmail(t *testing.T) {
+	tests := []struct {
+		name  string
+		email string
+	}{
+		{name: "new account", email: "new@example.com"},
+		{name: "existing account", email: "bob@example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, q := newTestDB(t)
+			bob := createTestUser(t, q, "bob@example.com")
+			a := &apiConfig{
+				db:        db,
+				dbQueries: q,
+				oidc:      newTestOIDCProvider(t, tt.email, false),
+			}
+
+			res := completeOIDCLogin(t, a)
+			if res.Code != http.StatusForbidden {
+				t.Fatalf("callback status = %d, want 403, body %s", res.Code, res.Body)
+			}
+
+			ctx := context.Background()
+			userDB, err := q.LookUpByEmail(ctx, tt.email)
+			if tt.email == bob.Email {
+				if err != nil || userDB.ID != bob.ID {
+					t.Errorf("LookUpByEmail() = %v, %v, want the existing account", userDB.ID, err)
+				}
+			} else if !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("an account was created for an unverified email, error = %v", err)
+			}
+
+			var pendingLinks int
+			err = db.QueryRow("SELECT COUNT(*) FROM oidc_pending_links").Scan(&pendingLinks)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pendingLinks != 0 {
+				t.Errorf("%d link tokens were issued for an unverified email", pendingLinks)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/ehumba/chirpy-web-server/internal/auth"
+	"github.com/ehumba/chirpy-web-server/internal/database"
+	"github.com/google/uuid"
+)
+
+func (a *apiConfig) handlerCreateWebhookEndpoint(w http.ResponseWriter, r *http.Request) {
+	caller := principalFromContext(r.Context())
+	if !requireSession(w, caller) {
+		return
+	}
+
+	type reqParams struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+
+	params := reqParams{}
+	err := decodeJSON(r, &params)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+
+	validationErrs := validateWebhookURL(params.URL, a.platform == "dev")
+	if len(params.Events) == 0 {
+		validationErrs = append(validationErrs, fieldError{Field: "events", Code: "required", Message: "at least one event is required"})
+	}
+	for _, event := range params.Events {
+		if !validWebhookEvent(event) {
+			validationErrs = append(validationErrs, fieldError{Field: "events", Code: "invalid", Message: "unknown event: " + event})
+		}
+	}
+	if len(validationErrs) > 0 {
+		respondWithValidationErrors(w, validationErrs)
+		return
+	}
+
+	existing, err := a.dbQueries.GetWebhookEndpointsForUser(r.Context(), caller.UserID)
+	if err != nil {
+		respondWithError(w, 500, "failed to get webhooks")
+		return
+	}
+	if len(existing) >= maxWebhooksPerUser {
+		respondWithError(w, 409, "you already have the maximum number of webhooks")
+		return
+	}
+
+	secret, err := auth.MakeWebhookSecret()
+	if err != nil {
+		respondWithError(w, 500, "failed to create webhook secret")
+		return
+	}
+
+	endpointDB, err := a.dbQueries.CreateWebhookEndpoint(r.Context(), database.CreateWebhookEndpointParams{
+		UserID: caller.UserID,
+		Url:    params.URL,
+		Secret: secret,
+		Events: params.Events,
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to save webhook")
+		return
+	}
+
+	// the secret is only ever shown in this response
+	resStruct := struct {
+		WebhookEndpoint `json:",inline"`
+		Secret          string `json:"secret"`
+	}{
+		WebhookEndpoint: webhookEndpointFromDB(endpointDB),
+		Secret:          secret,
+	}
+
+	respondWithJSON(w, 201, resStruct)
+}
+
+func (a *apiConfig) handlerGetWebhookEndpoints(w http.ResponseWriter, r *http.Request) {
+	caller := principalFromContext(r.Context())
+	if !requireSession(w, caller) {
+		return
+	}
+
+	endpointsDB, err := a.dbQueries.GetWebhookEndpointsForUser(r.Context(), caller.UserID)
+	if err != nil {
+		respondWithError(w, 500, "failed to get webhooks")
+		return
+	}
+
+	endpoints := []WebhookEndpoint{}
+	for _, endpointDB := range endpointsDB {
+		endpoints = append(endpoints, webhookEndpointFromDB(endpointDB))
+	}
+
+	respondWithJSON(w, 200, endpoints)
+}
+
+func (a *apiConfig) handlerDeleteWebhookEndpoint(w http.ResponseWriter, r *http.Request) {
+	endpointID, err := uuid.Parse(r.PathValue("webhookID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid webhook ID format")
+		return
+	}
+
+	caller := principalFromContext(r.Context())
+	if !requireSession(w, caller) {
+		return
+	}
+
+	rows, err := a.dbQueries.DeleteWebhookEndpoint(r.Context(), database.DeleteWebhookEndpointParams{
+		ID:     endpointID,
+		UserID: caller.UserID,
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to delete webhook")
+		return
+	}
+	if rows == 0 {
+		respondWithError(w, 404, "webhook not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerEnableWebhookEndpoint turns an endpoint back on after it was
+// disabled for failing too often.
+func (a *apiConfig) handlerEnableWebhookEndpoint(w http.ResponseWriter, r *http.Request) {
+	endpointID, err := uuid.Parse(r.PathValue("webhookID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid webhook ID format")
+		return
+	}
+
+	caller := principalFromContext(r.Context())
+	if !requireSession(w, caller) {
+		return
+	}
+
+	rows, err := a.dbQueries.EnableWebhookEndpoint(r.Context(), database.EnableWebhookEndpointParams{
+		ID:     endpointID,
+		UserID: caller.UserID,
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to enable webhook")
+		return
+	}
+	if rows == 0 {
+		respondWithError(w, 404, "webhook not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *apiConfig) handlerGetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	endpointID, err := uuid.Parse(r.PathValue("webhookID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid webhook ID format")
+		return
+	}
+
+	caller := principalFromContext(r.Context())
+	if !requireSession(w, caller) {
+		return
+	}
+
+	endpointDB, err := a.dbQueries.GetWebhookEndpoint(r.Context(), endpointID)
+	if err != nil || endpointDB.UserID != caller.UserID {
+		respondWithError(w, 404, "webhook not found")
+		return
+	}
+
+	deliveriesDB, err := a.dbQueries.GetWebhookDeliveries(r.Context(), endpointID)
+	if err != nil {
+		respondWithError(w, 500, "failed to get deliveries")
+		return
+	}
+
+	deliveries := []WebhookDelivery{}
+	for _, deliveryDB := range deliveriesDB {
+		deliveries = append(deliveries, webhookDeliveryFromDB(deliveryDB))
+	}
+
+	respondWithJSON(w, 200, deliveries)
+}
+
+func webhookEndpointFromDB(endpointDB database.WebhookEndpoint) WebhookEndpoint {
+	endpoint := WebhookEndpoint{
+		ID:                  endpointDB.ID,
+		CreatedAt:           endpointDB.CreatedAt,
+		URL:                 endpointDB.Url,
+		Events:              endpointDB.Events,
+		Enabled:             endpointDB.Enabled,
+		ConsecutiveFailures: endpointDB.ConsecutiveFailures,
+	}
+	if endpointDB.DisabledAt.Valid {
+		endpoint.DisabledAt = &endpointDB.DisabledAt.Time
+	}
+	return endpoint
+}
+
+func webhookDeliveryFromDB(deliveryDB database.WebhookDelivery) WebhookDelivery {
+	delivery := WebhookDelivery{
+		ID:        deliveryDB.ID,
+		CreatedAt: deliveryDB.CreatedAt,
+		Event:     deliveryDB.Event,
+		Payload:   json.RawMessage(deliveryDB.Payload),
+		Status:    deliveryDB.Status,
+		Attempts:  deliveryDB.Attempts,
+		LastError: deliveryDB.LastError.String,
+	}
+	if deliveryDB.Status == webhookDeliveryStatusPending {
+		delivery.NextAttemptAt = &deliveryDB.NextAttemptAt
+	}
+	if deliveryDB.LastAttemptAt.Valid {
+		delivery.LastAttemptAt = &deliveryDB.LastAttemptAt.Time
+	}
+	if deliveryDB.ResponseStatus.Valid {
+		delivery.ResponseStatus = &deliveryDB.ResponseStatus.Int32
+	}
+	return delivery
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/ehumba/chirpy-web-server/internal/auth"
+	"github.com/ehumba/chirpy-web-server/internal/database"
+	"github.com/ehumba/chirpy-web-server/internal/mailer"
+)
+
+// Events that can be sent to webhook endpoints. Endpoints only receive
+// events about their owner's account.
+var webhookEvents = []string{eventChirpCreated, eventChirpUpdated, eventChirpDeleted}
+
+const (
+	webhookDeliveryStatusPending   = "pending"
+	webhookDeliveryStatusSucceeded = "succeeded"
+	webhookDeliveryStatusFailed    = "failed"
+
+	webhookSignatureHeader = "Chirpy-Signature"
+	webhookEventHeader     = "Chirpy-Event"
+	webhookDeliveryHeader  = "Chirpy-Delivery"
+
+	webhookPollInterval     = 5 * time.Second
+	webhookBatchSize        = 20
+	webhookRequestTimeout   = 10 * time.Second
+	webhookMaxAttempts      = 8
+	webhookRetryBaseDelay   = 30 * time.Second
+	webhookRetryMaxDelay    = 12 * time.Hour
+	webhookDeliveryRetained = 30 * 24 * time.Hour
+	// endpoints are disabled after this many failed attempts in a row
+	webhookDisableAfter   = 15
+	maxWebhooksPerUser    = 10
+	maxWebhookLogBodySize = 512
+)
+
+func validWebhookEvent(event string) bool {
+	for _, e := range webhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookEvent is the JSON body posted to endpoints.
+type webhookEvent struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// enqueueWebhookEvent subscribes webhooks to domain events. It queues a
+// delivery for every enabled endpoint of the event's user that subscribed
+// to it, deliverWebhooks sends them.
+func (a *apiConfig) enqueueWebhookEvent(ctx context.Context, q *database.Queries, event domainEvent) error {
+	if !validWebhookEvent(event.Type) {
+		return nil
+	}
+
+	endpoints, err := q.GetSubscribedWebhookEndpoints(ctx, database.GetSubscribedWebhookEndpointsParams{
+		UserID: event.UserID,
+		Event:  event.Type,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to look up webhook endpoints: %v", err)
+	}
+	if len(endpoints) == 0 {
+		return nil
+	}
+
+	// the id stays the same across endpoints and retries, so receivers
+	// can use it to drop duplicates
+	payload, err := json.Marshal(webhookEvent{
+		ID:        "evt_" + strconv.FormatInt(event.ID, 10),
+		Type:      event.Type,
+		CreatedAt: event.CreatedAt.UTC(),
+		Data:      event.Data,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook: %v", err)
+	}
+
+	for _, endpoint := range endpoints {
+		err = q.CreateWebhookDelivery(ctx, database.CreateWebhookDeliveryParams{
+			EndpointID: endpoint.ID,
+			Event:      event.Type,
+			Payload:    string(payload),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to queue webhook for endpoint %s: %v", endpoint.ID, err)
+		}
+	}
+	return nil
+}
+
+// deliverWebhooks sends queued deliveries. Claimed deliveries are leased
+// by pushing next_attempt_at forward, so a crash while sending only
+// delays the retry.
+func (a *apiConfig) deliverWebhooks(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	client := newWebhookClient(a.platform == "dev")
+
+	for {
+		deliveries, err := a.dbQueries.ClaimDueWebhookDeliveries(ctx, database.ClaimDueWebhookDeliveriesParams{
+			LeaseUntil:    time.Now().Add(2 * webhookRequestTimeout),
+			MaxDeliveries: webhookBatchSize,
+		})
+		if err != nil {
+			log.Printf("failed to claim webhook deliveries: %v", err)
+		}
+		for _, delivery := range deliveries {
+			a.deliverWebhook(ctx, client, delivery)
+		}
+
+		err = a.dbQueries.DeleteOldWebhookDeliveries(ctx, time.Now().Add(-webhookDeliveryRetained))
+		if err != nil {
+			log.Printf("failed to delete old webhook deliveries: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *apiConfig) deliverWebhook(ctx context.Context, client *http.Client, delivery database.WebhookDelivery) {
+	endpoint, err := a.dbQueries.GetWebhookEndpoint(ctx, delivery.EndpointID)
+	if err != nil {
+		log.Printf("failed to look up webhook endpoint %s: %v", delivery.EndpointID, err)
+		return
+	}
+
+	statusCode, sendErr := sendWebhook(ctx, client, endpoint, delivery)
+	attempt := database.RecordWebhookDeliveryAttemptParams{
+		ID:            delivery.ID,
+		Status:        webhookDeliveryStatusSucceeded,
+		NextAttemptAt: time.Now(),
+	}
+	if statusCode != 0 {
+		attempt.ResponseStatus = sql.NullInt32{Int32: int32(statusCode), Valid: true}
+	}
+
+	if sendErr == nil {
+		err = a.dbQueries.RecordWebhookDeliveryAttempt(ctx, attempt)
+		if err != nil {
+			log.Printf("failed to record webhook delivery %s: %v", delivery.ID, err)
+		}
+		err = a.dbQueries.ResetWebhookEndpointFailures(ctx, endpoint.ID)
+		if err != nil {
+			log.Printf("failed to reset failures of webhook endpoint %s: %v", endpoint.ID, err)
+		}
+		return
+	}
+
+	attempts := int(delivery.Attempts) + 1
+	attempt.Status = webhookDeliveryStatusPending
+	attempt.NextAttemptAt = time.Now().Add(webhookRetryDelay(attempts))
+	attempt.LastError = sql.NullString{String: sendErr.Error(), Valid: true}
+	if attempts >= webhookMaxAttempts {
+		attempt.Status = webhookDeliveryStatusFailed
+	}
+	err = a.dbQueries.RecordWebhookDeliveryAttempt(ctx, attempt)
+	if err != nil {
+		log.Printf("failed to record webhook delivery %s: %v", delivery.ID, err)
+	}
+
+	failures, err := a.dbQueries.RecordWebhookEndpointFailure(ctx, endpoint.ID)
+	if err != nil {
+		log.Printf("failed to record failure of webhook endpoint %s: %v", endpoint.ID, err)
+		return
+	}
+	if failures == webhookDisableAfter {
+		a.disableWebhookEndpoint(ctx, endpoint)
+	}
+}
+
+// disableWebhookEndpoint stops deliveries to an endpoint that keeps
+// failing. Its pending deliveries are canceled, so they are pruned with the
+// old ones instead of piling up until it is enabled again.
+func (a *apiConfig) disableWebhookEndpoint(ctx context.Context, endpoint database.WebhookEndpoint) {
+	tx, err := a.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("failed to disable webhook endpoint %s: %v", endpoint.ID, err)
+		return
+	}
+	defer tx.Rollback()
+	qtx := a.dbQueries.WithTx(tx)
+
+	err = qtx.DisableWebhookEndpoint(ctx, endpoint.ID)
+	if err != nil {
+		log.Printf("failed to disable webhook endpoint %s: %v", endpoint.ID, err)
+		return
+	}
+	err = qtx.CancelPendingWebhookDeliveries(ctx, endpoint.ID)
+	if err != nil {
+		log.Printf("failed to cancel deliveries of webhook endpoint %s: %v", endpoint.ID, err)
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("failed to disable webhook endpoint %s: %v", endpoint.ID, err)
+		return
+	}
+	log.Printf("disabled webhook endpoint %s after %d failed deliveries", endpoint.ID, webhookDisableAfter)
+
+	userDB, err := a.dbQueries.LookUpByID(ctx, endpoint.UserID)
+	if err != nil {
+		return
+	}
+	msg := mailer.Message{
+		To:      userDB.Email,
+		Subject: "Your Chirpy webhook was disabled",
+		Body: fmt.Sprintf("We stopped sending events to %s because the last %d deliveries failed.\n\n"+
+			"Deliveries that were still pending have been canceled. "+
+			"Once the endpoint works again, enable it with POST /api/webhooks/%s/enable.\n",
+			endpoint.Url, webhookDisableAfter, endpoint.ID),
+	}
+	err = a.mailer.Send(ctx, msg)
+	if err != nil {
+		log.Printf("failed to send %q to %s: %v", msg.Subject, msg.To, err)
+	}
+}
+
+// sendWebhook posts a delivery and returns the response status. Anything
+// but a 2xx response is an error.
+func sendWebhook(ctx context.Context, client *http.Client, endpoint database.WebhookEndpoint, delivery database.WebhookDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, webhookRequestTimeout)
+	defer cancel()
+
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Chirpy-Webhooks/1.0")
+	req.Header.Set(webhookEventHeader, delivery.Event)
+	req.Header.Set(webhookDeliveryHeader, delivery.ID.String())
+	req.Header.Set(webhookSignatureHeader, auth.SignWebhook(endpoint.Secret, body, time.Now()))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		snippet, _ := io.ReadAll(io.LimitReader(res.Body, maxWebhookLogBodySize))
+		return res.StatusCode, fmt.Errorf("endpoint responded with %d: %s", res.StatusCode, snippet)
+	}
+	return res.StatusCode, nil
+}
+
+// webhookRetryDelay doubles the delay with every attempt, with some jitter
+// so that deliveries that failed together don't retry together.
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookRetryMaxDelay
+	if attempts <= 16 {
+		delay = min(webhookRetryBaseDelay<<(attempts-1), webhookRetryMaxDelay)
+	}
+	return delay + rand.N(delay/10+1)
+}
+
+// validateWebhookURL only accepts https URLs, plain http is allowed on the
+// dev platform for local testing.
+func validateWebhookURL(rawURL string, allowHTTP bool) []fieldError {
+	if rawURL == "" {
+		return []fieldError{{Field: "url", Code: "required", Message: "url is required"}}
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" || u.User != nil ||
+		(u.Scheme != "https" && !(allowHTTP && u.Scheme == "http")) {
+		return []fieldError{{Field: "url", Code: "invalid", Message: "url must be an absolute https URL"}}
+	}
+	return nil
+}
+
+var errWebhookAddressNotAllowed = errors.New("webhook address is not allowed")
+
+// webhookDeniedPrefixes are the special-purpose ranges (RFC 6890 and the
+// IANA registries) that aren't reachable on the internet, or that embed
+// IPv4 addresses and could be used to reach the ones above.
+var webhookDeniedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.88.99.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/96"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001::/23"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("2002::/16"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("fec0::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// webhookAddressAllowed reports whether deliveries may connect to addr.
+// IPv4-mapped IPv6 addresses are checked as the IPv4 address.
+func webhookAddressAllowed(addr netip.Addr) bool {
+	addr = addr.Unmap().WithZone("")
+	for _, prefix := range webhookDeniedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return addr.IsValid()
+}
+
+// newWebhookClient returns the client used for deliveries. Endpoint URLs
+// are chosen by users, so outside of dev it refuses to connect to the
+// addresses in webhookDeniedPrefixes, and it never follows redirects.
+func newWebhookClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: webhookRequestTimeout}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			addr, err := netip.ParseAddr(host)
+			if err != nil || !webhookAddressAllowed(addr) {
+				return errWebhookAddressNotAllowed
+			}
+			return nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   webhookRequestTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/ehumba/chirpy-web-server/internal/database"
+	"github.com/ehumba/chirpy-web-server/internal/mailer"
+)
+
+func TestWebhookAddressAllowed(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{addr: "93.184.216.34", want: true},
+		{addr: "8.8.8.8", want: true},
+		{addr: "2606:4700:4700::1111", want: true},
+		{addr: "::ffff:93.184.216.34", want: true},
+
+		{addr: "0.0.0.0", want: false},
+		{addr: "127.0.0.1", want: false},
+		{addr: "10.1.2.3", want: false},
+		{addr: "172.16.0.1", want: false},
+		{addr: "192.168.1.1", want: false},
+		{addr: "169.254.169.254", want: false},
+		// carrier-grade NAT
+		{addr: "100.64.0.1", want: false},
+		{addr: "100.127.255.254", want: false},
+		// benchmarking
+		{addr: "198.18.0.1", want: false},
+		{addr: "198.19.255.254", want: false},
+		{addr: "192.0.0.8", want: false},
+		{addr: "192.0.2.1", want: false},
+		{addr: "203.0.113.7", want: false},
+		{addr: "224.0.0.1", want: false},
+		{addr: "240.0.0.1", want: false},
+		{addr: "255.255.255.255", want: false},
+
+		{addr: "::", want: false},
+		{addr: "::1", want: false},
+		{addr: "::ffff:127.0.0.1", want: false},
+		{addr: "::ffff:100.64.0.1", want: false},
+		{addr: "64:ff9b::7f00:1", want: false},
+		{addr: "2001:db8::1", want: false},
+		{addr: "2001::1", want: false},
+		{addr: "2002:7f00:1::1", want: false},
+		{addr: "fd00::1", want: false},
+		{addr: "fe80::1", want: false},
+		{addr: "fe80::1%eth0", want: false},
+		{addr: "ff02::1", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			got := webhookAddressAllowed(netip.MustParseAddr(tt.addr))
+			if got != tt.want {
+				t.Errorf("webhookAddressAllowed(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDisableWebhookEndpointCancelsPendingDeliveries(t *testing.T) {
+	db, q := newTestDB(t)
+	a := &apiConfig{db: db, dbQueries: q, mailer: mailer.LogMailer{}}
+	ctx := context.Background()
+
+	alice := createTestUser(t, q, "alice@example.com")
+	endpoint, err := q.CreateWebhookEndpoint(ctx, database.CreateWebhookEndpointParams{
+		UserID: alice.ID,
+		Url:    "https://hooks.example.com/chirpy",
+		Secret: "whsec_test",
+		Events: []string{eventChirpCreated},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = q.CreateWebhookDelivery(ctx, database.CreateWebhookDeliveryParams{
+		EndpointID: endpoint.ID,
+		Event:      eventChirpCreated,
+		Payload:    `{}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.disableWebhookEndpoint(ctx, endpoint)
+
+	deliveries, err := q.GetWebhookDeliveries(ctx, endpoint.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(deliveries))
+	}
+	if deliveries[0].Status == webhookDeliveryStatusPending {
+		t.Error("delivery to the disabled endpoint is still pending")
+	}
+
+	endpoint, err = q.GetWebhookEndpoint(ctx, endpoint.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.Enabled {
+		t.Error("endpoint is still enabled")
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"time"
+
+	"github.com/ehumba/chirpy-web-server/internal/auth"
+	"github.com/ehumba/chirpy-web-server/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	ceremonyRegistration = "registration"
+	ceremonyLogin        = "login"
+	webAuthnTimeout      = 5 * time.Minute
+)
+
+type pubKeyCredParam struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type credentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+func (a *apiConfig) handlerBeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	caller := principalFromContext(r.Context())
+	if !requireSession(w, caller) {
+		return
+	}
+	userID := caller.UserID
+
+	userDB, err := a.dbQueries.LookUpByID(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, 404, "user not found")
+		return
+	}
+
+	credentials, err := a.dbQueries.GetWebAuthnCredentialsForUser(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, 500, "failed to get passkeys")
+		return
+	}
+
+	challenge, err := auth.MakeWebAuthnChallenge()
+	if err != nil {
+		respondWithError(w, 500, "failed to create challenge")
+		return
+	}
+
+	err = a.dbQueries.CreateWebAuthnChallenge(r.Context(), database.CreateWebAuthnChallengeParams{
+		Challenge: challenge,
+		UserID:    uuid.NullUUID{UUID: userID, Valid: true},
+		Ceremony:  ceremonyRegistration,
+		ExpiresAt: time.Now().Add(webAuthnTimeout),
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to save challenge")
+		return
+	}
+
+	// don't let the same authenticator register twice
+	exclude := []credentialDescriptor{}
+	for _, credential := range credentials {
+		exclude = append(exclude, credentialDescriptor{Type: "public-key", ID: credential.ID})
+	}
+
+	type rpEntity struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+
+	type userEntity struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	}
+
+	type authenticatorSelection struct {
+		ResidentKey      string `json:"residentKey"`
+		UserVerification string `json:"userVerification"`
+	}
+
+	type creationOptions struct {
+		Challenge              string                 `json:"challenge"`
+		RP                     rpEntity               `json:"rp"`
+		User                   userEntity             `json:"user"`
+		PubKeyCredParams       []pubKeyCredParam      `json:"pubKeyCredParams"`
+		Timeout                int64                  `json:"timeout"`
+		Attestation            string                 `json:"attestation"`
+		AuthenticatorSelection authenticatorSelection `json:"authenticatorSelection"`
+		ExcludeCredentials     []credentialDescriptor `json:"excludeCredentials"`
+	}
+
+	options := creationOptions{
+		Challenge: challenge,
+		RP: rpEntity{
+			ID:   a.webAuthn.RPID,
+			Name: a.webAuthn.RPName,
+		},
+		User: userEntity{
+			ID:          base64.RawURLEncoding.EncodeToString(userID[:]),
+			Name:        userDB.Email,
+			DisplayName: userDB.Email,
+		},
+		PubKeyCredParams: []pubKeyCredParam{
+			{Type: "public-key", Alg: auth.COSEAlgES256},
+			{Type: "public-key", Alg: auth.COSEAlgEdDSA},
+			{Type: "public-key", Alg: auth.COSEAlgRS256},
+		},
+		Timeout:     webAuthnTimeout.Milliseconds(),
+		Attestation: "none",
+		AuthenticatorSelection: authenticatorSelection{
+			ResidentKey:      "required",
+			UserVerification: "required",
+		},
+		ExcludeCredentials: exclude,
+	}
+
+	respondWithJSON(w, 200, map[string]creationOptions{"publicKey": options})
+}
+
+func (a *apiConfig) handlerFinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	caller := principalFromContext(r.Context())
+	if !requireSession(w, caller) {
+		return
+	}
+	userID := caller.UserID
+
+	type attestationResponse struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+	}
+
+	type reqParams struct {
+		Name     string              `json:"name"`
+		Response attestationResponse `json:"response"`
+	}
+
+	params := reqParams{}
+	err := decodeJSON(r, &params)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+
+	clientDataJSON, err := auth.DecodeBase64URL(params.Response.ClientDataJSON)
+	if err != nil {
+		respondWithError(w, 400, "invalid client data encoding")
+		return
+	}
+
+	attestationObject, err := auth.DecodeBase64URL(params.Response.AttestationObject)
+	if err != nil {
+		respondWithError(w, 400, "invalid attestation object encoding")
+		return
+	}
+
+	challenge, err := auth.ClientDataChallenge(clientDataJSON)
+	if err != nil {
+		respondWithError(w, 400, "invalid client data")
+		return
+	}
+
+	pending, err := a.dbQueries.ConsumeWebAuthnChallenge(r.Context(), database.ConsumeWebAuthnChallengeParams{
+		Challenge: challenge,
+		Ceremony:  ceremonyRegistration,
+	})
+	if err != nil || !pending.UserID.Valid || pending.UserID.UUID != userID {
+		respondWithError(w, 400, "invalid or expired challenge")
+		return
+	}
+
+	credential, err := a.webAuthn.VerifyRegistration(challenge, clientDataJSON, attestationObject)
+	if err != nil {
+		respondWithError(w, 400, "passkey registration failed")
+		return
+	}
+
+	name := params.Name
+	if name == "" {
+		name = "Passkey"
+	}
+
+	credentialDB, err := a.dbQueries.CreateWebAuthnCredential(r.Context(), database.CreateWebAuthnCredentialParams{
+		ID:        base64.RawURLEncoding.EncodeToString(credential.ID),
+		UserID:    userID,
+		Name:      name,
+		PublicKey: credential.PublicKey,
+		SignCount: int64(credential.SignCount),
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to save passkey")
+		return
+	}
+
+	respondWithJSON(w, 201, passkeyFromDB(credentialDB))
+}
+
+func (a *apiConfig) handlerGetPasskeys(w http.ResponseWriter, r *http.Request) {
+	caller := principalFromContext(r.Context())
+	if !requireSession(w, caller) {
+		return
+	}
+	userID := caller.UserID
+
+	credentials, err := a.dbQueries.GetWebAuthnCredentialsForUser(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, 500, "failed to get passkeys")
+		return
+	}
+
+	passkeys := []Passkey{}
+	for _, credential := range credentials {
+		passkeys = append(passkeys, passkeyFromDB(credential))
+	}
+
+	respondWithJSON(w, 200, passkeys)
+}
+
+func (a *apiConfig) handlerDeletePasskey(w http.ResponseWriter, r *http.Request) {
+	caller := principalFromContext(r.Context())
+	if !requireSession(w, caller) {
+		return
+	}
+	userID := caller.UserID
+
+	rows, err := a.dbQueries.DeleteWebAuthnCredential(r.Context(), database.DeleteWebAuthnCredentialParams{
+		ID:     r.PathValue("credentialID"),
+		UserID: userID,
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to delete passkey")
+		return
+	}
+	if rows == 0 {
+		respondWithError(w, 404, "passkey not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *apiConfig) handlerBeginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	challenge, err := auth.MakeWebAuthnChallenge()
+	if err != nil {
+		respondWithError(w, 500, "failed to create challenge")
+		return
+	}
+
+	err = a.dbQueries.CreateWebAuthnChallenge(r.Context(), database.CreateWebAuthnChallengeParams{
+		Challenge: challenge,
+		Ceremony:  ceremonyLogin,
+		ExpiresAt: time.Now().Add(webAuthnTimeout),
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to save challenge")
+		return
+	}
+
+	// passkeys are discoverable, so no allowCredentials list is needed
+	type requestOptions struct {
+		Challenge        string `json:"challenge"`
+		RPID             string `json:"rpId"`
+		Timeout          int64  `json:"timeout"`
+		UserVerification string `json:"userVerification"`
+	}
+
+	options := requestOptions{
+		Challenge:        challenge,
+		RPID:             a.webAuthn.RPID,
+		Timeout:          webAuthnTimeout.Milliseconds(),
+		UserVerification: "required",
+	}
+
+	respondWithJSON(w, 200, map[string]requestOptions{"publicKey": options})
+}
+
+func (a *apiConfig) handlerFinishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	type assertionResponse struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	}
+
+	type parameters struct {
+		ID       string            `json:"id"`
+		Response assertionResponse `json:"response"`
+	}
+
+	params := parameters{}
+	err := decodeJSON(r, &params)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+
+	clientDataJSON, err := auth.DecodeBase64URL(params.Response.ClientDataJSON)
+	if err != nil {
+		respondWithError(w, 400, "invalid client data encoding")
+		return
+	}
+
+	authenticatorData, err := auth.DecodeBase64URL(params.Response.AuthenticatorData)
+	if err != nil {
+		respondWithError(w, 400, "invalid authenticator data encoding")
+		return
+	}
+
+	signature, err := auth.DecodeBase64URL(params.Response.Signature)
+	if err != nil {
+		respondWithError(w, 400, "invalid signature encoding")
+		return
+	}
+
+	challenge, err := auth.ClientDataChallenge(clientDataJSON)
+	if err != nil {
+		respondWithError(w, 400, "invalid client data")
+		return
+	}
+
+	_, err = a.dbQueries.ConsumeWebAuthnChallenge(r.Context(), database.ConsumeWebAuthnChallengeParams{
+		Challenge: challenge,
+		Ceremony:  ceremonyLogin,
+	})
+	if err != nil {
+		respondWithError(w, 401, "invalid or expired challenge")
+		return
+	}
+
+	credential, err := a.dbQueries.GetWebAuthnCredential(r.Context(), params.ID)
+	if err != nil {
+		respondWithError(w, 401, "unknown passkey")
+		return
+	}
+
+	if params.Response.UserHandle != "" {
+		userHandle, err := auth.DecodeBase64URL(params.Response.UserHandle)
+		if err != nil || string(userHandle) != string(credential.UserID[:]) {
+			respondWithError(w, 401, "passkey does not belong to this user")
+			return
+		}
+	}
+
+	signCount, err := a.webAuthn.VerifyAssertion(
+		challenge,
+		credential.PublicKey,
+		uint32(credential.SignCount),
+		clientDataJSON,
+		authenticatorData,
+		signature,
+	)
+	if err != nil {
+		respondWithError(w, 401, "passkey verification failed")
+		return
+	}
+
+	err = a.dbQueries.UpdateWebAuthnSignCount(r.Context(), database.UpdateWebAuthnSignCountParams{
+		ID:        credential.ID,
+		SignCount: int64(signCount),
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to update passkey")
+		return
+	}
+
+	userDB, err := a.dbQueries.LookUpByID(r.Context(), credential.UserID)
+	if err != nil {
+		respondWithError(w, 500, "failed to look up user")
+		return
+	}
+
+	a.respondWithTokens(w, r, userDB)
+}
+
+func passkeyFromDB(credential database.WebauthnCredential) Passkey {
+	passkey := Passkey{
+		ID:        credential.ID,
+		CreatedAt: credential.CreatedAt,
+		Name:      credential.Name,
+	}
+	if credential.LastUsedAt.Valid {
+		passkey.LastUsedAt = &credential.LastUsedAt.Time
+	}
+	return passkey
+}
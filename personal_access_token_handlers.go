@@ -0,0 +1,152 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/ehumba/chirpy-web-server/internal/auth"
+	"github.com/ehumba/chirpy-web-server/internal/database"
+	"github.com/google/uuid"
+)
+
+func (a *apiConfig) handlerCreatePersonalAccessToken(w http.ResponseWriter, r *http.Request) {
+	caller := principalFromContext(r.Context())
+	if !requireSession(w, caller) {
+		return
+	}
+
+	type reqParams struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+
+	params := reqParams{}
+	err := decodeJSON(r, &params)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+
+	if params.Name == "" {
+		respondWithError(w, 400, "name is required")
+		return
+	}
+	if len(params.Scopes) == 0 {
+		respondWithError(w, 400, "at least one scope is required")
+		return
+	}
+	for _, scope := range params.Scopes {
+		if !auth.ValidScope(scope) {
+			respondWithError(w, 400, "unknown scope: "+scope)
+			return
+		}
+	}
+	if params.ExpiresInDays < 0 {
+		respondWithError(w, 400, "expires_in_days must not be negative")
+		return
+	}
+
+	// tokens without an expiry stay valid until they are revoked
+	expiresAt := sql.NullTime{}
+	if params.ExpiresInDays > 0 {
+		expiresAt = sql.NullTime{
+			Time:  time.Now().AddDate(0, 0, params.ExpiresInDays),
+			Valid: true,
+		}
+	}
+
+	patToken, err := auth.MakePersonalAccessToken()
+	if err != nil {
+		respondWithError(w, 500, "failed to create token")
+		return
+	}
+
+	patDB, err := a.dbQueries.CreatePersonalAccessToken(r.Context(), database.CreatePersonalAccessTokenParams{
+		UserID:    caller.UserID,
+		Name:      params.Name,
+		TokenHash: auth.HashPersonalAccessToken(patToken),
+		Scopes:    params.Scopes,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to save token")
+		return
+	}
+
+	// the token itself is only ever shown in this response
+	resStruct := struct {
+		PersonalAccessToken `json:",inline"`
+		Token               string `json:"token"`
+	}{
+		PersonalAccessToken: personalAccessTokenFromDB(patDB),
+		Token:               patToken,
+	}
+
+	respondWithJSON(w, 201, resStruct)
+}
+
+func (a *apiConfig) handlerGetPersonalAccessTokens(w http.ResponseWriter, r *http.Request) {
+	caller := principalFromContext(r.Context())
+	if !requireSession(w, caller) {
+		return
+	}
+
+	patsDB, err := a.dbQueries.GetPersonalAccessTokensForUser(r.Context(), caller.UserID)
+	if err != nil {
+		respondWithError(w, 500, "failed to get tokens")
+		return
+	}
+
+	pats := []PersonalAccessToken{}
+	for _, patDB := range patsDB {
+		pats = append(pats, personalAccessTokenFromDB(patDB))
+	}
+
+	respondWithJSON(w, 200, pats)
+}
+
+func (a *apiConfig) handlerRevokePersonalAccessToken(w http.ResponseWriter, r *http.Request) {
+	tokenID, err := uuid.Parse(r.PathValue("tokenID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid token ID format")
+		return
+	}
+
+	caller := principalFromContext(r.Context())
+	if !requireSession(w, caller) {
+		return
+	}
+
+	rows, err := a.dbQueries.RevokePersonalAccessToken(r.Context(), database.RevokePersonalAccessTokenParams{
+		ID:     tokenID,
+		UserID: caller.UserID,
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to revoke token")
+		return
+	}
+	if rows == 0 {
+		respondWithError(w, 404, "token not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func personalAccessTokenFromDB(patDB database.PersonalAccessToken) PersonalAccessToken {
+	pat := PersonalAccessToken{
+		ID:        patDB.ID,
+		CreatedAt: patDB.CreatedAt,
+		Name:      patDB.Name,
+		Scopes:    patDB.Scopes,
+	}
+	if patDB.ExpiresAt.Valid {
+		pat.ExpiresAt = &patDB.ExpiresAt.Time
+	}
+	if patDB.LastUsedAt.Valid {
+		pat.LastUsedAt = &patDB.LastUsedAt.Time
+	}
+	return pat
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/ehumba/chirpy-web-server/internal/auth"
+	"github.com/ehumba/chirpy-web-server/internal/database"
+)
+
+func (a *apiConfig) handlerGetPolkaEvents(w http.ResponseWriter, r *http.Request) {
+	caller := principalFromContext(r.Context())
+	if !caller.HasRole(auth.RoleAdmin) {
+		respondWithError(w, 403, "you don't have access to this endpoint")
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", polkaEventPending, polkaEventProcessed, polkaEventIgnored, polkaEventFailed:
+	default:
+		respondWithError(w, 400, "invalid status")
+		return
+	}
+
+	eventsDB, err := a.dbQueries.GetPolkaEvents(r.Context(), status)
+	if err != nil {
+		respondWithError(w, 500, "failed to get events")
+		return
+	}
+
+	events := []PolkaEvent{}
+	for _, eventDB := range eventsDB {
+		events = append(events, polkaEventFromDB(eventDB))
+	}
+
+	respondWithJSON(w, 200, events)
+}
+
+func (a *apiConfig) handlerGetPolkaEvent(w http.ResponseWriter, r *http.Request) {
+	caller := principalFromContext(r.Context())
+	if !caller.HasRole(auth.RoleAdmin) {
+		respondWithError(w, 403, "you don't have access to this endpoint")
+		return
+	}
+
+	eventDB, err := a.dbQueries.GetPolkaEvent(r.Context(), r.PathValue("eventID"))
+	if err != nil {
+		respondWithError(w, 404, "event not found")
+		return
+	}
+
+	respondWithJSON(w, 200, polkaEventFromDB(eventDB))
+}
+
+// handlerReplayPolkaEvent queues a failed event to be applied again, for
+// example after the user it belongs to was restored.
+func (a *apiConfig) handlerReplayPolkaEvent(w http.ResponseWriter, r *http.Request) {
+	caller := principalFromContext(r.Context())
+	if !caller.HasRole(auth.RoleAdmin) {
+		respondWithError(w, 403, "you don't have access to this endpoint")
+		return
+	}
+
+	eventID := r.PathValue("eventID")
+	eventDB, err := a.dbQueries.GetPolkaEvent(r.Context(), eventID)
+	if err != nil {
+		respondWithError(w, 404, "event not found")
+		return
+	}
+
+	// replaying an applied event would apply it twice, e.g. extend a
+	// subscription by two periods
+	rows, err := a.dbQueries.ReplayPolkaEvent(r.Context(), eventID)
+	if err != nil {
+		respondWithError(w, 500, "failed to replay event")
+		return
+	}
+	if rows == 0 {
+		respondWithError(w, 409, "only failed events can be replayed, this one is "+eventDB.Status)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func polkaEventFromDB(eventDB database.PolkaEvent) PolkaEvent {
+	event := PolkaEvent{
+		ID:         eventDB.ID,
+		Event:      eventDB.Event,
+		ReceivedAt: eventDB.ReceivedAt,
+		Status:     eventDB.Status,
+		Attempts:   eventDB.Attempts,
+		LastError:  eventDB.LastError.String,
+	}
+	if eventDB.Status == polkaEventPending {
+		event.NextAttemptAt = &eventDB.NextAttemptAt
+	}
+	if eventDB.ProcessedAt.Valid {
+		event.ProcessedAt = &eventDB.ProcessedAt.Time
+	}
+	// events received before the inbox existed have no payload
+	if eventDB.Payload.Valid && json.Valid([]byte(eventDB.Payload.String)) {
+		event.Payload = json.RawMessage(eventDB.Payload.String)
+	}
+	return event
+}
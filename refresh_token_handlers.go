@@ -2,15 +2,14 @@ package main
 
 import (
 	"net/http"
-	"time"
 
 	"github.com/ehumba/chirpy-web-server/internal/auth"
+	"github.com/ehumba/chirpy-web-server/internal/database"
 )
 
 func (a *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, 401, "no authorization header")
+	token, fromCookie, ok := a.refreshTokenFromRequest(w, r)
+	if !ok {
 		return
 	}
 
@@ -20,12 +19,18 @@ func (a *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	authToken, err := auth.MakeJWT(refreshTokenDB.UserID, a.secret, time.Hour)
+	authToken, err := a.makeAccessToken(r.Context(), refreshTokenDB.UserID)
 	if err != nil {
 		respondWithError(w, 401, "unable to create authentication token")
 		return
 	}
 
+	if fromCookie {
+		a.setAccessCookie(w, authToken)
+		w.WriteHeader(204)
+		return
+	}
+
 	resStruct := struct {
 		Token string `json:"token"`
 	}{
@@ -36,17 +41,63 @@ func (a *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *apiConfig) handlerRevoke(w http.ResponseWriter, r *http.Request) {
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, 401, "no authorization header")
+	token, fromCookie, ok := a.refreshTokenFromRequest(w, r)
+	if !ok {
 		return
 	}
 
-	err = a.dbQueries.RevokeRefreshToken(r.Context(), token)
+	err := a.dbQueries.RevokeRefreshToken(r.Context(), token)
 	if err != nil {
 		respondWithError(w, 500, "failed to revoke refresh token")
 		return
 	}
 
+	// optionally revoke the current access token as well, e.g. on logout
+	type reqParams struct {
+		AccessToken string `json:"access_token"`
+	}
+
+	params := reqParams{}
+	if r.ContentLength != 0 {
+		err = decodeJSON(r, &params)
+		if err != nil {
+			respondWithAPIError(w, err)
+			return
+		}
+	}
+
+	// logging out of a browser session also ends its access token, unless
+	// it has expired already
+	if fromCookie {
+		accessToken := a.sessionCookie(r, accessCookieName)
+		if _, err := auth.ValidateJWT(accessToken, a.tokens); err == nil {
+			params.AccessToken = accessToken
+		}
+		a.clearSessionCookies(w)
+	}
+
+	if params.AccessToken != "" {
+		claims, err := auth.ValidateJWT(params.AccessToken, a.tokens)
+		if err != nil {
+			respondWithError(w, 400, "invalid access token")
+			return
+		}
+
+		err = a.dbQueries.RevokeAccessToken(r.Context(), database.RevokeAccessTokenParams{
+			Jti:       claims.ID,
+			ExpiresAt: claims.ExpiresAt.Time,
+		})
+		if err != nil {
+			respondWithError(w, 500, "failed to revoke access token")
+			return
+		}
+
+		err = a.dbQueries.DeleteExpiredRevokedAccessTokens(r.Context())
+		if err != nil {
+			respondWithError(w, 500, "failed to clean up revoked access tokens")
+			return
+		}
+	}
+
 	w.WriteHeader(204)
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/ehumba/chirpy-web-server/internal/auth"
+)
+
+const (
+	accessCookieName  = "chirpy_access"
+	refreshCookieName = "chirpy_refresh"
+	csrfCookieName    = "chirpy_csrf"
+	csrfHeaderName    = "X-CSRF-Token"
+)
+
+// setSessionCookies stores the tokens of a browser session in cookies. The
+// token cookies are HttpOnly so scripts can't read them; the CSRF cookie is
+// not, because the app has to echo it back in the X-CSRF-Token header.
+func (a *apiConfig) setSessionCookies(w http.ResponseWriter, accessToken, refreshToken, csrfToken string) {
+	a.setAccessCookie(w, accessToken)
+	a.setRefreshCookie(w, refreshToken)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    csrfToken,
+		Path:     "/",
+		MaxAge:   int(a.tokens.RefreshTokenTTL.Seconds()),
+		Secure:   a.cookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (a *apiConfig) setRefreshCookie(w http.ResponseWriter, refreshToken string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookieName,
+		Value:    refreshToken,
+		Path:     "/api",
+		MaxAge:   int(a.tokens.RefreshTokenTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   a.cookieSecure,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func (a *apiConfig) setAccessCookie(w http.ResponseWriter, accessToken string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     accessCookieName,
+		Value:    accessToken,
+		Path:     "/",
+		MaxAge:   int(a.tokens.AccessTokenTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   a.cookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (a *apiConfig) clearSessionCookies(w http.ResponseWriter) {
+	for name, path := range map[string]string{
+		accessCookieName:  "/",
+		refreshCookieName: "/api",
+		csrfCookieName:    "/",
+	} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Path:     path,
+			MaxAge:   -1,
+			HttpOnly: name != csrfCookieName,
+			Secure:   a.cookieSecure,
+		})
+	}
+}
+
+// sessionCookie returns the value of a session cookie, or "" if cookie
+// sessions are disabled or the cookie was not sent.
+func (a *apiConfig) sessionCookie(r *http.Request, name string) string {
+	if !a.cookieSessions {
+		return ""
+	}
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// validCSRF implements the double-submit check: requests that change state
+// must repeat the value of the CSRF cookie in the X-CSRF-Token header. Other
+// sites can make the browser send the cookie, but they can't read it.
+func validCSRF(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	cookie, err := r.Cookie(csrfCookieName)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	header := r.Header.Get(csrfHeaderName)
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) == 1
+}
+
+// refreshTokenFromRequest reads the refresh token from the Authorization
+// header or, for browser sessions, from the refresh cookie. It writes the
+// error response itself and returns ok=false if there is no usable token.
+func (a *apiConfig) refreshTokenFromRequest(w http.ResponseWriter, r *http.Request) (token string, fromCookie bool, ok bool) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err == nil {
+		return token, false, true
+	}
+
+	token = a.sessionCookie(r, refreshCookieName)
+	if token == "" {
+		respondWithError(w, 401, "no authorization header")
+		return "", false, false
+	}
+	if !validCSRF(r) {
+		respondWithError(w, 403, "invalid csrf token")
+		return "", false, false
+	}
+	return token, true, true
+}
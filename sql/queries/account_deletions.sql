@@ -0,0 +1,27 @@
+-- name: ScheduleAccountDeletion :one
+INSERT INTO account_deletions(user_id, requested_at, purge_after)
+VALUES(
+    $1,
+    NOW(),
+    $2
+)
+ON CONFLICT (user_id) DO UPDATE
+SET purge_after = account_deletions.purge_after
+RETURNING *;
+
+-- name: CancelAccountDeletion :execrows
+DELETE FROM account_deletions
+WHERE user_id = $1;
+
+-- name: IsAccountPendingDeletion :one
+SELECT EXISTS(
+    SELECT 1 FROM account_deletions
+    WHERE user_id = $1
+);
+
+-- name: PurgeDeletedAccounts :execrows
+DELETE FROM users
+WHERE id IN (
+    SELECT user_id FROM account_deletions
+    WHERE purge_after <= NOW()
+);
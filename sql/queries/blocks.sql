@@ -0,0 +1,25 @@
+-- name: BlockUser :exec
+INSERT INTO blocks(blocker_id, blocked_id, created_at)
+VALUES(
+    $1,
+    $2,
+    NOW()
+)
+ON CONFLICT (blocker_id, blocked_id) DO NOTHING;
+
+-- name: UnblockUser :exec
+DELETE FROM blocks
+WHERE blocker_id = $1
+AND blocked_id = $2;
+
+-- name: GetBlockedUsers :many
+SELECT * FROM blocks
+WHERE blocker_id = $1
+ORDER BY created_at DESC;
+
+-- name: HasBlockBetween :one
+SELECT EXISTS(
+    SELECT 1 FROM blocks
+    WHERE (blocker_id = sqlc.arg(user_id) AND blocked_id = ANY(sqlc.arg(other_ids)::UUID[]))
+    OR (blocked_id = sqlc.arg(user_id) AND blocker_id = ANY(sqlc.arg(other_ids)::UUID[]))
+);
@@ -25,4 +25,16 @@ WHERE id = $1;
 
 -- name: DeleteChirp :exec
 DELETE FROM chirps
-WHERE id = $1;
\ No newline at end of file
+WHERE id = $1;
+
+-- name: UpdateChirpBody :one
+UPDATE chirps
+SET body = $2,
+updated_at = NOW()
+WHERE id = $1
+RETURNING *;
+
+-- name: CountChirpsSince :one
+SELECT COUNT(*) FROM chirps
+WHERE user_id = $1
+AND created_at > $2;
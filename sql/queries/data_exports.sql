@@ -0,0 +1,48 @@
+-- name: CreateDataExport :one
+INSERT INTO data_exports(id, created_at, updated_at, user_id, include_html, status, archive, expires_at)
+VALUES(
+    gen_random_uuid(),
+    NOW(),
+    NOW(),
+    $1,
+    $2,
+    'pending',
+    NULL,
+    $3
+)
+RETURNING *;
+
+-- name: GetDataExport :one
+SELECT * FROM data_exports
+WHERE id = $1
+AND expires_at > NOW();
+
+-- name: ClaimPendingDataExport :one
+UPDATE data_exports
+SET status = 'running',
+updated_at = NOW()
+WHERE id = (
+    SELECT id FROM data_exports
+    WHERE status = 'pending'
+    ORDER BY created_at ASC
+    LIMIT 1
+    FOR UPDATE SKIP LOCKED
+)
+RETURNING *;
+
+-- name: CompleteDataExport :exec
+UPDATE data_exports
+SET status = 'ready',
+archive = $2,
+updated_at = NOW()
+WHERE id = $1;
+
+-- name: FailDataExport :exec
+UPDATE data_exports
+SET status = 'failed',
+updated_at = NOW()
+WHERE id = $1;
+
+-- name: DeleteExpiredDataExports :exec
+DELETE FROM data_exports
+WHERE expires_at <= NOW();
@@ -0,0 +1,119 @@
+-- name: CreateConversation :one
+INSERT INTO conversations(id, created_at, updated_at, profanity_filter, last_message_at)
+VALUES(
+    gen_random_uuid(),
+    NOW(),
+    NOW(),
+    $1,
+    NULL
+)
+RETURNING *;
+
+-- name: AddConversationParticipant :exec
+INSERT INTO conversation_participants(conversation_id, user_id, joined_at, last_read_at, muted)
+VALUES(
+    $1,
+    $2,
+    NOW(),
+    NULL,
+    FALSE
+);
+
+-- name: GetDirectConversation :one
+SELECT * FROM conversations
+WHERE id IN (
+    SELECT conversation_id FROM conversation_participants
+    GROUP BY conversation_id
+    HAVING COUNT(*) = 2
+    AND bool_or(user_id = sqlc.arg(user_id))
+    AND bool_or(user_id = sqlc.arg(other_id))
+)
+LIMIT 1;
+
+-- name: GetConversationForUser :one
+SELECT conversations.*, conversation_participants.muted, conversation_participants.last_read_at,
+(
+    SELECT COUNT(*) FROM messages
+    WHERE messages.conversation_id = conversations.id
+    AND messages.sender_id <> conversation_participants.user_id
+    AND messages.created_at > COALESCE(conversation_participants.last_read_at, '-infinity')
+) AS unread_count
+FROM conversations
+JOIN conversation_participants ON conversation_participants.conversation_id = conversations.id
+WHERE conversations.id = $1
+AND conversation_participants.user_id = $2;
+
+-- name: GetConversationsForUser :many
+SELECT conversations.*, conversation_participants.muted, conversation_participants.last_read_at,
+(
+    SELECT COUNT(*) FROM messages
+    WHERE messages.conversation_id = conversations.id
+    AND messages.sender_id <> conversation_participants.user_id
+    AND messages.created_at > COALESCE(conversation_participants.last_read_at, '-infinity')
+) AS unread_count
+FROM conversations
+JOIN conversation_participants ON conversation_participants.conversation_id = conversations.id
+WHERE conversation_participants.user_id = $1
+ORDER BY COALESCE(conversations.last_message_at, conversations.created_at) DESC;
+
+-- name: GetConversationParticipants :many
+SELECT * FROM conversation_participants
+WHERE conversation_id = $1
+ORDER BY joined_at ASC, user_id ASC;
+
+-- name: GetParticipantsOfUserConversations :many
+SELECT * FROM conversation_participants
+WHERE conversation_id IN (
+    SELECT own.conversation_id FROM conversation_participants AS own
+    WHERE own.user_id = $1
+)
+ORDER BY joined_at ASC, user_id ASC;
+
+-- name: SetConversationProfanityFilter :exec
+UPDATE conversations
+SET profanity_filter = $2,
+updated_at = NOW()
+WHERE id = $1;
+
+-- name: SetConversationMuted :exec
+UPDATE conversation_participants
+SET muted = $3
+WHERE conversation_id = $1
+AND user_id = $2;
+
+-- name: MarkConversationRead :exec
+UPDATE conversation_participants
+SET last_read_at = NOW()
+WHERE conversation_id = $1
+AND user_id = $2;
+
+-- name: CreateMessage :one
+INSERT INTO messages(id, created_at, conversation_id, sender_id, body)
+VALUES(
+    gen_random_uuid(),
+    NOW(),
+    $1,
+    $2,
+    $3
+)
+RETURNING *;
+
+-- name: SetConversationLastMessageAt :exec
+UPDATE conversations
+SET last_message_at = $2
+WHERE id = $1;
+
+-- name: GetMessages :many
+SELECT * FROM messages
+WHERE conversation_id = $1
+AND (created_at, id) < (sqlc.arg(before_created_at)::TIMESTAMP, sqlc.arg(before_id)::UUID)
+ORDER BY created_at DESC, id DESC
+LIMIT sqlc.arg(max_messages);
+
+-- name: GetMessagesForUser :many
+SELECT * FROM messages
+WHERE conversation_id IN (
+    SELECT conversation_id FROM conversation_participants
+    WHERE user_id = $1
+)
+ORDER BY created_at ASC, id ASC;
@@ -0,0 +1,28 @@
+-- name: GetLoginFailure :one
+SELECT * FROM login_failures
+WHERE key = $1;
+
+-- name: RecordLoginFailure :one
+INSERT INTO login_failures(key, failed_attempts, last_failed_at, locked_until)
+VALUES(
+    $1,
+    1,
+    NOW(),
+    NULL
+)
+ON CONFLICT (key) DO UPDATE
+SET failed_attempts = CASE
+    WHEN login_failures.last_failed_at < NOW() - INTERVAL '24 hours' THEN 1
+    ELSE login_failures.failed_attempts + 1
+END,
+last_failed_at = NOW()
+RETURNING *;
+
+-- name: LockLogin :exec
+UPDATE login_failures
+SET locked_until = $2
+WHERE key = $1;
+
+-- name: ClearLoginFailures :exec
+DELETE FROM login_failures
+WHERE key = $1;
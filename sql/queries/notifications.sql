@@ -0,0 +1,58 @@
+-- name: UpsertNotification :one
+INSERT INTO notifications(id, created_at, updated_at, user_id, type, group_key, chirp_id, conversation_id, actor_ids, actor_count, read_at)
+VALUES(
+    gen_random_uuid(),
+    NOW(),
+    NOW(),
+    $1,
+    $2,
+    $3,
+    $4,
+    $5,
+    ARRAY[sqlc.arg(actor_id)::UUID],
+    1,
+    NULL
+)
+ON CONFLICT (user_id, group_key) WHERE read_at IS NULL DO UPDATE
+SET actor_ids = ARRAY[EXCLUDED.actor_ids[1]] || array_remove(notifications.actor_ids, EXCLUDED.actor_ids[1]),
+actor_count = cardinality(array_remove(notifications.actor_ids, EXCLUDED.actor_ids[1])) + 1,
+chirp_id = EXCLUDED.chirp_id,
+updated_at = NOW()
+RETURNING *;
+
+-- name: GetNotifications :many
+SELECT * FROM notifications
+WHERE user_id = $1
+AND (NOT sqlc.arg(unread_only)::BOOLEAN OR read_at IS NULL)
+AND (updated_at, id) < (sqlc.arg(before_updated_at)::TIMESTAMP, sqlc.arg(before_id)::UUID)
+ORDER BY updated_at DESC, id DESC
+LIMIT sqlc.arg(max_notifications);
+
+-- name: GetNotificationsForUser :many
+SELECT * FROM notifications
+WHERE user_id = $1
+ORDER BY updated_at DESC, id DESC;
+
+-- name: CountUnreadNotifications :one
+SELECT COUNT(*) FROM notifications
+WHERE user_id = $1
+AND read_at IS NULL;
+
+-- name: MarkNotificationRead :execrows
+UPDATE notifications
+SET read_at = COALESCE(read_at, NOW())
+WHERE id = $1
+AND user_id = $2;
+
+-- name: MarkAllNotificationsRead :exec
+UPDATE notifications
+SET read_at = NOW()
+WHERE user_id = $1
+AND read_at IS NULL;
+
+-- name: MarkConversationNotificationsRead :exec
+UPDATE notifications
+SET read_at = NOW()
+WHERE user_id = $1
+AND conversation_id = $2
+AND read_at IS NULL;
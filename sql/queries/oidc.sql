@@ -0,0 +1,60 @@
+-- name: CreateOIDCLoginState :exec
+INSERT INTO oidc_login_states(state, created_at, nonce, code_verifier, expires_at, user_id)
+VALUES(
+    $1,
+    NOW(),
+    $2,
+    $3,
+    $4,
+    $5
+);
+
+-- name: ConsumeOIDCLoginState :one
+DELETE FROM oidc_login_states
+WHERE state = $1
+AND expires_at > NOW()
+RETURNING *;
+
+-- name: GetUserIdentity :one
+SELECT * FROM user_identities
+WHERE issuer = $1
+AND subject = $2;
+
+-- name: CreateUserIdentity :one
+INSERT INTO user_identities(id, created_at, updated_at, user_id, issuer, subject, email)
+VALUES(
+    gen_random_uuid(),
+    NOW(),
+    NOW(),
+    $1,
+    $2,
+    $3,
+    $4
+)
+RETURNING *;
+
+-- name: GetUserIdentitiesForUser :many
+SELECT * FROM user_identities
+WHERE user_id = $1
+ORDER BY created_at ASC;
+
+-- name: CreateOIDCPendingLink :exec
+INSERT INTO oidc_pending_links(token_hash, created_at, user_id, issuer, subject, email, expires_at)
+VALUES(
+    $1,
+    NOW(),
+    $2,
+    $3,
+    $4,
+    $5,
+    $6
+);
+
+-- name: GetOIDCPendingLink :one
+SELECT * FROM oidc_pending_links
+WHERE token_hash = $1
+AND expires_at > NOW();
+
+-- name: DeleteOIDCPendingLink :exec
+DELETE FROM oidc_pending_links
+WHERE token_hash = $1;
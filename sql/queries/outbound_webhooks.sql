@@ -0,0 +1,125 @@
+-- name: CreateWebhookEndpoint :one
+INSERT INTO webhook_endpoints(id, created_at, updated_at, user_id, url, secret, events, enabled, consecutive_failures, disabled_at)
+VALUES(
+    gen_random_uuid(),
+    NOW(),
+    NOW(),
+    $1,
+    $2,
+    $3,
+    $4,
+    TRUE,
+    0,
+    NULL
+)
+RETURNING *;
+
+-- name: GetWebhookEndpoint :one
+SELECT * FROM webhook_endpoints
+WHERE id = $1;
+
+-- name: GetWebhookEndpointsForUser :many
+SELECT * FROM webhook_endpoints
+WHERE user_id = $1
+ORDER BY created_at ASC;
+
+-- name: GetSubscribedWebhookEndpoints :many
+SELECT * FROM webhook_endpoints
+WHERE user_id = $1
+AND enabled = TRUE
+AND sqlc.arg(event)::TEXT = ANY(events);
+
+-- name: DeleteWebhookEndpoint :execrows
+DELETE FROM webhook_endpoints
+WHERE id = $1
+AND user_id = $2;
+
+-- name: EnableWebhookEndpoint :execrows
+UPDATE webhook_endpoints
+SET enabled = TRUE,
+consecutive_failures = 0,
+disabled_at = NULL,
+updated_at = NOW()
+WHERE id = $1
+AND user_id = $2;
+
+-- name: DisableWebhookEndpoint :exec
+UPDATE webhook_endpoints
+SET enabled = FALSE,
+disabled_at = NOW(),
+updated_at = NOW()
+WHERE id = $1;
+
+-- name: CancelPendingWebhookDeliveries :exec
+UPDATE webhook_deliveries
+SET status = 'canceled',
+last_error = 'endpoint was disabled',
+updated_at = NOW()
+WHERE endpoint_id = $1
+AND status = 'pending';
+
+-- name: RecordWebhookEndpointFailure :one
+UPDATE webhook_endpoints
+SET consecutive_failures = consecutive_failures + 1,
+updated_at = NOW()
+WHERE id = $1
+RETURNING consecutive_failures;
+
+-- name: ResetWebhookEndpointFailures :exec
+UPDATE webhook_endpoints
+SET consecutive_failures = 0,
+updated_at = NOW()
+WHERE id = $1
+AND consecutive_failures > 0;
+
+-- name: CreateWebhookDelivery :exec
+INSERT INTO webhook_deliveries(id, created_at, updated_at, endpoint_id, event, payload, status, attempts, next_attempt_at)
+VALUES(
+    gen_random_uuid(),
+    NOW(),
+    NOW(),
+    $1,
+    $2,
+    $3,
+    'pending',
+    0,
+    NOW()
+);
+
+-- name: ClaimDueWebhookDeliveries :many
+UPDATE webhook_deliveries
+SET next_attempt_at = sqlc.arg(lease_until),
+updated_at = NOW()
+WHERE id IN (
+    SELECT webhook_deliveries.id FROM webhook_deliveries
+    JOIN webhook_endpoints ON webhook_endpoints.id = webhook_deliveries.endpoint_id
+    WHERE webhook_deliveries.status = 'pending'
+    AND webhook_deliveries.next_attempt_at <= NOW()
+    AND webhook_endpoints.enabled = TRUE
+    ORDER BY webhook_deliveries.next_attempt_at ASC
+    LIMIT sqlc.arg(max_deliveries)
+    FOR UPDATE OF webhook_deliveries SKIP LOCKED
+)
+RETURNING *;
+
+-- name: RecordWebhookDeliveryAttempt :exec
+UPDATE webhook_deliveries
+SET status = $2,
+attempts = attempts + 1,
+next_attempt_at = $3,
+last_attempt_at = NOW(),
+response_status = $4,
+last_error = $5,
+updated_at = NOW()
+WHERE id = $1;
+
+-- name: GetWebhookDeliveries :many
+SELECT * FROM webhook_deliveries
+WHERE endpoint_id = $1
+ORDER BY created_at DESC
+LIMIT 100;
+
+-- name: DeleteOldWebhookDeliveries :exec
+DELETE FROM webhook_deliveries
+WHERE status <> 'pending'
+AND created_at < $1;
@@ -0,0 +1,50 @@
+-- name: CreateOutboxEvent :exec
+INSERT INTO outbox_events(created_at, event_type, user_id, payload, status, attempts, next_attempt_at)
+VALUES(
+    NOW(),
+    $1,
+    $2,
+    $3,
+    'pending',
+    0,
+    NOW()
+);
+
+-- name: ClaimPendingOutboxEvent :one
+SELECT * FROM outbox_events
+WHERE status = 'pending'
+AND next_attempt_at <= NOW()
+ORDER BY id ASC
+LIMIT 1
+FOR UPDATE SKIP LOCKED;
+
+-- name: MarkOutboxEventDispatched :one
+UPDATE outbox_events
+SET status = 'dispatched',
+attempts = attempts + 1,
+dispatched_at = NOW(),
+dispatch_seq = nextval('outbox_dispatch_seq'),
+last_error = NULL
+WHERE id = $1
+RETURNING dispatch_seq;
+
+-- name: RecordOutboxEventFailure :exec
+UPDATE outbox_events
+SET status = $2,
+attempts = attempts + 1,
+next_attempt_at = $3,
+last_error = $4
+WHERE id = $1;
+
+-- name: DeleteOldOutboxEvents :exec
+DELETE FROM outbox_events
+WHERE status <> 'pending'
+AND created_at < $1;
+
+-- name: GetDispatchedOutboxEventsAfter :many
+SELECT * FROM outbox_events
+WHERE dispatch_seq > sqlc.arg(after_seq)::BIGINT
+AND status = 'dispatched'
+AND event_type = ANY(sqlc.arg(event_types)::TEXT[])
+ORDER BY dispatch_seq ASC
+LIMIT sqlc.arg(max_events);
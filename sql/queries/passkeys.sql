@@ -0,0 +1,51 @@
+-- name: CreateWebAuthnChallenge :exec
+INSERT INTO webauthn_challenges(challenge, created_at, user_id, ceremony, expires_at)
+VALUES(
+    $1,
+    NOW(),
+    $2,
+    $3,
+    $4
+);
+
+-- name: ConsumeWebAuthnChallenge :one
+DELETE FROM webauthn_challenges
+WHERE challenge = $1
+AND ceremony = $2
+AND expires_at > NOW()
+RETURNING *;
+
+-- name: CreateWebAuthnCredential :one
+INSERT INTO webauthn_credentials(id, created_at, updated_at, user_id, name, public_key, sign_count, last_used_at)
+VALUES(
+    $1,
+    NOW(),
+    NOW(),
+    $2,
+    $3,
+    $4,
+    $5,
+    NULL
+)
+RETURNING *;
+
+-- name: GetWebAuthnCredential :one
+SELECT * FROM webauthn_credentials
+WHERE id = $1;
+
+-- name: GetWebAuthnCredentialsForUser :many
+SELECT * FROM webauthn_credentials
+WHERE user_id = $1
+ORDER BY created_at ASC;
+
+-- name: UpdateWebAuthnSignCount :exec
+UPDATE webauthn_credentials
+SET sign_count = $2,
+last_used_at = NOW(),
+updated_at = NOW()
+WHERE id = $1;
+
+-- name: DeleteWebAuthnCredential :execrows
+DELETE FROM webauthn_credentials
+WHERE id = $1
+AND user_id = $2;
@@ -0,0 +1,55 @@
+-- name: RecordPolkaEvent :execrows
+INSERT INTO polka_events(id, event, received_at, payload, status, attempts, next_attempt_at)
+VALUES(
+    $1,
+    $2,
+    NOW(),
+    $3,
+    $4,
+    0,
+    NOW()
+)
+ON CONFLICT (id) DO NOTHING;
+
+-- name: ClaimPendingPolkaEvent :one
+SELECT * FROM polka_events
+WHERE status = 'pending'
+AND next_attempt_at <= NOW()
+ORDER BY received_at ASC
+LIMIT 1
+FOR UPDATE SKIP LOCKED;
+
+-- name: MarkPolkaEventProcessed :exec
+UPDATE polka_events
+SET status = 'processed',
+attempts = attempts + 1,
+processed_at = NOW(),
+last_error = NULL
+WHERE id = $1;
+
+-- name: RecordPolkaEventFailure :exec
+UPDATE polka_events
+SET status = $2,
+attempts = attempts + 1,
+next_attempt_at = $3,
+last_error = $4
+WHERE id = $1;
+
+-- name: GetPolkaEvent :one
+SELECT * FROM polka_events
+WHERE id = $1;
+
+-- name: GetPolkaEvents :many
+SELECT * FROM polka_events
+WHERE sqlc.arg(status)::TEXT = '' OR status = sqlc.arg(status)::TEXT
+ORDER BY received_at DESC
+LIMIT 100;
+
+-- name: ReplayPolkaEvent :execrows
+UPDATE polka_events
+SET status = 'pending',
+attempts = 0,
+next_attempt_at = NOW(),
+last_error = NULL
+WHERE id = $1
+AND status = 'failed';
@@ -21,4 +21,16 @@ AND expires_at > NOW();
 UPDATE refresh_tokens
 SET updated_at = NOW(),
 revoked_at = NOW()
-WHERE token = $1;
\ No newline at end of file
+WHERE token = $1;
+
+-- name: RevokeRefreshTokensForUser :exec
+UPDATE refresh_tokens
+SET updated_at = NOW(),
+revoked_at = NOW()
+WHERE user_id = $1
+AND revoked_at IS NULL;
+
+-- name: GetRefreshTokensForUser :many
+SELECT * FROM refresh_tokens
+WHERE user_id = $1
+ORDER BY created_at ASC;
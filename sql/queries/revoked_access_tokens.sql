@@ -0,0 +1,18 @@
+-- name: RevokeAccessToken :exec
+INSERT INTO revoked_access_tokens(jti, revoked_at, expires_at)
+VALUES(
+    $1,
+    NOW(),
+    $2
+)
+ON CONFLICT DO NOTHING;
+
+-- name: IsAccessTokenRevoked :one
+SELECT EXISTS(
+    SELECT 1 FROM revoked_access_tokens
+    WHERE jti = $1
+);
+
+-- name: DeleteExpiredRevokedAccessTokens :exec
+DELETE FROM revoked_access_tokens
+WHERE expires_at < NOW();
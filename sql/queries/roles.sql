@@ -0,0 +1,13 @@
+-- name: GetUserRoles :many
+SELECT role FROM user_roles
+WHERE user_id = $1
+ORDER BY role ASC;
+
+-- name: AddUserRole :exec
+INSERT INTO user_roles(user_id, role, created_at)
+VALUES(
+    $1,
+    $2,
+    NOW()
+)
+ON CONFLICT DO NOTHING;
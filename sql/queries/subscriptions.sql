@@ -0,0 +1,65 @@
+-- name: GetSubscription :one
+SELECT * FROM subscriptions
+WHERE user_id = $1;
+
+-- name: UpsertSubscription :one
+INSERT INTO subscriptions(user_id, created_at, updated_at, plan, status, current_period_start, current_period_end)
+VALUES(
+    $1,
+    NOW(),
+    NOW(),
+    $2,
+    $3,
+    $4,
+    $5
+)
+ON CONFLICT (user_id) DO UPDATE
+SET updated_at = NOW(),
+plan = EXCLUDED.plan,
+status = EXCLUDED.status,
+current_period_start = EXCLUDED.current_period_start,
+current_period_end = EXCLUDED.current_period_end
+RETURNING *;
+
+-- name: CreateSubscriptionHistory :exec
+INSERT INTO subscription_history(id, created_at, user_id, event, polka_event_id, plan, status, current_period_start, current_period_end)
+VALUES(
+    gen_random_uuid(),
+    NOW(),
+    $1,
+    $2,
+    $3,
+    $4,
+    $5,
+    $6,
+    $7
+);
+
+-- name: GetSubscriptionHistory :many
+SELECT * FROM subscription_history
+WHERE user_id = $1
+ORDER BY created_at ASC;
+
+-- name: SyncChirpyRed :exec
+UPDATE users
+SET is_chirpy_red = EXISTS(
+    SELECT 1 FROM subscriptions
+    WHERE subscriptions.user_id = users.id
+    AND subscriptions.status IN ('active', 'past_due', 'canceled')
+    AND subscriptions.current_period_end > NOW()
+),
+updated_at = NOW()
+WHERE id = $1;
+
+-- name: ExpireChirpyRed :many
+UPDATE users
+SET is_chirpy_red = FALSE,
+updated_at = NOW()
+WHERE is_chirpy_red = TRUE
+AND NOT EXISTS(
+    SELECT 1 FROM subscriptions
+    WHERE subscriptions.user_id = users.id
+    AND subscriptions.status IN ('active', 'past_due', 'canceled')
+    AND subscriptions.current_period_end > NOW()
+)
+RETURNING id;
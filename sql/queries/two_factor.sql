@@ -0,0 +1,85 @@
+-- name: UpsertTOTPSecret :one
+INSERT INTO user_totp(user_id, created_at, updated_at, secret, enabled_at, last_used_step)
+VALUES(
+    $1,
+    NOW(),
+    NOW(),
+    $2,
+    NULL,
+    0
+)
+ON CONFLICT (user_id) DO UPDATE
+SET secret = EXCLUDED.secret,
+updated_at = NOW(),
+enabled_at = NULL,
+last_used_step = 0
+RETURNING *;
+
+-- name: GetTOTP :one
+SELECT * FROM user_totp
+WHERE user_id = $1;
+
+-- name: EnableTOTP :exec
+UPDATE user_totp
+SET enabled_at = NOW(),
+updated_at = NOW(),
+last_used_step = $2
+WHERE user_id = $1;
+
+-- name: UseTOTPStep :execrows
+UPDATE user_totp
+SET last_used_step = $2,
+updated_at = NOW()
+WHERE user_id = $1
+AND last_used_step < $2;
+
+-- name: DeleteTOTP :exec
+DELETE FROM user_totp
+WHERE user_id = $1;
+
+-- name: CreateRecoveryCode :exec
+INSERT INTO recovery_codes(id, created_at, user_id, code_hash, used_at)
+VALUES(
+    gen_random_uuid(),
+    NOW(),
+    $1,
+    $2,
+    NULL
+);
+
+-- name: UseRecoveryCode :execrows
+UPDATE recovery_codes
+SET used_at = NOW()
+WHERE user_id = $1
+AND code_hash = $2
+AND used_at IS NULL;
+
+-- name: DeleteRecoveryCodes :exec
+DELETE FROM recovery_codes
+WHERE user_id = $1;
+
+-- name: CreateLoginChallenge :one
+INSERT INTO login_challenges(token, created_at, user_id, expires_at, attempts)
+VALUES(
+    $1,
+    NOW(),
+    $2,
+    $3,
+    0
+)
+RETURNING *;
+
+-- name: GetLoginChallenge :one
+SELECT * FROM login_challenges
+WHERE token = $1
+AND expires_at > NOW();
+
+-- name: IncrementLoginChallengeAttempts :one
+UPDATE login_challenges
+SET attempts = attempts + 1
+WHERE token = $1
+RETURNING attempts;
+
+-- name: DeleteLoginChallenge :exec
+DELETE FROM login_challenges
+WHERE token = $1;
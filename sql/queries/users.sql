@@ -20,17 +20,31 @@ WHERE email = $1;
 SELECT * FROM users
 WHERE id = $1;
 
--- name: UpdateUserData :exec
+-- name: CreateUserWithoutPassword :one
+INSERT INTO users (id, created_at, updated_at, email)
+VALUES (
+    gen_random_uuid(),
+    NOW(),
+    NOW(),
+    $1
+)
+RETURNING *;
+
+
+-- name: UpdatePasswordHash :exec
 UPDATE users
-SET email = $2,
-hashed_password = $3,
-updated_at = NOW()
+SET hashed_password = $2
 WHERE id = $1;
 
-
--- name: MakeChirpyRed :exec
+-- name: UpdateUserEmail :one
 UPDATE users
-SET is_chirpy_red = TRUE,
+SET email = $2,
 updated_at = NOW()
 WHERE id = $1
-AND is_chirpy_red = FALSE;
\ No newline at end of file
+RETURNING *;
+
+-- name: UpdateUserPassword :exec
+UPDATE users
+SET hashed_password = $2,
+updated_at = NOW()
+WHERE id = $1;
@@ -0,0 +1,17 @@
+-- +goose Up
+CREATE TABLE user_roles(
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY(user_id, role)
+);
+
+CREATE TABLE revoked_access_tokens(
+    jti TEXT PRIMARY KEY,
+    revoked_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+-- +goose Down
+DROP TABLE revoked_access_tokens;
+DROP TABLE user_roles;
@@ -0,0 +1,10 @@
+-- +goose Up
+CREATE TABLE login_failures(
+    key TEXT PRIMARY KEY,
+    failed_attempts INTEGER NOT NULL,
+    last_failed_at TIMESTAMP NOT NULL,
+    locked_until TIMESTAMP
+);
+
+-- +goose Down
+DROP TABLE login_failures;
@@ -0,0 +1,34 @@
+-- +goose Up
+CREATE TABLE subscriptions(
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    plan TEXT NOT NULL,
+    status TEXT NOT NULL,
+    current_period_start TIMESTAMP NOT NULL,
+    current_period_end TIMESTAMP NOT NULL
+);
+
+CREATE TABLE subscription_history(
+    id UUID PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    event TEXT NOT NULL,
+    polka_event_id TEXT NOT NULL,
+    plan TEXT NOT NULL,
+    status TEXT NOT NULL,
+    current_period_start TIMESTAMP NOT NULL,
+    current_period_end TIMESTAMP NOT NULL
+);
+
+CREATE INDEX subscription_history_user_id_idx ON subscription_history(user_id, created_at);
+
+-- upgrades before subscriptions were tracked never expired
+INSERT INTO subscriptions(user_id, created_at, updated_at, plan, status, current_period_start, current_period_end)
+SELECT id, NOW(), NOW(), 'red', 'active', updated_at, '9999-12-31'
+FROM users
+WHERE is_chirpy_red = TRUE;
+
+-- +goose Down
+DROP TABLE subscription_history;
+DROP TABLE subscriptions;
@@ -0,0 +1,27 @@
+-- +goose Up
+ALTER TABLE polka_events
+ADD COLUMN payload TEXT,
+ADD COLUMN status TEXT NOT NULL DEFAULT 'processed',
+ADD COLUMN attempts INTEGER NOT NULL DEFAULT 1,
+ADD COLUMN next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ADD COLUMN processed_at TIMESTAMP,
+ADD COLUMN last_error TEXT;
+
+-- events received so far were applied right away
+UPDATE polka_events SET processed_at = received_at;
+
+ALTER TABLE polka_events
+ALTER COLUMN status SET DEFAULT 'pending',
+ALTER COLUMN attempts SET DEFAULT 0;
+
+CREATE INDEX polka_events_pending_idx ON polka_events(next_attempt_at) WHERE status = 'pending';
+
+-- +goose Down
+DROP INDEX polka_events_pending_idx;
+ALTER TABLE polka_events
+DROP COLUMN payload,
+DROP COLUMN status,
+DROP COLUMN attempts,
+DROP COLUMN next_attempt_at,
+DROP COLUMN processed_at,
+DROP COLUMN last_error;
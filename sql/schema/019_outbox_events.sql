@@ -0,0 +1,18 @@
+-- +goose Up
+CREATE TABLE outbox_events(
+    id BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL,
+    event_type TEXT NOT NULL,
+    user_id UUID NOT NULL,
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL,
+    dispatched_at TIMESTAMP,
+    last_error TEXT
+);
+
+CREATE INDEX outbox_events_pending_idx ON outbox_events(id) WHERE status = 'pending';
+
+-- +goose Down
+DROP TABLE outbox_events;
@@ -0,0 +1,20 @@
+-- +goose Up
+CREATE TABLE notifications(
+    id UUID PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    type TEXT NOT NULL,
+    group_key TEXT NOT NULL,
+    chirp_id UUID REFERENCES chirps(id) ON DELETE CASCADE,
+    actor_ids UUID[] NOT NULL,
+    actor_count INTEGER NOT NULL,
+    read_at TIMESTAMP
+);
+
+-- similar notifications are grouped until the group is read
+CREATE UNIQUE INDEX notifications_unread_group_idx ON notifications(user_id, group_key) WHERE read_at IS NULL;
+CREATE INDEX notifications_user_id_idx ON notifications(user_id, updated_at DESC, id DESC);
+
+-- +goose Down
+DROP TABLE notifications;
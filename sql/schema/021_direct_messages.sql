@@ -0,0 +1,46 @@
+-- +goose Up
+CREATE TABLE blocks(
+    blocker_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    blocked_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (blocker_id, blocked_id)
+);
+
+CREATE TABLE conversations(
+    id UUID PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    profanity_filter BOOLEAN NOT NULL DEFAULT TRUE,
+    last_message_at TIMESTAMP
+);
+
+CREATE TABLE conversation_participants(
+    conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    joined_at TIMESTAMP NOT NULL,
+    -- messages up to this point count as read
+    last_read_at TIMESTAMP,
+    muted BOOLEAN NOT NULL DEFAULT FALSE,
+    PRIMARY KEY (conversation_id, user_id)
+);
+
+CREATE INDEX conversation_participants_user_id_idx ON conversation_participants(user_id);
+
+CREATE TABLE messages(
+    id UUID PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL,
+    conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    sender_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    body TEXT NOT NULL
+);
+
+CREATE INDEX messages_conversation_id_idx ON messages(conversation_id, created_at DESC, id DESC);
+
+ALTER TABLE notifications ADD COLUMN conversation_id UUID REFERENCES conversations(id) ON DELETE CASCADE;
+
+-- +goose Down
+ALTER TABLE notifications DROP COLUMN conversation_id;
+DROP TABLE messages;
+DROP TABLE conversation_participants;
+DROP TABLE conversations;
+DROP TABLE blocks;
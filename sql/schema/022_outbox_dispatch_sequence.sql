@@ -0,0 +1,18 @@
+-- +goose Up
+-- Outbox ids are assigned on insert, but events can be dispatched in a
+-- different order when one is retried. Clients resume from the position in
+-- the dispatch order instead, so nothing dispatched late is skipped.
+CREATE SEQUENCE outbox_dispatch_seq;
+ALTER TABLE outbox_events ADD COLUMN dispatch_seq BIGINT;
+
+-- keep the ids clients have already seen valid
+UPDATE outbox_events
+SET dispatch_seq = id
+WHERE status = 'dispatched';
+SELECT setval('outbox_dispatch_seq', COALESCE(MAX(id), 0) + 1, false) FROM outbox_events;
+
+CREATE UNIQUE INDEX outbox_events_dispatch_seq_idx ON outbox_events(dispatch_seq);
+
+-- +goose Down
+ALTER TABLE outbox_events DROP COLUMN dispatch_seq;
+DROP SEQUENCE outbox_dispatch_seq;
@@ -0,0 +1,18 @@
+-- +goose Up
+-- set when a logged-in user starts the login to link another identity
+ALTER TABLE oidc_login_states ADD COLUMN user_id UUID REFERENCES users(id) ON DELETE CASCADE;
+
+-- identities waiting for the password of the account with the same email
+CREATE TABLE oidc_pending_links(
+    token_hash TEXT PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    issuer TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    email TEXT NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+-- +goose Down
+DROP TABLE oidc_pending_links;
+ALTER TABLE oidc_login_states DROP COLUMN user_id;
@@ -0,0 +1,11 @@
+-- +goose Up
+-- Grouped mentions point at the latest chirp of the group. Deleting that
+-- chirp only clears the reference instead of dropping the whole group.
+ALTER TABLE notifications
+    DROP CONSTRAINT notifications_chirp_id_fkey,
+    ADD CONSTRAINT notifications_chirp_id_fkey FOREIGN KEY (chirp_id) REFERENCES chirps(id) ON DELETE SET NULL;
+
+-- +goose Down
+ALTER TABLE notifications
+    DROP CONSTRAINT notifications_chirp_id_fkey,
+    ADD CONSTRAINT notifications_chirp_id_fkey FOREIGN KEY (chirp_id) REFERENCES chirps(id) ON DELETE CASCADE;
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ehumba/chirpy-web-server/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	// events buffered per client before it counts as too slow
+	streamClientBuffer = 64
+	streamHeartbeat    = 15 * time.Second
+	streamRetry        = 3 * time.Second
+	streamReplayBatch  = 500
+)
+
+// events pushed to the chirp stream
+var streamEvents = []string{eventChirpCreated, eventChirpDeleted}
+
+// streamHub fans dispatched events out to the connected stream and
+// WebSocket clients. Publishing never blocks: a client that can't keep up
+// is dropped and resumes from the last event id it received, which replays
+// what it missed from the outbox.
+type streamHub struct {
+	mu      sync.Mutex
+	clients map[*streamClient]struct{}
+	// number of open WebSocket connections per user
+	online map[uuid.UUID]int
+}
+
+type streamClient struct {
+	// wants decides which events the client receives. It is called with
+	// the hub locked and must not block.
+	wants  func(event domainEvent) bool
+	events chan domainEvent
+	// closed when the hub dropped the client
+	dropped chan struct{}
+}
+
+func newStreamHub() *streamHub {
+	return &streamHub{
+		clients: map[*streamClient]struct{}{},
+		online:  map[uuid.UUID]int{},
+	}
+}
+
+func (h *streamHub) subscribe(wants func(event domainEvent) bool) *streamClient {
+	client := &streamClient{
+		wants:   wants,
+		events:  make(chan domainEvent, streamClientBuffer),
+		dropped: make(chan struct{}),
+	}
+	h.mu.Lock()
+	h.clients[client] = struct{}{}
+	h.mu.Unlock()
+	return client
+}
+
+func (h *streamHub) unsubscribe(client *streamClient) {
+	h.mu.Lock()
+	delete(h.clients, client)
+	h.mu.Unlock()
+}
+
+// connect marks a user as online while at least one of their WebSocket
+// connections is open. Going online or offline is published as a
+// presence.changed event, which isn't stored in the outbox.
+func (h *streamHub) connect(userID uuid.UUID) {
+	h.mu.Lock()
+	h.online[userID]++
+	changed := h.online[userID] == 1
+	h.mu.Unlock()
+	if changed {
+		h.publish(presenceEvent(userID, true))
+	}
+}
+
+func (h *streamHub) disconnect(userID uuid.UUID) {
+	h.mu.Lock()
+	h.online[userID]--
+	changed := h.online[userID] <= 0
+	if changed {
+		delete(h.online, userID)
+	}
+	h.mu.Unlock()
+	if changed {
+		h.publish(presenceEvent(userID, false))
+	}
+}
+
+func (h *streamHub) isOnline(userID uuid.UUID) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.online[userID] > 0
+}
+
+type presence struct {
+	UserID uuid.UUID `json:"user_id"`
+	Online bool      `json:"online"`
+}
+
+func presenceEvent(userID uuid.UUID, online bool) domainEvent {
+	data, _ := json.Marshal(presence{UserID: userID, Online: online})
+	return domainEvent{
+		Type:      eventPresenceChanged,
+		UserID:    userID,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	}
+}
+
+// publish is registered as an event bus listener.
+func (h *streamHub) publish(event domainEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for client := range h.clients {
+		if !client.wants(event) {
+			continue
+		}
+		select {
+		case client.events <- event:
+		default:
+			delete(h.clients, client)
+			close(client.dropped)
+		}
+	}
+}
+
+func isStreamEvent(eventType string) bool {
+	for _, e := range streamEvents {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// handlerStream pushes chirp.created and chirp.deleted events as
+// Server-Sent Events. Event ids are positions in the dispatch order, so a
+// reconnecting client gets everything after its Last-Event-ID first.
+func (a *apiConfig) handlerStream(w http.ResponseWriter, r *http.Request) {
+	authorID := uuid.Nil
+	if s := r.URL.Query().Get("author_id"); s != "" {
+		id, err := uuid.Parse(s)
+		if err != nil {
+			respondWithError(w, 400, "invalid author id")
+			return
+		}
+		authorID = id
+	}
+
+	lastEventID := int64(0)
+	if s := r.Header.Get("Last-Event-ID"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || id < 0 {
+			respondWithError(w, 400, "invalid Last-Event-ID")
+			return
+		}
+		lastEventID = id
+	}
+
+	rc := http.NewResponseController(w)
+
+	// subscribe before replaying, so nothing dispatched in between is lost;
+	// events that were replayed already are skipped below
+	client := a.streams.subscribe(func(event domainEvent) bool {
+		return isStreamEvent(event.Type) && (authorID == uuid.Nil || authorID == event.UserID)
+	})
+	defer a.streams.unsubscribe(client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, "retry: %d\n\n", streamRetry.Milliseconds())
+
+	if lastEventID > 0 {
+		var err error
+		lastEventID, err = a.replayStream(r.Context(), w, client, lastEventID)
+		if err != nil {
+			return
+		}
+	}
+	if rc.Flush() != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-client.dropped:
+			// the client reconnects and catches up from its Last-Event-ID
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case event := <-client.events:
+			if event.Seq <= lastEventID {
+				continue
+			}
+			writeStreamEvent(w, event)
+			lastEventID = event.Seq
+		}
+		if rc.Flush() != nil {
+			return
+		}
+	}
+}
+
+// replayStream writes the events after lastEventID that are already in the
+// outbox and returns the id of the last one.
+func (a *apiConfig) replayStream(ctx context.Context, w http.ResponseWriter, client *streamClient, lastEventID int64) (int64, error) {
+	return a.replayEvents(ctx, lastEventID, streamEvents, func(event domainEvent) error {
+		if client.wants(event) {
+			writeStreamEvent(w, event)
+		}
+		return nil
+	})
+}
+
+// replayEvents calls fn with the dispatched events of the given types after
+// the dispatch sequence number lastEventID, in dispatch order, and returns
+// the sequence number of the last one.
+func (a *apiConfig) replayEvents(ctx context.Context, lastEventID int64, eventTypes []string, fn func(event domainEvent) error) (int64, error) {
+	for {
+		eventsDB, err := a.dbQueries.GetDispatchedOutboxEventsAfter(ctx, database.GetDispatchedOutboxEventsAfterParams{
+			AfterSeq:   lastEventID,
+			EventTypes: eventTypes,
+			MaxEvents:  streamReplayBatch,
+		})
+		if err != nil {
+			return lastEventID, err
+		}
+
+		for _, eventDB := range eventsDB {
+			event := domainEvent{
+				ID:        eventDB.ID,
+				Seq:       eventDB.DispatchSeq.Int64,
+				Type:      eventDB.EventType,
+				UserID:    eventDB.UserID,
+				CreatedAt: eventDB.CreatedAt,
+				Data:      []byte(eventDB.Payload),
+			}
+			err = fn(event)
+			if err != nil {
+				return lastEventID, err
+			}
+			lastEventID = event.Seq
+		}
+
+		if len(eventsDB) < streamReplayBatch {
+			return lastEventID, nil
+		}
+	}
+}
+
+func writeStreamEvent(w http.ResponseWriter, event domainEvent) {
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Type, event.Data)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ehumba/chirpy-web-server/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	subscriptionActive   = "active"
+	subscriptionPastDue  = "past_due"
+	subscriptionCanceled = "canceled"
+	subscriptionExpired  = "expired"
+	subscriptionRefunded = "refunded"
+
+	defaultSubscriptionPlan   = "red"
+	subscriptionCheckInterval = time.Hour
+)
+
+// Polka events that change a subscription
+const (
+	polkaUserUpgraded         = "user.upgraded"
+	polkaUserDowngraded       = "user.downgraded"
+	polkaSubscriptionRenewed  = "subscription.renewed"
+	polkaSubscriptionCanceled = "subscription.canceled"
+	polkaPaymentFailed        = "payment.failed"
+	polkaPaymentRefunded      = "payment.refunded"
+)
+
+var errSubscriptionNotFound = errors.New("subscription not found")
+
+func isSubscriptionEvent(event string) bool {
+	switch event {
+	case polkaUserUpgraded, polkaUserDowngraded, polkaSubscriptionRenewed,
+		polkaSubscriptionCanceled, polkaPaymentFailed, polkaPaymentRefunded:
+		return true
+	}
+	return false
+}
+
+type subscriptionEventData struct {
+	Plan               string     `json:"plan"`
+	CurrentPeriodStart *time.Time `json:"current_period_start"`
+	CurrentPeriodEnd   *time.Time `json:"current_period_end"`
+}
+
+// nextSubscription works out the subscription after an event. current is
+// nil if the user never had one. Members keep Chirpy Red while a payment
+// is retried (past_due) and after canceling until the paid period ends;
+// downgrades and refunds end it immediately.
+func nextSubscription(current *database.Subscription, event string, data subscriptionEventData, now time.Time) (database.Subscription, error) {
+	if current == nil && event != polkaUserUpgraded && event != polkaSubscriptionRenewed {
+		return database.Subscription{}, errSubscriptionNotFound
+	}
+
+	next := database.Subscription{Plan: defaultSubscriptionPlan}
+	if current != nil {
+		next = *current
+	}
+	if data.Plan != "" {
+		next.Plan = data.Plan
+	}
+
+	switch event {
+	case polkaUserUpgraded, polkaSubscriptionRenewed:
+		start := now
+		// renewals continue where the paid period ends
+		if event == polkaSubscriptionRenewed && current != nil && current.CurrentPeriodEnd.After(now) {
+			start = current.CurrentPeriodEnd
+		}
+		if data.CurrentPeriodStart != nil {
+			start = *data.CurrentPeriodStart
+		}
+		end := start.AddDate(0, 1, 0)
+		if data.CurrentPeriodEnd != nil {
+			end = *data.CurrentPeriodEnd
+		}
+		next.Status = subscriptionActive
+		next.CurrentPeriodStart = start
+		next.CurrentPeriodEnd = end
+	case polkaPaymentFailed:
+		next.Status = subscriptionPastDue
+	case polkaSubscriptionCanceled:
+		next.Status = subscriptionCanceled
+	case polkaUserDowngraded, polkaPaymentRefunded:
+		next.Status = subscriptionExpired
+		if event == polkaPaymentRefunded {
+			next.Status = subscriptionRefunded
+		}
+		if next.CurrentPeriodEnd.After(now) {
+			next.CurrentPeriodEnd = now
+		}
+	default:
+		return database.Subscription{}, fmt.Errorf("unknown subscription event: %q", event)
+	}
+
+	return next, nil
+}
+
+// applySubscriptionEvent updates the subscription, records it in the
+// history and recomputes is_chirpy_red. q should be bound to the
+// transaction that also records the Polka event.
+func applySubscriptionEvent(ctx context.Context, q *database.Queries, userID uuid.UUID, eventID, event string, data subscriptionEventData) error {
+	var current *database.Subscription
+	subscription, err := q.GetSubscription(ctx, userID)
+	if err == nil {
+		current = &subscription
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	next, err := nextSubscription(current, event, data, time.Now())
+	if err != nil {
+		return err
+	}
+
+	_, err = q.UpsertSubscription(ctx, database.UpsertSubscriptionParams{
+		UserID:             userID,
+		Plan:               next.Plan,
+		Status:             next.Status,
+		CurrentPeriodStart: next.CurrentPeriodStart,
+		CurrentPeriodEnd:   next.CurrentPeriodEnd,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = q.CreateSubscriptionHistory(ctx, database.CreateSubscriptionHistoryParams{
+		UserID:             userID,
+		Event:              event,
+		PolkaEventID:       eventID,
+		Plan:               next.Plan,
+		Status:             next.Status,
+		CurrentPeriodStart: next.CurrentPeriodStart,
+		CurrentPeriodEnd:   next.CurrentPeriodEnd,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = q.SyncChirpyRed(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	return publishSubscriptionUpdated(ctx, q, userID)
+}
+
+// subscriptionUpdate is the payload of subscription.updated events.
+type subscriptionUpdate struct {
+	UserID      uuid.UUID `json:"user_id"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+	exportedSubscription
+}
+
+func publishSubscriptionUpdated(ctx context.Context, q *database.Queries, userID uuid.UUID) error {
+	userDB, err := q.LookUpByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	subscription, err := q.GetSubscription(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	return publishEvent(ctx, q, eventSubscriptionUpdated, userID, subscriptionUpdate{
+		UserID:      userID,
+		IsChirpyRed: userDB.IsChirpyRed,
+		exportedSubscription: exportedSubscription{
+			Plan:               subscription.Plan,
+			Status:             subscription.Status,
+			CurrentPeriodStart: subscription.CurrentPeriodStart,
+			CurrentPeriodEnd:   subscription.CurrentPeriodEnd,
+		},
+	})
+}
+
+// expireSubscriptions takes Chirpy Red away from users whose paid period
+// has ended without a renewal.
+func (a *apiConfig) expireSubscriptions(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		expired, err := a.expireChirpyRed(ctx)
+		if err != nil {
+			log.Printf("failed to expire subscriptions: %v", err)
+		} else if expired > 0 {
+			log.Printf("expired %d subscriptions", expired)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *apiConfig) expireChirpyRed(ctx context.Context) (int, error) {
+	tx, err := a.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	qtx := a.dbQueries.WithTx(tx)
+
+	userIDs, err := qtx.ExpireChirpyRed(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, userID := range userIDs {
+		err = publishSubscriptionUpdated(ctx, qtx, userID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	a.events.Wake()
+	return len(userIDs), nil
+}
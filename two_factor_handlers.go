@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/ehumba/chirpy-web-server/internal/auth"
+	"github.com/ehumba/chirpy-web-server/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	totpIssuer             = "Chirpy"
+	recoveryCodeCount      = 10
+	maxLoginChallengeTries = 5
+)
+
+func (a *apiConfig) handlerEnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	caller := principalFromContext(r.Context())
+	if !requireSession(w, caller) {
+		return
+	}
+	userID := caller.UserID
+
+	userDB, err := a.dbQueries.LookUpByID(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, 404, "user not found")
+		return
+	}
+
+	existing, err := a.dbQueries.GetTOTP(r.Context(), userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, 500, "failed to look up two-factor settings")
+		return
+	}
+	if err == nil && existing.EnabledAt.Valid {
+		respondWithError(w, 409, "two-factor authentication is already enabled")
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		respondWithError(w, 500, "failed to generate two-factor secret")
+		return
+	}
+
+	recoveryCodes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		respondWithError(w, 500, "failed to generate recovery codes")
+		return
+	}
+
+	_, err = a.dbQueries.UpsertTOTPSecret(r.Context(), database.UpsertTOTPSecretParams{
+		UserID: userID,
+		Secret: secret,
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to save two-factor secret")
+		return
+	}
+
+	err = a.dbQueries.DeleteRecoveryCodes(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, 500, "failed to reset recovery codes")
+		return
+	}
+
+	for _, code := range recoveryCodes {
+		err = a.dbQueries.CreateRecoveryCode(r.Context(), database.CreateRecoveryCodeParams{
+			UserID:   userID,
+			CodeHash: auth.HashRecoveryCode(code),
+		})
+		if err != nil {
+			respondWithError(w, 500, "failed to save recovery codes")
+			return
+		}
+	}
+
+	resStruct := struct {
+		Secret        string   `json:"secret"`
+		OTPAuthURI    string   `json:"otpauth_uri"`
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{
+		Secret:        secret,
+		OTPAuthURI:    auth.TOTPURI(totpIssuer, userDB.Email, secret),
+		RecoveryCodes: recoveryCodes,
+	}
+
+	respondWithJSON(w, 201, resStruct)
+}
+
+func (a *apiConfig) handlerConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	caller := principalFromContext(r.Context())
+	if !requireSession(w, caller) {
+		return
+	}
+	userID := caller.UserID
+
+	type reqParams struct {
+		Code string `json:"code"`
+	}
+
+	params := reqParams{}
+	err := decodeJSON(r, &params)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+
+	totp, err := a.dbQueries.GetTOTP(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, 404, "two-factor enrollment not started")
+		return
+	}
+	if totp.EnabledAt.Valid {
+		respondWithError(w, 409, "two-factor authentication is already enabled")
+		return
+	}
+
+	step, ok := auth.ValidateTOTP(params.Code, totp.Secret, time.Now())
+	if !ok {
+		respondWithError(w, 401, "invalid two-factor code")
+		return
+	}
+
+	err = a.dbQueries.EnableTOTP(r.Context(), database.EnableTOTPParams{
+		UserID:       userID,
+		LastUsedStep: step,
+	})
+	if err != nil {
+		respondWithError(w, 500, "failed to enable two-factor authentication")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *apiConfig) handlerDisableTOTP(w http.ResponseWriter, r *http.Request) {
+	caller := principalFromContext(r.Context())
+	if !requireSession(w, caller) {
+		return
+	}
+	userID := caller.UserID
+
+	type reqParams struct {
+		Code string `json:"code"`
+	}
+
+	params := reqParams{}
+	err := decodeJSON(r, &params)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+
+	ok, err := a.verifySecondFactor(r.Context(), userID, params.Code)
+	if err != nil {
+		respondWithError(w, 500, "failed to verify two-factor code")
+		return
+	}
+	if !ok {
+		respondWithError(w, 401, "invalid two-factor code")
+		return
+	}
+
+	err = a.dbQueries.DeleteTOTP(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, 500, "failed to disable two-factor authentication")
+		return
+	}
+
+	err = a.dbQueries.DeleteRecoveryCodes(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, 500, "failed to delete recovery codes")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *apiConfig) handlerLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+	}
+
+	params := parameters{}
+	err := decodeJSON(r, &params)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+
+	challenge, err := a.dbQueries.GetLoginChallenge(r.Context(), params.ChallengeToken)
+	if err != nil {
+		respondWithError(w, 401, "invalid or expired login challenge")
+		return
+	}
+
+	attempts, err := a.dbQueries.IncrementLoginChallengeAttempts(r.Context(), challenge.Token)
+	if err != nil {
+		respondWithError(w, 500, "failed to update login challenge")
+		return
+	}
+	if attempts > maxLoginChallengeTries {
+		a.dbQueries.DeleteLoginChallenge(r.Context(), challenge.Token)
+		respondWithError(w, 401, "too many attempts, please log in again")
+		return
+	}
+
+	userDB, err := a.dbQueries.LookUpByID(r.Context(), challenge.UserID)
+	if err != nil {
+		respondWithError(w, 500, "failed to look up user")
+		return
+	}
+
+	// wrong codes count against the account like wrong passwords, so new
+	// challenges don't mean new guesses
+	accountKey := accountThrottleKey(userDB.Email)
+	lockedUntil, err := a.loginLockedUntil(r.Context(), accountKey)
+	if err != nil {
+		respondWithError(w, 500, "failed to check login attempts")
+		return
+	}
+	if !lockedUntil.IsZero() {
+		respondWithLockout(w, lockedUntil)
+		return
+	}
+
+	ok, err := a.verifySecondFactor(r.Context(), challenge.UserID, params.Code)
+	if err != nil {
+		respondWithError(w, 500, "failed to verify two-factor code")
+		return
+	}
+	if !ok {
+		err = a.recordLoginFailure(r.Context(), accountKey, accountLoginThrottle)
+		if err != nil {
+			respondWithError(w, 500, "failed to record login attempt")
+			return
+		}
+		respondWithError(w, 401, "invalid two-factor code")
+		return
+	}
+
+	err = a.dbQueries.DeleteLoginChallenge(r.Context(), challenge.Token)
+	if err != nil {
+		respondWithError(w, 500, "failed to complete login challenge")
+		return
+	}
+
+	a.respondWithTokens(w, r, userDB)
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused recovery
+// code. Each TOTP step and each recovery code can only be used once.
+func (a *apiConfig) verifySecondFactor(ctx context.Context, userID uuid.UUID, code string) (bool, error) {
+	totp, err := a.dbQueries.GetTOTP(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !totp.EnabledAt.Valid) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if step, ok := auth.ValidateTOTP(code, totp.Secret, time.Now()); ok {
+		rows, err := a.dbQueries.UseTOTPStep(ctx, database.UseTOTPStepParams{
+			UserID:       userID,
+			LastUsedStep: step,
+		})
+		if err != nil {
+			return false, err
+		}
+		return rows == 1, nil
+	}
+
+	rows, err := a.dbQueries.UseRecoveryCode(ctx, database.UseRecoveryCodeParams{
+		UserID:   userID,
+		CodeHash: auth.HashRecoveryCode(code),
+	})
+	if err != nil {
+		return false, err
+	}
+	return rows == 1, nil
+}
@@ -1,64 +1,218 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/ehumba/chirpy-web-server/internal/auth"
+	"github.com/ehumba/chirpy-web-server/internal/database"
 	"github.com/google/uuid"
 )
 
+const (
+	polkaSignatureHeader    = "Polka-Signature"
+	polkaSignatureTolerance = 5 * time.Minute
+	maxWebhookBodyBytes     = 1 << 20
+
+	polkaEventPending   = "pending"
+	polkaEventProcessed = "processed"
+	polkaEventIgnored   = "ignored"
+	polkaEventFailed    = "failed"
+
+	polkaPollInterval = 2 * time.Second
+	polkaMaxAttempts  = 8
+)
+
+var (
+	errInvalidPolkaEvent = errors.New("invalid event payload")
+	errPolkaUserNotFound = errors.New("user not found")
+)
+
+type polkaEventPayload struct {
+	ID    string `json:"id"`
+	Event string `json:"event"`
+	Data  struct {
+		UserID string `json:"user_id"`
+		subscriptionEventData
+	} `json:"data"`
+}
+
+// handlerWebhooks stores the event in the Polka inbox and acknowledges it.
+// The event is applied by processPolkaEvents, so a failure while applying
+// it is retried by us instead of depending on Polka to send it again.
 func (a *apiConfig) handlerWebhooks(w http.ResponseWriter, r *http.Request) {
-	apiKey, err := auth.GetAPIKey(r.Header)
+	// the signature covers the exact bytes that were sent, so read them
+	// before decoding anything
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodyBytes))
 	if err != nil {
-		respondWithError(w, 401, "invalid authorization header")
+		respondWithError(w, 400, "could not read request body")
 		return
 	}
 
-	if apiKey != a.polkaKey {
-		respondWithError(w, 401, "invalid API key")
+	err = auth.VerifyWebhook(r.Header.Get(polkaSignatureHeader), body, a.polkaKeys, polkaSignatureTolerance, time.Now())
+	if errors.Is(err, auth.ErrSignatureTimestamp) {
+		respondWithError(w, 401, "webhook timestamp is too old or too far in the future")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 401, "invalid webhook signature")
 		return
 	}
 
-	type data struct {
-		UserID string `json:"user_id"`
+	params := polkaEventPayload{}
+	err = json.Unmarshal(body, &params)
+	if err != nil {
+		respondWithError(w, 400, "could not decode parameters")
+		return
+	}
+
+	status := polkaEventPending
+	if !isSubscriptionEvent(params.Event) {
+		status = polkaEventIgnored
 	}
 
-	type reqParams struct {
-		Event string `json:"event"`
-		Data  data   `json:"data"`
+	if params.ID == "" {
+		if status != polkaEventIgnored {
+			respondWithError(w, 400, "event id is required")
+			return
+		}
+		// ignored events are kept for the admins as well; a retry has the
+		// same body and is stored only once
+		params.ID = "body:" + auth.HashToken(string(body))
 	}
 
-	decoder := json.NewDecoder(r.Body)
-	params := reqParams{}
-	err = decoder.Decode(&params)
+	// events that were already received are not stored again, which
+	// acknowledges retries without applying them twice
+	_, err = a.dbQueries.RecordPolkaEvent(r.Context(), database.RecordPolkaEventParams{
+		ID:      params.ID,
+		Event:   params.Event,
+		Payload: sql.NullString{String: string(body), Valid: true},
+		Status:  status,
+	})
 	if err != nil {
-		respondWithError(w, 400, "invalid request")
+		respondWithError(w, 500, "failed to record event")
 		return
 	}
 
-	if params.Event != "user.upgraded" {
-		w.WriteHeader(http.StatusNoContent)
-		return
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// processPolkaEvents applies pending events from the Polka inbox in the
+// order they were received.
+func (a *apiConfig) processPolkaEvents(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for a.processNextPolkaEvent(ctx) {
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
+}
 
-	id, err := uuid.Parse(params.Data.UserID)
+// processNextPolkaEvent applies one pending event and reports whether there
+// may be more to process. The event stays locked while it is applied, and
+// a failed attempt is rolled back to a savepoint so that only the failure
+// is recorded.
+func (a *apiConfig) processNextPolkaEvent(ctx context.Context) bool {
+	tx, err := a.db.BeginTx(ctx, nil)
 	if err != nil {
-		respondWithError(w, 400, "invalid user id format")
-		return
+		log.Printf("failed to start transaction: %v", err)
+		return false
 	}
+	defer tx.Rollback()
+	qtx := a.dbQueries.WithTx(tx)
 
-	_, err = a.dbQueries.LookUpByID(r.Context(), id)
+	event, err := qtx.ClaimPendingPolkaEvent(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false
+	}
 	if err != nil {
-		respondWithError(w, 404, "user not found")
-		return
+		log.Printf("failed to claim polka event: %v", err)
+		return false
 	}
 
-	err = a.dbQueries.MakeChirpyRed(r.Context(), id)
+	_, err = tx.ExecContext(ctx, "SAVEPOINT apply_polka_event")
 	if err != nil {
-		respondWithError(w, 500, "unable to upgrade user to chirpy red")
-		return
+		log.Printf("failed to create savepoint: %v", err)
+		return false
 	}
 
-	w.WriteHeader(http.StatusNoContent)
+	applyErr := applyPolkaEvent(ctx, qtx, event)
+	if applyErr == nil {
+		err = qtx.MarkPolkaEventProcessed(ctx, event.ID)
+	} else {
+		_, err = tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT apply_polka_event")
+		if err == nil {
+			err = qtx.RecordPolkaEventFailure(ctx, polkaEventFailure(event, applyErr))
+		}
+		log.Printf("failed to apply polka event %s: %v", event.ID, applyErr)
+	}
+	if err != nil {
+		log.Printf("failed to update polka event %s: %v", event.ID, err)
+		return false
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("failed to save polka event %s: %v", event.ID, err)
+		return false
+	}
+	a.events.Wake()
+	return true
+}
+
+// polkaEventFailure schedules the next attempt. Events that can never
+// succeed fail right away, others are retried with backoff until they run
+// out of attempts.
+func polkaEventFailure(event database.PolkaEvent, err error) database.RecordPolkaEventFailureParams {
+	attempts := int(event.Attempts) + 1
+	failure := database.RecordPolkaEventFailureParams{
+		ID:            event.ID,
+		Status:        polkaEventPending,
+		NextAttemptAt: time.Now().Add(webhookRetryDelay(attempts)),
+		LastError:     sql.NullString{String: err.Error(), Valid: true},
+	}
+	if attempts >= polkaMaxAttempts ||
+		errors.Is(err, errInvalidPolkaEvent) ||
+		errors.Is(err, errPolkaUserNotFound) ||
+		errors.Is(err, errSubscriptionNotFound) {
+		failure.Status = polkaEventFailed
+	}
+	return failure
+}
+
+func applyPolkaEvent(ctx context.Context, q *database.Queries, event database.PolkaEvent) error {
+	params := polkaEventPayload{}
+	err := json.Unmarshal([]byte(event.Payload.String), &params)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidPolkaEvent, err)
+	}
+
+	id, err := uuid.Parse(params.Data.UserID)
+	if err != nil {
+		return fmt.Errorf("%w: invalid user id format", errInvalidPolkaEvent)
+	}
+
+	_, err = q.LookUpByID(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errPolkaUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	return applySubscriptionEvent(ctx, q, id, event.ID, event.Event, params.Data.subscriptionEventData)
 }
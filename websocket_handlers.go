@@ -0,0 +1,519 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ehumba/chirpy-web-server/internal/auth"
+	"github.com/ehumba/chirpy-web-server/internal/database"
+	"github.com/ehumba/chirpy-web-server/internal/websocket"
+	"github.com/google/uuid"
+)
+
+const (
+	wsPingInterval = 30 * time.Second
+	// a client that misses two pings is gone
+	wsReadTimeout  = 75 * time.Second
+	wsWriteTimeout = 10 * time.Second
+	// how long a client that didn't send an Authorization header has to
+	// send its token
+	wsAuthTimeout = 10 * time.Second
+	// how long before the token expires the client is asked for a new one
+	wsAuthWarning = time.Minute
+	// how long to wait for the client to confirm a close
+	wsCloseTimeout = 5 * time.Second
+	// replies queued for the writer before the client counts as flooding
+	wsReplyBuffer    = 16
+	wsMaxMessageSize = 4 << 10
+	maxPresenceUsers = 100
+
+	wsCloseAuthFailed   = 4001
+	wsCloseTokenExpired = 4002
+)
+
+const (
+	wsChannelTimeline      = "timeline"
+	wsChannelNotifications = "notifications"
+	wsChannelPresence      = "presence"
+)
+
+// wsClientMessage is a message from the client. Type is one of auth,
+// subscribe, unsubscribe and ping.
+type wsClientMessage struct {
+	Type        string      `json:"type"`
+	Token       string      `json:"token"`
+	Channel     string      `json:"channel"`
+	AuthorID    uuid.UUID   `json:"author_id"`
+	LastEventID int64       `json:"last_event_id"`
+	UserIDs     []uuid.UUID `json:"user_ids"`
+}
+
+type wsServerMessage struct {
+	Type      string          `json:"type"`
+	Channel   string          `json:"channel,omitempty"`
+	ID        int64           `json:"id,omitempty"`
+	Event     string          `json:"event,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Presence  []presence      `json:"presence,omitempty"`
+	ExpiresAt *time.Time      `json:"expires_at,omitempty"`
+	Error     string          `json:"error,omitempty"`
+
+	// events of the channel after this dispatch sequence number are
+	// replayed once the message was sent
+	replayAfter int64
+}
+
+// wsSession is the state of one WebSocket connection. Subscriptions are
+// changed by the reading goroutine and read by the hub, everything is sent
+// by the writing goroutine.
+type wsSession struct {
+	conn *websocket.Conn
+
+	mu             sync.Mutex
+	caller         *principal
+	timeline       bool
+	timelineAuthor uuid.UUID
+	notifications  bool
+	presence       map[uuid.UUID]bool
+
+	replies chan wsServerMessage
+	// new token expiry after a re-authentication
+	expiry  chan time.Time
+	closing atomic.Bool
+}
+
+// wants is the hub filter of the session.
+func (s *wsSession) wants(event domainEvent) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch wsEventChannel(event.Type) {
+	case wsChannelTimeline:
+		return s.timeline && (s.timelineAuthor == uuid.Nil || s.timelineAuthor == event.UserID)
+	case wsChannelNotifications:
+		return s.notifications && event.UserID == s.caller.UserID
+	case wsChannelPresence:
+		return s.presence[event.UserID]
+	}
+	return false
+}
+
+func wsEventChannel(eventType string) string {
+	switch {
+	case isStreamEvent(eventType):
+		return wsChannelTimeline
+	case eventType == eventNotificationCreated:
+		return wsChannelNotifications
+	case eventType == eventPresenceChanged:
+		return wsChannelPresence
+	}
+	return ""
+}
+
+// wsChannelEvents lists the outbox events a channel can replay.
+func wsChannelEvents(channel string) []string {
+	switch channel {
+	case wsChannelTimeline:
+		return streamEvents
+	case wsChannelNotifications:
+		return []string{eventNotificationCreated}
+	}
+	return nil
+}
+
+// reply queues a message for the writer. A client that sends messages
+// faster than it reads the replies is disconnected.
+func (s *wsSession) reply(message wsServerMessage) bool {
+	select {
+	case s.replies <- message:
+		return true
+	default:
+		s.close(websocket.ClosePolicyViolation, "too many messages")
+		return false
+	}
+}
+
+// close starts the closing handshake and gives the client wsCloseTimeout
+// to confirm it.
+func (s *wsSession) close(code int, reason string) {
+	s.closing.Store(true)
+	s.conn.WriteClose(code, reason)
+	s.conn.SetReadDeadline(time.Now().Add(wsCloseTimeout))
+}
+
+func (s *wsSession) extendReadDeadline() {
+	if !s.closing.Load() {
+		s.conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+	}
+}
+
+func (s *wsSession) send(message wsServerMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return s.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func wsEventMessage(event domainEvent) wsServerMessage {
+	return wsServerMessage{
+		Type:    "event",
+		Channel: wsEventChannel(event.Type),
+		ID:      event.Seq,
+		Event:   event.Type,
+		Data:    event.Data,
+	}
+}
+
+func wsError(channel, msg string) wsServerMessage {
+	return wsServerMessage{Type: "error", Channel: channel, Error: msg}
+}
+
+// handlerWebSocket carries timeline events, notifications and presence
+// over a single connection. The protocol is described in the README.
+func (a *apiConfig) handlerWebSocket(w http.ResponseWriter, r *http.Request) {
+	// browsers can't set headers on a WebSocket, so the token can also be
+	// sent as the first message. Cookies are not accepted, which means other
+	// sites can't open a connection on behalf of a user.
+	var caller *principal
+	token, err := auth.GetBearerToken(r.Header)
+	if err == nil {
+		caller, err = a.authenticate(r.Context(), token)
+		if err != nil {
+			setAuthenticateHeader(w, "invalid_token", "the access token is invalid, expired or revoked", "")
+			respondWithError(w, 401, "invalid or expired token")
+			return
+		}
+	} else if !errors.Is(err, auth.ErrNoAuthHeader) {
+		setAuthenticateHeader(w, "invalid_request", "malformed authorization header", "")
+		respondWithError(w, 400, "malformed authorization header")
+		return
+	}
+
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.MaxMessageSize = wsMaxMessageSize
+	conn.WriteTimeout = wsWriteTimeout
+
+	s := &wsSession{
+		conn:     conn,
+		presence: map[uuid.UUID]bool{},
+		replies:  make(chan wsServerMessage, wsReplyBuffer),
+		expiry:   make(chan time.Time, 1),
+	}
+
+	if caller == nil {
+		caller, err = a.authenticateWebSocket(r.Context(), conn)
+		if err != nil {
+			s.close(wsCloseAuthFailed, err.Error())
+			// wait for the client to confirm
+			conn.ReadMessage()
+			return
+		}
+		s.reply(authenticatedMessage(caller))
+	}
+	s.caller = caller
+
+	client := a.streams.subscribe(s.wants)
+	defer a.streams.unsubscribe(client)
+	a.streams.connect(caller.UserID)
+	defer a.streams.disconnect(caller.UserID)
+
+	done := make(chan struct{})
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		a.writeWebSocket(r.Context(), s, client, done)
+	}()
+
+	a.readWebSocket(r.Context(), s)
+	close(done)
+	<-writerDone
+}
+
+// authenticateWebSocket expects an auth message as the first message.
+func (a *apiConfig) authenticateWebSocket(ctx context.Context, conn *websocket.Conn) (*principal, error) {
+	conn.SetReadDeadline(time.Now().Add(wsAuthTimeout))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return nil, errors.New("authentication required")
+	}
+
+	message := wsClientMessage{}
+	err = json.Unmarshal(data, &message)
+	if err != nil || message.Type != "auth" {
+		return nil, errors.New("authentication required")
+	}
+
+	caller, err := a.authenticate(ctx, message.Token)
+	if err != nil {
+		return nil, errors.New("invalid or expired token")
+	}
+	return caller, nil
+}
+
+func authenticatedMessage(caller *principal) wsServerMessage {
+	message := wsServerMessage{Type: "authenticated"}
+	if !caller.ExpiresAt.IsZero() {
+		message.ExpiresAt = &caller.ExpiresAt
+	}
+	return message
+}
+
+func (a *apiConfig) readWebSocket(ctx context.Context, s *wsSession) {
+	s.extendReadDeadline()
+	s.conn.SetPongHandler(func([]byte) {
+		s.extendReadDeadline()
+	})
+
+	for {
+		messageType, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		s.extendReadDeadline()
+
+		if messageType != websocket.TextMessage {
+			s.close(websocket.CloseUnsupportedData, "only text messages are supported")
+			continue
+		}
+
+		message := wsClientMessage{}
+		err = json.Unmarshal(data, &message)
+		if err != nil {
+			if !s.reply(wsError("", "invalid message")) {
+				return
+			}
+			continue
+		}
+
+		var reply wsServerMessage
+		switch message.Type {
+		case "ping":
+			reply = wsServerMessage{Type: "pong"}
+		case "auth":
+			reply = a.reauthenticateWebSocket(ctx, s, message.Token)
+		case "subscribe":
+			reply = a.subscribeWebSocket(ctx, s, message)
+		case "unsubscribe":
+			reply = s.unsubscribe(message.Channel)
+		default:
+			reply = wsError("", "unknown message type")
+		}
+		if !s.reply(reply) {
+			return
+		}
+	}
+}
+
+// reauthenticateWebSocket swaps the token of a connection before the old
+// one expires. The new token must belong to the same user. Channels it has
+// no scope for are unsubscribed.
+func (a *apiConfig) reauthenticateWebSocket(ctx context.Context, s *wsSession, token string) wsServerMessage {
+	caller, err := a.authenticate(ctx, token)
+	if err != nil {
+		return wsError("", "invalid or expired token")
+	}
+
+	s.mu.Lock()
+	if caller.UserID != s.caller.UserID {
+		s.mu.Unlock()
+		return wsError("", "the token belongs to a different user")
+	}
+	s.caller = caller
+	if !caller.HasScope(auth.ScopeChirpsRead) {
+		s.timeline = false
+	}
+	if !caller.HasScope(auth.ScopeNotificationsRead) {
+		s.notifications = false
+	}
+	s.mu.Unlock()
+
+	// only the latest expiry matters
+	select {
+	case <-s.expiry:
+	default:
+	}
+	s.expiry <- caller.ExpiresAt
+
+	return authenticatedMessage(caller)
+}
+
+func (a *apiConfig) subscribeWebSocket(ctx context.Context, s *wsSession, message wsClientMessage) wsServerMessage {
+	if message.LastEventID < 0 {
+		return wsError(message.Channel, "invalid last_event_id")
+	}
+
+	switch message.Channel {
+	case wsChannelTimeline:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if !s.caller.HasScope(auth.ScopeChirpsRead) {
+			return wsError(message.Channel, "token is missing the "+auth.ScopeChirpsRead+" scope")
+		}
+		s.timeline = true
+		s.timelineAuthor = message.AuthorID
+	case wsChannelNotifications:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if !s.caller.HasScope(auth.ScopeNotificationsRead) {
+			return wsError(message.Channel, "token is missing the "+auth.ScopeNotificationsRead+" scope")
+		}
+		s.notifications = true
+	case wsChannelPresence:
+		return a.subscribePresence(ctx, s, message.UserIDs)
+	default:
+		return wsError(message.Channel, "unknown channel")
+	}
+
+	return wsServerMessage{Type: "subscribed", Channel: message.Channel, replayAfter: message.LastEventID}
+}
+
+// subscribePresence adds users to the presence channel and replies with
+// whether they are online right now. Users who blocked the caller, or whom
+// the caller blocked, can't be watched.
+func (a *apiConfig) subscribePresence(ctx context.Context, s *wsSession, userIDs []uuid.UUID) wsServerMessage {
+	if len(userIDs) == 0 {
+		return wsError(wsChannelPresence, "user_ids is required")
+	}
+
+	s.mu.Lock()
+	callerID := s.caller.UserID
+	s.mu.Unlock()
+
+	blocked, err := a.dbQueries.HasBlockBetween(ctx, database.HasBlockBetweenParams{
+		UserID:   callerID,
+		OtherIds: userIDs,
+	})
+	if err != nil {
+		return wsError(wsChannelPresence, "failed to check blocks")
+	}
+	if blocked {
+		return wsError(wsChannelPresence, "you can't see the presence of users you blocked or who blocked you")
+	}
+
+	s.mu.Lock()
+	added := 0
+	for _, id := range userIDs {
+		if !s.presence[id] {
+			added++
+		}
+	}
+	if len(s.presence)+added > maxPresenceUsers {
+		s.mu.Unlock()
+		return wsError(wsChannelPresence, "presence is limited to 100 users per connection")
+	}
+	for _, id := range userIDs {
+		s.presence[id] = true
+	}
+	s.mu.Unlock()
+
+	// the hub locks the session while publishing, so it is only asked once
+	// the session is unlocked
+	snapshot := []presence{}
+	for _, id := range userIDs {
+		snapshot = append(snapshot, presence{UserID: id, Online: a.streams.isOnline(id)})
+	}
+	return wsServerMessage{Type: "subscribed", Channel: wsChannelPresence, Presence: snapshot}
+}
+
+func (s *wsSession) unsubscribe(channel string) wsServerMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch channel {
+	case wsChannelTimeline:
+		s.timeline = false
+	case wsChannelNotifications:
+		s.notifications = false
+	case wsChannelPresence:
+		s.presence = map[uuid.UUID]bool{}
+	default:
+		return wsError(channel, "unknown channel")
+	}
+	return wsServerMessage{Type: "unsubscribed", Channel: channel}
+}
+
+// writeWebSocket sends events, replies and pings until done is closed. Like
+// the event stream, a connection that falls behind is closed and the client
+// resumes with last_event_id.
+func (a *apiConfig) writeWebSocket(ctx context.Context, s *wsSession, client *streamClient, done <-chan struct{}) {
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	var expiresAt time.Time
+	var warning, expiry *time.Timer
+	setExpiry := func(t time.Time) {
+		expiresAt = t
+		if warning != nil {
+			warning.Stop()
+			expiry.Stop()
+			warning, expiry = nil, nil
+		}
+		if !expiresAt.IsZero() {
+			warning = time.NewTimer(time.Until(expiresAt) - wsAuthWarning)
+			expiry = time.NewTimer(time.Until(expiresAt))
+		}
+	}
+	setExpiry(s.caller.ExpiresAt)
+	defer setExpiry(time.Time{})
+
+	// the dispatch sequence number of the last event sent per channel, so
+	// replayed events aren't sent twice. Presence events have none.
+	lastEventIDs := map[string]int64{}
+
+	for {
+		var warningC, expiryC <-chan time.Time
+		if warning != nil {
+			warningC, expiryC = warning.C, expiry.C
+		}
+
+		var err error
+		select {
+		case <-done:
+			return
+		case <-client.dropped:
+			s.close(websocket.CloseTryAgainLater, "too slow, reconnect with last_event_id")
+			return
+		case <-ping.C:
+			err = s.conn.WriteMessage(websocket.PingMessage, nil)
+		case t := <-s.expiry:
+			setExpiry(t)
+		case <-warningC:
+			err = s.send(wsServerMessage{Type: "auth_expiring", ExpiresAt: &expiresAt})
+		case <-expiryC:
+			s.close(wsCloseTokenExpired, "token expired")
+			return
+		case event := <-client.events:
+			channel := wsEventChannel(event.Type)
+			if event.Seq != 0 && event.Seq <= lastEventIDs[channel] {
+				continue
+			}
+			err = s.send(wsEventMessage(event))
+			if event.Seq != 0 {
+				lastEventIDs[channel] = event.Seq
+			}
+		case reply := <-s.replies:
+			err = s.send(reply)
+			if err == nil && reply.replayAfter > 0 {
+				lastEventIDs[reply.Channel], err = a.replayEvents(ctx, reply.replayAfter, wsChannelEvents(reply.Channel), func(event domainEvent) error {
+					if !s.wants(event) {
+						return nil
+					}
+					return s.send(wsEventMessage(event))
+				})
+			}
+		}
+		if err != nil {
+			s.conn.Close()
+			return
+		}
+	}
+}